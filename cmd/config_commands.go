@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"TerminalBuddyServer/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configCommands = []*command{
+	{"check", "", "check the config and print it resolved, with secrets redacted", runConfigCheck},
+}
+
+func runConfig(args []string) error {
+	return runCommand("config", configCommands, args)
+}
+
+func runConfigCheck(args []string) error {
+	fs := newFlagSet("config check", "")
+	configFlags := addConfigFlags(fs)
+	parseArgs(fs, args, 0)
+
+	tbConfig, err := configFlags.load()
+	var validationErr *config.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, p := range validationErr.Problems {
+			fmt.Fprintf(os.Stderr, "problem: %s\n", p)
+		}
+		return fmt.Errorf("config of env %s not ok", validationErr.Env)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the resolved config, after env vars and flags
+	envConfig, err := yaml.Marshal(tbConfig.Config.Redacted())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("env: %s\n%s", tbConfig.Env, envConfig)
+	fmt.Fprintln(os.Stderr, "config ok")
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+var dbCommands = []*command{
+	{"migrate", "", "create the schema and apply migrations", runDbMigrate},
+	{"backup", "", "write all tables as JSON", runDbBackup},
+	{"restore", "", "replace all data with a backup", runDbRestore},
+}
+
+func runDb(args []string) error {
+	return runCommand("db", dbCommands, args)
+}
+
+func runDbMigrate(args []string) error {
+	fs := newFlagSet("db migrate", "")
+	flags := addConfigFlags(fs)
+	parseArgs(fs, args, 0)
+
+	// opening the DB creates and migrates the schema
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fmt.Println("schema is up to date")
+	return nil
+}
+
+func runDbBackup(args []string) error {
+	fs := newFlagSet("db backup", "")
+	flags := addConfigFlags(fs)
+	output := fs.String("o", "", "backup file, stdout if empty")
+	parseArgs(fs, args, 0)
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(*output) == 0 {
+		if err := db.Backup(os.Stdout); err != nil {
+			return fmt.Errorf("backup failed: %w", err)
+		}
+		return nil
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := db.Backup(file); err != nil {
+		file.Close()
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backup written to %s\n", *output)
+	return nil
+}
+
+func runDbRestore(args []string) error {
+	fs := newFlagSet("db restore", "")
+	flags := addConfigFlags(fs)
+	input := fs.String("i", "", "backup file, stdin if empty")
+	force := fs.Bool("force", false, "restore even if the DB has users, their data is replaced")
+	parseArgs(fs, args, 0)
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.GetStats()
+	if err != nil {
+		return err
+	}
+	if stats.Users > 0 && !*force {
+		return fmt.Errorf("DB has %d users, use -force to replace them", stats.Users)
+	}
+
+	var r io.Reader = os.Stdin
+	if len(*input) > 0 {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	if err := db.Restore(r); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	fmt.Println("backup restored, restart running servers")
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"TerminalBuddyServer/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	logFileMode        = 0640
+	logBackupTimestamp = "2006-01-02T15-04-05.000"
+)
+
+// commandLoggingSetup keeps command output clean, only warnings (e.g. audit logs) and errors go to stderr
+func commandLoggingSetup() {
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+}
+
+// logOutput is the current log output, closed when logging is set up again, e.g. on reload
+var logOutput io.Closer
+
+// configLoggingSetup applies the log settings. If the log file cannot be opened, the error is returned and the
+// previous settings and output stay, so a bad reload does not stop the logs.
+func configLoggingSetup(tbConfig *config.TBConfig) error {
+	logConfig := tbConfig.Log()
+
+	var output io.Writer = os.Stdout
+	var outputCloser io.Closer
+	if tbConfig.LogOutput() == config.FileLogOutput {
+		logFileName := logConfig.File
+		if !strings.HasSuffix(logFileName, ".log") {
+			logFileName += ".log"
+		}
+
+		file, err := openRotatingFile(logFileName, int64(logConfig.MaxSizeMb)*1024*1024, logConfig.MaxBackups,
+			time.Duration(logConfig.MaxAgeDays)*24*time.Hour)
+		if err != nil {
+			return fmt.Errorf("failed to open log file %q: %w", logFileName, err)
+		}
+		output, outputCloser = file, file
+	}
+
+	switch strings.ToLower(logConfig.Level) {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	case "fatal":
+		log.SetLevel(log.FatalLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "trace":
+		log.SetLevel(log.TraceLevel)
+	case "warn":
+		log.SetLevel(log.WarnLevel)
+	default:
+		log.SetLevel(log.TraceLevel)
+	}
+
+	if logConfig.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+
+	previousLogOutput := logOutput
+	log.SetOutput(output)
+	logOutput = outputCloser
+	if previousLogOutput != nil {
+		_ = previousLogOutput.Close()
+	}
+	return nil
+}
+
+// rotatingFile is an append only log file, renamed to a timestamped backup (server-<time>.log for server.log) when
+// a write would make it bigger than maxSize
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64         // 0 never rotates
+	maxBackups int           // 0 keeps all
+	maxAge     time.Duration // 0 keeps all
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.removeOldBackups()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, logFileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		// a failed rotation must not lose the log line, it goes to the old file (if still open)
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	renameErr := os.Rename(f.path, f.backupPath(time.Now()))
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.removeOldBackups()
+	return nil
+}
+
+func (f *rotatingFile) backupPath(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.Format(logBackupTimestamp) + ext
+}
+
+// removeOldBackups removes backups over maxBackups and older than maxAge, errors are ignored since the log file
+// is the only place to report them
+func (f *rotatingFile) removeOldBackups() {
+	if f.maxBackups == 0 && f.maxAge == 0 {
+		return
+	}
+
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(logBackupTimestamp, strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext)); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// timestamps in the names sort by time, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil {
+			continue
+		}
+		if (f.maxBackups > 0 && i >= f.maxBackups) || (f.maxAge > 0 && time.Since(info.ModTime()) > f.maxAge) {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"TerminalBuddyServer/config"
 	"TerminalBuddyServer/internal"
@@ -11,39 +16,122 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []*command{
+	{"serve", "[flags]", "start the server, the default without a command", runServe},
+	{"user", "create|list|disable|reset-password", "manage users", runUser},
+	{"reminder", "list|export", "show and export reminders of a user", runReminder},
+	{"db", "migrate|backup|restore", "manage the Postgres DB", runDb},
+	{"config", "check", "check the config file", runConfig},
+}
+
 func main() {
-	port := flag.Int("port", 8080, "port number")
-	dbTypeParam := flag.String("db-type", "ps", "in memory DB (mem) or Postgres (ps)")
-	recreateDb := flag.Bool("recreate-db", false, "drop current DB and create from scratch")
-	configPath := flag.String("cfg-path", "cmd/config.yaml", "yaml config file path")
-	flag.Parse()
-	log.Debugf("using port %d", *port)
+	args := os.Args[1:]
+
+	// flags only, as before there were commands
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if err := runServe(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	name := args[0]
+	if name == "help" {
+		printUsage(os.Stdout, "", commands)
+		return
+	}
+	if err := runCommand("", commands, args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the command named by the first arg, commands of a group like user are prefixed with it
+func runCommand(group string, commands []*command, args []string) error {
+	if len(args) == 0 {
+		printUsage(os.Stderr, group, commands)
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			if c.name != "serve" {
+				commandLoggingSetup()
+			}
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.TrimSpace(group+" "+args[0]))
+	printUsage(os.Stderr, group, commands)
+	os.Exit(2)
+	return nil
+}
+
+func printUsage(w io.Writer, group string, commands []*command) {
+	prefix := ""
+	if len(group) > 0 {
+		prefix = group + " "
+	}
+	fmt.Fprintf(w, "usage: %s %s<command> [flags] [args]\n\ncommands:\n", os.Args[0], prefix)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-40s %s\n", strings.TrimSpace(prefix+c.name+" "+c.args), c.usage)
+	}
+	fmt.Fprintf(w, "\nuse -h after a command for its flags\n")
+}
+
+func newFlagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags and checks the count of the positional args left after them
+func parseArgs(fs *flag.FlagSet, args []string, count int) []string {
+	_ = fs.Parse(args)
+	if fs.NArg() != count {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "")
+	configFlags := addConfigFlags(fs)
+	port := fs.Int("port", 0, "port number, overrides the config")
+	dbTypeParam := fs.String("db-type", "ps", "in memory DB (mem) or Postgres (ps)")
+	recreateDb := fs.Bool("recreate-db", false, "drop current DB and create from scratch")
+	adminUsername := fs.String("bootstrap-admin", "", "admin user created on start if there is no admin yet, password from env var TB_ADMIN_PASSWORD")
+	parseArgs(fs, args, 0)
 	if *recreateDb {
 		log.Warn("will recreate DB")
 	}
 
-	configData, err := config.ReadYamlConfig(*configPath)
-	if err != nil {
-		log.Fatalf("cannot open/read yaml conf file: %s", err.Error())
+	var overrides []string
+	if *port > 0 {
+		overrides = append(overrides, fmt.Sprintf("port=%d", *port))
 	}
-
-	tbConfig, err := config.NewTbConfig(configData)
+	tbConfig, err := configFlags.load(overrides...)
 	if err != nil {
-		log.Fatalf("error getting config: %s", err.Error())
-	}
-	if tbConfig == nil {
-		panic("received config is nil")
+		return err
 	}
 
-	if tbConfig.LogOutput() == config.FileLogOutput {
-		loggingSetup(tbConfig.LogFilePath(), tbConfig.LogLevel())
-	} else {
-		setupTraceLoggingToStdout()
+	if err := configLoggingSetup(tbConfig); err != nil {
+		return err
 	}
 	log.Debug("starting ...")
 
 	if *dbTypeParam != "ps" && *dbTypeParam != "mem" {
-		panic("unknown db type: " + *dbTypeParam)
+		return fmt.Errorf("unknown db type: %s", *dbTypeParam)
 	}
 
 	var dbType = internal.InMemDB
@@ -51,50 +139,108 @@ func main() {
 		dbType = internal.PsDB
 	}
 
-	dbPassword := os.Getenv("TB_DB_PASSWORD")
-	if dbType == internal.PsDB && len(dbPassword) == 0 {
-		log.Fatal("DB password not set. use env var TB_DB_PASSWORD to set it")
+	if dbType == internal.PsDB && len(tbConfig.Db().Password) == 0 {
+		return errorDbPasswordMissing
 	}
 
-	server := internal.NewServer(tbConfig, dbType, dbPassword, *recreateDb)
+	server := internal.NewServer(tbConfig, dbType, *recreateDb)
+
+	if len(*adminUsername) == 0 {
+		*adminUsername = os.Getenv("TB_ADMIN_USERNAME")
+	}
+	if len(*adminUsername) > 0 {
+		if err := server.BootstrapAdmin(*adminUsername, os.Getenv("TB_ADMIN_PASSWORD")); err != nil {
+			return fmt.Errorf("cannot bootstrap admin: %w", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadOnSighup(hup, server, configFlags, overrides)
+
 	server.Serve()
+	return nil
 }
 
-func setupTraceLoggingToStdout() {
-	loggingSetup("", "")
+// reloadOnSighup reloads the config and applies the settings which are safe to change while clients are
+// connected. An invalid config is logged and the running config stays, as do the log settings if the log file
+// cannot be opened.
+func reloadOnSighup(hup chan os.Signal, server *internal.Server, configFlags *configFlags, overrides []string) {
+	for range hup {
+		log.Warn("SIGHUP received, reloading config ...")
+		tbConfig, err := configFlags.load(overrides...)
+		if err != nil {
+			log.Errorf("config not reloaded: %s", err)
+			continue
+		}
+		if err := configLoggingSetup(tbConfig); err != nil {
+			log.Errorf("log settings not reloaded: %s", err)
+		}
+		server.Reload(tbConfig)
+		log.Warnf("config of env %s reloaded", tbConfig.Env)
+	}
 }
 
-func loggingSetup(logFileName string, logLevel string) {
-	switch strings.ToLower(logLevel) {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "fatal":
-		log.SetLevel(log.FatalLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "trace":
-		log.SetLevel(log.TraceLevel)
-	case "warn":
-		log.SetLevel(log.WarnLevel)
-	default:
-		log.SetLevel(log.TraceLevel)
-	}
-
-	if logFileName == "" {
-		log.SetOutput(os.Stdout)
-		return
+var errorDbPasswordMissing = errors.New("DB password not set. use env var TB_DB_PASSWORD to set it")
+
+// configFlags pick the config file and env, and override single settings
+type configFlags struct {
+	path      *string
+	env       *string
+	overrides overrideFlag
+}
+
+// overrideFlag collects repeated key=value flags
+type overrideFlag []string
+
+func (o *overrideFlag) String() string {
+	return strings.Join(*o, ", ")
+}
+
+func (o *overrideFlag) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{
+		path: fs.String("cfg-path", "cmd/config.yaml", "yaml config file path"),
+		env:  fs.String("env", "", "config env, overrides TB_ENV and env in the config file"),
 	}
+	fs.Var(&f.overrides, "set", "key=value config setting, overrides the config file and TB_* env vars, repeatable")
+	return f
+}
 
-	if !strings.HasSuffix(logFileName, ".log") {
-		logFileName += ".log"
+// load resolves the config, the extra overrides come from command specific flags and go last
+func (f *configFlags) load(extra ...string) (*config.TBConfig, error) {
+	configData, err := config.ReadYamlConfig(*f.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open/read yaml conf file: %w", err)
 	}
 
-	logFile, err := os.OpenFile(logFileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0777)
+	tbConfig, err := config.NewTbConfig(configData, *f.env, append(f.overrides, extra...))
 	if err != nil {
-		log.Panicf("failed to open log file %q: %s", logFileName, err)
+		return nil, fmt.Errorf("error getting config: %w", err)
 	}
+	return tbConfig, nil
+}
 
-	log.SetOutput(logFile)
+// openDb loads the config and opens the Postgres DB, management commands have nothing to do with an in memory DB
+func (f *configFlags) openDb() (*config.TBConfig, *internal.PostgresDBClient, error) {
+	tbConfig, err := f.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tbConfig.Db().Password) == 0 {
+		return nil, nil, errorDbPasswordMissing
+	}
+
+	db, err := internal.NewPostgresDBClient(tbConfig, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open DB: %w", err)
+	}
+	if !db.DbOk() {
+		return nil, nil, errors.New("DB connection not happy ...")
+	}
+	return tbConfig, db, nil
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"TerminalBuddyServer/internal"
+)
+
+var reminderCommands = []*command{
+	{"list", "<username>", "list reminders of a user", runReminderList},
+	{"export", "<username>", "export reminders of a user as iCalendar or JSON", runReminderExport},
+}
+
+func runReminder(args []string) error {
+	return runCommand("reminder", reminderCommands, args)
+}
+
+func runReminderList(args []string) error {
+	fs := newFlagSet("reminder list", "<username>")
+	flags := addConfigFlags(fs)
+	unacked := fs.Bool("unacked", false, "only reminders not acked yet")
+	asJson := fs.Bool("json", false, "print JSON instead of a table")
+	username := parseArgs(fs, args, 1)[0]
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reminders, err := internal.UserReminders(db, username)
+	if err != nil {
+		return err
+	}
+	if *unacked {
+		var filtered []*internal.Reminder
+		for _, r := range reminders {
+			if !r.Ack {
+				filtered = append(filtered, r)
+			}
+		}
+		reminders = filtered
+	}
+
+	if *asJson {
+		if reminders == nil {
+			reminders = []*internal.Reminder{}
+		}
+		return printJson(reminders)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDUE (UTC)\tACK\tPRIORITY\tTAGS\tMESSAGE")
+	for _, r := range reminders {
+		dueDate := time.Unix(r.DueDate, 0).UTC().Format("2006-01-02 15:04")
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\t%s\n", r.Id, dueDate, r.Ack, r.Priority, strings.Join(r.Tags, ","), r.Message)
+	}
+	return w.Flush()
+}
+
+func runReminderExport(args []string) error {
+	fs := newFlagSet("reminder export", "<username>")
+	flags := addConfigFlags(fs)
+	format := fs.String("format", "ics", "ics or json")
+	asEvents := fs.Bool("events", false, "iCalendar events instead of todos")
+	output := fs.String("o", "", "export file, stdout if empty")
+	username := parseArgs(fs, args, 1)[0]
+
+	if *format != "ics" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reminders, err := internal.UserReminders(db, username)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if *format == "ics" {
+		data = internal.EncodeICalendar(reminders, *asEvents, time.Now())
+	} else {
+		if reminders == nil {
+			reminders = []*internal.Reminder{}
+		}
+		if data, err = json.MarshalIndent(reminders, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+
+	if len(*output) == 0 {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(*output, data, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d reminders exported to %s\n", len(reminders), *output)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"TerminalBuddyServer/internal"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const usersPageLimit = 500
+
+var userCommands = []*command{
+	{"create", "<username>", "create a user, password from TB_USER_PASSWORD, the terminal or stdin", runUserCreate},
+	{"list", "", "list all users", runUserList},
+	{"disable", "<username>", "disable a user, -enable enables it again", runUserDisable},
+	{"reset-password", "<username>", "set a new password and revoke device tokens", runUserResetPassword},
+}
+
+func runUser(args []string) error {
+	return runCommand("user", userCommands, args)
+}
+
+func runUserCreate(args []string) error {
+	fs := newFlagSet("user create", "<username>")
+	flags := addConfigFlags(fs)
+	role := fs.String("role", internal.RoleUser, "user or admin")
+	username := parseArgs(fs, args, 1)[0]
+
+	tbConfig, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	user, err := internal.CreateUser(db, tbConfig.PasswordPolicy(), username, password, *role)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created user %s with id %d\n", user.Username, user.Id)
+	return nil
+}
+
+func runUserList(args []string) error {
+	fs := newFlagSet("user list", "")
+	flags := addConfigFlags(fs)
+	asJson := fs.Bool("json", false, "print JSON instead of a table")
+	parseArgs(fs, args, 0)
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	summaries := []*internal.UserSummary{}
+	cursor := int64(0)
+	for {
+		users, err := db.GetUsersPage(cursor, usersPageLimit)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			summaries = append(summaries, u.Summary())
+		}
+		if len(users) < usersPageLimit {
+			break
+		}
+		cursor = users[len(users)-1].Id
+	}
+
+	if *asJson {
+		return printJson(summaries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tROLE\tDISABLED\tTOTP\tEMAIL")
+	for _, u := range summaries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\t%s\n", u.Id, u.Username, u.Role, u.Disabled, u.TotpEnabled, u.Email)
+	}
+	return w.Flush()
+}
+
+func runUserDisable(args []string) error {
+	fs := newFlagSet("user disable", "<username>")
+	flags := addConfigFlags(fs)
+	enable := fs.Bool("enable", false, "enable the user again")
+	username := parseArgs(fs, args, 1)[0]
+
+	_, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := internal.SetUserDisabled(db, username, !*enable); err != nil {
+		return err
+	}
+
+	if *enable {
+		fmt.Printf("user %s enabled\n", username)
+	} else {
+		fmt.Printf("user %s disabled\n", username)
+	}
+	return nil
+}
+
+func runUserResetPassword(args []string) error {
+	fs := newFlagSet("user reset-password", "<username>")
+	flags := addConfigFlags(fs)
+	username := parseArgs(fs, args, 1)[0]
+
+	tbConfig, db, err := flags.openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := internal.ResetPassword(db, tbConfig.PasswordPolicy(), username, password); err != nil {
+		return err
+	}
+
+	fmt.Printf("password of %s reset, device tokens revoked\n", username)
+	return nil
+}
+
+// readPassword takes the password from TB_USER_PASSWORD, asks for it twice on a terminal, or reads the first
+// line of stdin, in this order
+func readPassword() (string, error) {
+	if password := os.Getenv("TB_USER_PASSWORD"); len(password) > 0 {
+		return password, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", errors.New("password missing on stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "repeat password: ")
+	repeated, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func printJson(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
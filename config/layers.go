@@ -0,0 +1,245 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultEnv   = "dev"
+	envVarPrefix = "TB_"
+	redacted     = "<redacted>"
+)
+
+// fileConfig is the yaml config file, with one section per env
+type fileConfig struct {
+	Env          string                 `yaml:"env"`
+	Environments map[string]interface{} `yaml:"environments"`
+	// before named environments there were only these two, env prod is read from production
+	Production interface{} `yaml:"production"`
+	Dev        interface{} `yaml:"dev"`
+}
+
+// typedFileConfig is decoded only to report unknown keys and wrong types with file line numbers
+type typedFileConfig struct {
+	Env          string               `yaml:"env"`
+	Environments map[string]EnvConfig `yaml:"environments"`
+	Production   *EnvConfig           `yaml:"production"`
+	Dev          *EnvConfig           `yaml:"dev"`
+}
+
+// DefaultEnvConfig is the bottom layer, the env section of the config file only has to set what differs
+func DefaultEnvConfig() EnvConfig {
+	c := EnvConfig{Port: 8080}
+	c.Log.Out = "stdout"
+	c.Log.File = "./server.log"
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.Log.MaxSizeMb = 100
+	c.Log.MaxBackups = 5
+	c.Log.MaxAgeDays = 30
+	c.DB = DbConfig{
+		Addr:    "localhost:5432",
+		User:    "termbuddy",
+		Name:    "termbuddydb",
+		SslMode: "disable",
+	}
+	c.Notifications.EmailFallbackMinutes = 15
+	c.Notifications.RedeliveryMinutes = 2
+	c.Notifications.CommandNotifySeconds = 60
+	c.Smtp.Port = 587
+	c.Smtp.From = "terminal-buddy@localhost"
+	// no password policy unless configured, clients sending only password_hash keep working
+	c.LoginLimits = LoginLimits{MaxFailures: 5, LockoutSeconds: 30, MaxLockoutSeconds: 3600}
+	// the server listens on localhost, behind a reverse proxy on the same host
+	c.TrustedProxies = []string{"127.0.0.1", "::1"}
+	return c
+}
+
+// NewTbConfig resolves the config in layers, each over the one before: defaults, the env section of the yaml
+// config, TB_* env vars and the key=value overrides, e.g. from flags. The env is picked the same way: dev, env
+// in the yaml config, TB_ENV, and the env param if not empty. Unknown keys and invalid values are errors.
+func NewTbConfig(configData []byte, env string, overrides []string) (*TBConfig, error) {
+	if err := yaml.UnmarshalStrict(configData, &typedFileConfig{}); err != nil {
+		return nil, err
+	}
+	file := &fileConfig{}
+	if err := yaml.Unmarshal(configData, file); err != nil {
+		return nil, err
+	}
+
+	tbConfig := &TBConfig{Env: defaultEnv, Config: DefaultEnvConfig()}
+	for _, e := range []string{file.Env, os.Getenv(envVarPrefix + "ENV"), env} {
+		if len(e) > 0 {
+			tbConfig.Env = e
+		}
+	}
+
+	section, err := file.section(tbConfig.Env)
+	if err != nil {
+		return nil, err
+	}
+	sectionData, err := yaml.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(sectionData, &tbConfig.Config); err != nil {
+		return nil, fmt.Errorf("env %s: %w", tbConfig.Env, err)
+	}
+
+	for _, key := range Keys() {
+		if value := os.Getenv(EnvVarName(key)); len(value) > 0 {
+			if err := tbConfig.Config.Set(key, value); err != nil {
+				return nil, fmt.Errorf("env var %s: %w", EnvVarName(key), err)
+			}
+		}
+	}
+
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("override %q is not key=value", override)
+		}
+		if err := tbConfig.Config.Set(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tbConfig.Config.Validate(tbConfig.Env); err != nil {
+		return nil, err
+	}
+
+	return tbConfig, nil
+}
+
+func (f *fileConfig) section(env string) (interface{}, error) {
+	if section, ok := f.Environments[env]; ok {
+		return section, nil
+	}
+	if env == "prod" && f.Production != nil {
+		return f.Production, nil
+	}
+	if env == "dev" && f.Dev != nil {
+		return f.Dev, nil
+	}
+
+	var envs []string
+	for e := range f.Environments {
+		envs = append(envs, e)
+	}
+	if f.Production != nil {
+		envs = append(envs, "prod")
+	}
+	if f.Dev != nil {
+		envs = append(envs, "dev")
+	}
+	sort.Strings(envs)
+	return nil, fmt.Errorf("env %q not in config file, it has: %s", env, strings.Join(envs, ", "))
+}
+
+// Keys are the dotted yaml keys of every EnvConfig setting, e.g. db.ssl_mode
+func Keys() []string {
+	var keys []string
+	c := EnvConfig{}
+	walkFields(reflect.ValueOf(&c).Elem(), "", func(key string, _ reflect.Value, _ reflect.StructField) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// EnvVarName is the env var of the key, e.g. TB_DB_SSL_MODE for db.ssl_mode
+func EnvVarName(key string) string {
+	return envVarPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Set parses the value into the setting with the key
+func (c *EnvConfig) Set(key string, value string) error {
+	var setErr error
+	found := false
+	walkFields(reflect.ValueOf(c).Elem(), "", func(k string, v reflect.Value, _ reflect.StructField) {
+		if k != key {
+			return
+		}
+		found = true
+		setErr = setValue(v, value)
+	})
+	if !found {
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	if setErr != nil {
+		return fmt.Errorf("config key %s: %w", key, setErr)
+	}
+	return nil
+}
+
+// Redacted is a copy with the secrets which are set replaced, for printing
+func (c EnvConfig) Redacted() EnvConfig {
+	walkFields(reflect.ValueOf(&c).Elem(), "", func(_ string, v reflect.Value, field reflect.StructField) {
+		if field.Tag.Get("secret") == "true" && v.Kind() == reflect.String && v.Len() > 0 {
+			v.SetString(redacted)
+		}
+	})
+	return c
+}
+
+// walkFields calls fn for every leaf field of the struct value, with its dotted yaml key
+func walkFields(v reflect.Value, prefix string, fn func(key string, value reflect.Value, field reflect.StructField)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + yamlKey(field)
+		if field.Type.Kind() == reflect.Struct {
+			walkFields(v.Field(i), key+".", fn)
+			continue
+		}
+		fn(key, v.Field(i), field)
+	}
+}
+
+// yamlKey is the key yaml.v2 uses for the field: the tag name, or the lower case field name
+func yamlKey(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("yaml"), ",")[0]; len(name) > 0 {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("lists of kind %s cannot be set", v.Type().Elem().Kind())
+		}
+		// comma separated, empty value is an empty list
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("settings of kind %s cannot be set", v.Kind())
+	}
+	return nil
+}
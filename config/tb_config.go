@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-
-	"gopkg.in/yaml.v2"
 )
 
 type LogOutput int
@@ -15,34 +13,94 @@ const (
 	FileLogOutput
 )
 
+// EnvConfig is the config of one environment. Secrets are better left out of the config file, every key can
+// also be set with a TB_* env var, e.g. db.password with TB_DB_PASSWORD.
 type EnvConfig struct {
 	Port int
 
-	Log struct {
-		Out   string
-		File  string
-		Level string
-	}
+	Log LogConfig
+
+	DB DbConfig
 
-	DB struct {
-		User string
-		Name string
+	Notifications struct {
+		// send email if reminder is not acked this many minutes after it is due, 0 means right away
+		EmailFallbackMinutes int `yaml:"email_fallback_minutes"`
+		// send reminder again if no agent confirms receiving it in this many minutes
+		RedeliveryMinutes int `yaml:"redelivery_minutes"`
+		// commands reported by agents running at least this many seconds are relayed when they finish, 0 disables
+		CommandNotifySeconds int `yaml:"command_notify_seconds"`
 	}
+
+	Smtp SmtpConfig
+
+	PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+
+	LoginLimits LoginLimits `yaml:"login_limits"`
+
+	// origins of browser clients, for websocket origin checks and CORS. Empty allows websockets from any origin
+	// and no CORS, * allows any origin for both.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// IPs and CIDRs of reverse proxies, whose X-Forwarded-For and X-Real-IP headers tell the client IP for logs and
+	// login limits. Clients behind a trusted proxy not sending them are not limited by IP.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
-type TBConfig struct {
-	Env        string    `yaml:"env"`
-	Production EnvConfig `yaml:"production"`
-	Dev        EnvConfig `yaml:"dev"`
+type LogConfig struct {
+	Out    string
+	File   string
+	Level  string
+	Format string // text | json
+	// the log file is rotated when it grows over MaxSizeMb, 0 never rotates it. Rotated files older than
+	// MaxAgeDays or beyond the newest MaxBackups are removed, 0 keeps them.
+	MaxSizeMb  int `yaml:"max_size_mb"`
+	MaxBackups int `yaml:"max_backups"`
+	MaxAgeDays int `yaml:"max_age_days"`
 }
 
-func NewTbConfig(configData []byte) (*TBConfig, error) {
-	tbConfig := &TBConfig{}
-	err := yaml.Unmarshal(configData, tbConfig)
-	if err != nil {
-		return nil, err
-	}
-	return tbConfig, nil
+type DbConfig struct {
+	Addr     string // host:port
+	User     string
+	Name     string
+	Password string `secret:"true"`
+	SslMode  string `yaml:"ssl_mode"`  // disable | require | verify-full
+	PoolSize int    `yaml:"pool_size"` // 0 is 10 connections per CPU
+}
+
+// LoginLimits lock out usernames and client IPs after failed logins, MaxFailures 0 turns the limits off
+type LoginLimits struct {
+	MaxFailures       int  `yaml:"max_failures"`        // failures before the first lockout
+	LockoutSeconds    int  `yaml:"lockout_seconds"`     // first lockout, doubled with every failure after it
+	MaxLockoutSeconds int  `yaml:"max_lockout_seconds"` // 0 means no max
+	Persist           bool // keep failures in the DB, so restarts do not reset them
+}
+
+// PasswordPolicy is checked on registration and password change, zero values turn the checks off
+type PasswordPolicy struct {
+	MinLength  int `yaml:"min_length"`
+	MinClasses int `yaml:"min_classes"` // of lower case, upper case, digits, other characters
+}
+
+func (p PasswordPolicy) Enabled() bool {
+	return p.MinLength > 0 || p.MinClasses > 0
+}
+
+// SmtpConfig is used for email notifications, which are disabled if Host is empty.
+// Password is only needed if the smtp server requires auth.
+type SmtpConfig struct {
+	Host            string
+	Port            int
+	Username        string
+	Password        string `secret:"true"`
+	From            string
+	SubjectTemplate string `yaml:"subject_template"`
+	BodyTemplate    string `yaml:"body_template"`
+}
+
+// TBConfig is the resolved config of the selected env, see NewTbConfig
+type TBConfig struct {
+	Env    string
+	Config EnvConfig
 }
 
 func ReadYamlConfig(path string) ([]byte, error) {
@@ -61,50 +119,60 @@ func ReadYamlConfig(path string) ([]byte, error) {
 }
 
 func (c *TBConfig) Port() int {
-	if c.Env == "prod" {
-		return c.Production.Port
-	}
-	return c.Dev.Port
+	return c.Config.Port
 }
 
 func (c *TBConfig) LogOutput() LogOutput {
-	if c.Env == "prod" {
-		if c.Production.Log.Out == "file" {
-			return FileLogOutput
-		}
-	}
-	if c.Env == "dev" {
-		if c.Dev.Log.Out == "file" {
-			return FileLogOutput
-		}
+	if c.Config.Log.Out == "file" {
+		return FileLogOutput
 	}
 	return StdoutLogOutput
 }
 
 func (c *TBConfig) LogFilePath() string {
-	if c.Env == "prod" {
-		return c.Production.Log.File
-	}
-	return c.Dev.Log.File
+	return c.Config.Log.File
 }
 
 func (c *TBConfig) LogLevel() string {
-	if c.Env == "prod" {
-		return c.Production.Log.Level
-	}
-	return c.Dev.Log.Level
+	return c.Config.Log.Level
 }
 
-func (c *TBConfig) DbName() string {
-	if c.Env == "prod" {
-		return c.Production.DB.Name
-	}
-	return c.Dev.DB.Name
+func (c *TBConfig) Log() LogConfig {
+	return c.Config.Log
 }
 
-func (c *TBConfig) DbUser() string {
-	if c.Env == "prod" {
-		return c.Production.DB.User
-	}
-	return c.Dev.DB.User
+func (c *TBConfig) Db() DbConfig {
+	return c.Config.DB
+}
+
+func (c *TBConfig) EmailFallbackMinutes() int {
+	return c.Config.Notifications.EmailFallbackMinutes
+}
+
+func (c *TBConfig) RedeliveryMinutes() int {
+	return c.Config.Notifications.RedeliveryMinutes
+}
+
+func (c *TBConfig) CommandNotifySeconds() int {
+	return c.Config.Notifications.CommandNotifySeconds
+}
+
+func (c *TBConfig) Smtp() SmtpConfig {
+	return c.Config.Smtp
+}
+
+func (c *TBConfig) PasswordPolicy() PasswordPolicy {
+	return c.Config.PasswordPolicy
+}
+
+func (c *TBConfig) LoginLimits() LoginLimits {
+	return c.Config.LoginLimits
+}
+
+func (c *TBConfig) AllowedOrigins() []string {
+	return c.Config.AllowedOrigins
+}
+
+func (c *TBConfig) TrustedProxies() []string {
+	return c.Config.TrustedProxies
 }
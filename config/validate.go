@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+)
+
+var (
+	logOutputs = []string{"stdout", "file"}
+	logLevels  = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+	logFormats = []string{"text", "json"}
+	dbSslModes = []string{"disable", "require", "verify-full"}
+)
+
+// ValidationError lists every problem of the env config, not only the first
+type ValidationError struct {
+	Env      string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config of env %s: %s", e.Env, strings.Join(e.Problems, "; "))
+}
+
+// Validate checks values and relations of the settings, it returns a *ValidationError
+func (c *EnvConfig) Validate(env string) error {
+	v := &ValidationError{Env: env}
+
+	v.checkPort("port", c.Port)
+
+	v.checkOneOf("log.out", c.Log.Out, logOutputs)
+	if c.Log.Out == "file" && len(c.Log.File) == 0 {
+		v.add("log.file is required with log.out file")
+	}
+	v.checkOneOf("log.level", strings.ToLower(c.Log.Level), logLevels)
+	v.checkOneOf("log.format", c.Log.Format, logFormats)
+	v.checkNotNegative("log.max_size_mb", c.Log.MaxSizeMb)
+	v.checkNotNegative("log.max_backups", c.Log.MaxBackups)
+	v.checkNotNegative("log.max_age_days", c.Log.MaxAgeDays)
+
+	if _, _, err := net.SplitHostPort(c.DB.Addr); err != nil {
+		v.add("db.addr %q is not host:port", c.DB.Addr)
+	}
+	v.checkRequired("db.user", c.DB.User)
+	v.checkRequired("db.name", c.DB.Name)
+	v.checkOneOf("db.ssl_mode", c.DB.SslMode, dbSslModes)
+	v.checkNotNegative("db.pool_size", c.DB.PoolSize)
+
+	v.checkNotNegative("notifications.email_fallback_minutes", c.Notifications.EmailFallbackMinutes)
+	if c.Notifications.RedeliveryMinutes < 1 {
+		v.add("notifications.redelivery_minutes must be at least 1, is %d", c.Notifications.RedeliveryMinutes)
+	}
+	v.checkNotNegative("notifications.command_notify_seconds", c.Notifications.CommandNotifySeconds)
+
+	if len(c.Smtp.Host) > 0 {
+		v.checkPort("smtp.port", c.Smtp.Port)
+		v.checkRequired("smtp.from", c.Smtp.From)
+		v.checkTemplate("smtp.subject_template", c.Smtp.SubjectTemplate)
+		v.checkTemplate("smtp.body_template", c.Smtp.BodyTemplate)
+	}
+
+	v.checkNotNegative("password_policy.min_length", c.PasswordPolicy.MinLength)
+	if c.PasswordPolicy.MinClasses < 0 || c.PasswordPolicy.MinClasses > 4 {
+		v.add("password_policy.min_classes must be 0 to 4 (lower case, upper case, digits, others), is %d", c.PasswordPolicy.MinClasses)
+	}
+
+	v.checkNotNegative("login_limits.max_failures", c.LoginLimits.MaxFailures)
+	v.checkNotNegative("login_limits.max_lockout_seconds", c.LoginLimits.MaxLockoutSeconds)
+	if c.LoginLimits.MaxFailures > 0 && c.LoginLimits.LockoutSeconds < 1 {
+		v.add("login_limits.lockout_seconds must be at least 1 when login_limits.max_failures is set")
+	}
+	if c.LoginLimits.MaxLockoutSeconds > 0 && c.LoginLimits.MaxLockoutSeconds < c.LoginLimits.LockoutSeconds {
+		v.add("login_limits.max_lockout_seconds %d is less than login_limits.lockout_seconds %d",
+			c.LoginLimits.MaxLockoutSeconds, c.LoginLimits.LockoutSeconds)
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			v.add("allowed_origins entry %q must be * or start with http:// or https://", origin)
+		}
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				v.add("trusted_proxies entry %q is not an IP or CIDR", proxy)
+			}
+		}
+	}
+
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (v *ValidationError) add(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+func (v *ValidationError) checkPort(key string, port int) {
+	if port < 1 || port > 65535 {
+		v.add("%s must be 1 to 65535, is %d", key, port)
+	}
+}
+
+func (v *ValidationError) checkRequired(key string, value string) {
+	if len(value) == 0 {
+		v.add("%s is required", key)
+	}
+}
+
+func (v *ValidationError) checkNotNegative(key string, value int) {
+	if value < 0 {
+		v.add("%s must not be negative, is %d", key, value)
+	}
+}
+
+func (v *ValidationError) checkOneOf(key string, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add("%s %q unknown, use one of: %s", key, value, strings.Join(allowed, ", "))
+}
+
+func (v *ValidationError) checkTemplate(key string, text string) {
+	if len(text) == 0 {
+		return
+	}
+	if _, err := template.New(key).Parse(text); err != nil {
+		v.add("%s invalid: %s", key, err)
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"TerminalBuddyServer/config"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+var (
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	// compared lower case
+	reservedUsernames = map[string]bool{
+		"admin": true,
+		"root":  true,
+		"serj":  true,
+	}
+
+	errorPasswordRequired = errors.New("password missing, hashed passwords cannot be checked against the password policy")
+)
+
+// ValidateUsername checks username length, characters and reserved names
+func ValidateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("username must have %d to %d characters", minUsernameLength, maxUsernameLength)
+	}
+	if !usernameRegexp.MatchString(username) {
+		return errors.New("username can have only letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return errors.New("username reserved")
+	}
+	return nil
+}
+
+// ValidatePassword checks the plain password against the policy: minimum length and minimum number of character
+// classes (lower case, upper case, digits, others)
+func ValidatePassword(policy config.PasswordPolicy, password string) error {
+	if len([]rune(password)) < policy.MinLength {
+		return fmt.Errorf("password must have at least %d characters", policy.MinLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			classes++
+		}
+	}
+	if classes < policy.MinClasses {
+		return fmt.Errorf("password must have at least %d of: lower case, upper case, digits, other characters", policy.MinClasses)
+	}
+
+	return nil
+}
+
+// passwordHash hashes the plain password the same way agents do before sending it
+func passwordHash(password string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(password)))
+}
+
+// checkedPasswordHash returns the hash of the plain password form value after checking it against the policy.
+// Without a policy the client can send the hash form value instead.
+func checkedPasswordHash(policy config.PasswordPolicy, password string, hash string) (string, error) {
+	if len(password) > 0 {
+		if err := ValidatePassword(policy, password); err != nil {
+			return "", err
+		}
+		return passwordHash(password), nil
+	}
+	if policy.Enabled() {
+		return "", errorPasswordRequired
+	}
+	if len(hash) == 0 {
+		return "", errors.New("password hash missing")
+	}
+	return hash, nil
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"TerminalBuddyServer/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Account operations for the command line, the HTTP handlers do the same with their own checks and responses.
+// Server instances sharing the Postgres DB are told to disconnect users whose password changed or who got disabled.
+
+// cliInstanceId is the From of bus messages the command line publishes
+const cliInstanceId = "cli"
+
+// CreateUser validates and saves a new user with the given role
+func CreateUser(db BuddyDb, policy config.PasswordPolicy, username string, password string, role string) (*User, error) {
+	if role != RoleUser && role != RoleAdmin {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password missing")
+	}
+	if err := ValidatePassword(policy, password); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Username:     username,
+		PasswordHash: passwordHash(password),
+		Role:         role,
+		Reminders:    []*Reminder{},
+	}
+	if err := db.SaveUser(user); err != nil {
+		return nil, err
+	}
+	log.Warnf("audit: created user [%s] with role %s", username, role)
+
+	return user, nil
+}
+
+// ResetPassword sets a new password and revokes the device tokens of the user
+func ResetPassword(db BuddyDb, policy config.PasswordPolicy, username string, password string) error {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if len(password) == 0 {
+		return errors.New("password missing")
+	}
+	if err := ValidatePassword(policy, password); err != nil {
+		return err
+	}
+
+	user.PasswordHash = passwordHash(password)
+	if err := db.SaveUser(user); err != nil {
+		return err
+	}
+	if err := db.DeleteDeviceTokens(user.Id); err != nil {
+		return fmt.Errorf("password changed, but device tokens not revoked: %w", err)
+	}
+	log.Warnf("audit: reset password of user [%s]", user.Username)
+	if err := disconnectUser(db, user.Username); err != nil {
+		return fmt.Errorf("password changed, but connected clients not disconnected: %w", err)
+	}
+
+	return nil
+}
+
+// SetUserDisabled disables the user, or enables it again
+func SetUserDisabled(db BuddyDb, username string, disabled bool) error {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user.Disabled == disabled {
+		return nil
+	}
+
+	user.Disabled = disabled
+	if err := db.SaveUser(user); err != nil {
+		return err
+	}
+	log.Warnf("audit: user [%s] disabled: %t", user.Username, disabled)
+	if disabled {
+		if err := disconnectUser(db, user.Username); err != nil {
+			return fmt.Errorf("user disabled, but connected clients not disconnected: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// disconnectUser asks the running server instances to close the clients of the user, like
+// NotificationManager.DisconnectUser. Only instances sharing a Postgres DB can be reached.
+func disconnectUser(db BuddyDb, username string) error {
+	c, ok := db.(*PostgresDBClient)
+	if !ok {
+		return nil
+	}
+	return publishBusMessage(c.db, &BusMessage{Type: busMessageDisconnect, From: cliInstanceId, Username: username})
+}
+
+// UserReminders returns all reminders of the user
+func UserReminders(db BuddyDb, username string) ([]*Reminder, error) {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	return allUserReminders(db, user.Id)
+}
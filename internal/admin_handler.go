@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultUsersPageLimit = 50
+	maxUsersPageLimit     = 200
+)
+
+type ServerStats struct {
+	*DbStats
+	ConnectedClients int   `json:"connected_clients"`
+	UptimeSeconds    int64 `json:"uptime_seconds"`
+}
+
+// AdminHandler serves endpoints for users with the admin role, authorized like other header authorized
+// endpoints, with the admin username in the path
+type AdminHandler struct {
+	db        BuddyDb
+	limiter   *LoginLimiter
+	nm        *NotificationManager
+	startedAt time.Time
+	router    *mux.Router
+}
+
+func NewAdminHandler(db BuddyDb, limiter *LoginLimiter, nm *NotificationManager, adminRouter *mux.Router) {
+	handler := &AdminHandler{
+		db:        db,
+		limiter:   limiter,
+		nm:        nm,
+		startedAt: time.Now(),
+		router:    adminRouter,
+	}
+
+	adminRouter.HandleFunc("/{username}/users", handler.handleUsers).Methods("GET")
+	adminRouter.HandleFunc("/{username}/users/{target}/disable", handler.handleDisable).Methods("POST")
+	adminRouter.HandleFunc("/{username}/stats", handler.handleStats).Methods("GET")
+	adminRouter.HandleFunc("/{username}/unlock", handler.handleUnlock).Methods("POST")
+
+	adminRouter.Use(handler.adminMiddleware)
+}
+
+// adminMiddleware lets only authorized users with the admin role through
+func (handler *AdminHandler) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+		if !ok {
+			return
+		}
+		if !user.IsAdmin() {
+			requestLog(r).Warnf("audit: user [%s] denied admin access to %s", user.Username, r.URL.Path)
+			sendSimpleErrResponse(w, http.StatusForbidden, "admin role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (handler *AdminHandler) handleUsers(w http.ResponseWriter, r *http.Request) {
+	cursor := int64(0)
+	if cursorStr := r.URL.Query().Get("cursor"); len(cursorStr) > 0 {
+		var err error
+		if cursor, err = strconv.ParseInt(cursorStr, 10, 64); err != nil || cursor < 0 {
+			sendSimpleBadRequestResponse(w, "cursor value invalid")
+			return
+		}
+	}
+
+	limit := defaultUsersPageLimit
+	if limitStr := r.URL.Query().Get("limit"); len(limitStr) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			sendSimpleBadRequestResponse(w, "limit value invalid")
+			return
+		}
+		if limit > maxUsersPageLimit {
+			limit = maxUsersPageLimit
+		}
+	}
+
+	users, err := handler.db.WithContext(r.Context()).GetUsersPage(cursor, limit)
+	if err != nil {
+		requestLog(r).Errorf("error getting users page: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get users")
+		return
+	}
+
+	page := UsersPage{Users: []*UserSummary{}}
+	for _, u := range users {
+		page.Users = append(page.Users, u.Summary())
+	}
+	if len(users) == limit {
+		page.NextCursor = users[len(users)-1].Id
+	}
+
+	pageJsonBytes, err := json.Marshal(page)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling users page: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: pageJsonBytes,
+	})
+}
+
+// handleDisable disables the target user, or enables it again with disabled=false. Connected agents of a
+// disabled user are disconnected.
+func (handler *AdminHandler) handleDisable(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	vars := mux.Vars(r)
+	if vars["target"] == vars["username"] {
+		sendSimpleBadRequestResponse(w, "cannot disable yourself")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	disabled := true
+	if disabledStr := r.FormValue("disabled"); len(disabledStr) > 0 {
+		var err error
+		if disabled, err = strconv.ParseBool(disabledStr); err != nil {
+			sendSimpleBadRequestResponse(w, "disabled value invalid")
+			return
+		}
+	}
+
+	target, err := db.GetUser(vars["target"])
+	if err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	target.Disabled = disabled
+	if err := db.SaveUser(target); err != nil {
+		requestLog(r).Errorf("error saving disabled user [%s]: %s", target.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save user")
+		return
+	}
+	if disabled {
+		handler.nm.DisconnectUser(target.Username)
+	}
+	requestLog(r).Warnf("audit: admin [%s] set user [%s] disabled: %t", vars["username"], target.Username, disabled)
+
+	sendSimpleResponse(w, "ok")
+}
+
+func (handler *AdminHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	dbStats, err := db.GetStats()
+	if err != nil {
+		requestLog(r).Errorf("error getting db stats: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get stats")
+		return
+	}
+
+	statsJsonBytes, err := json.Marshal(ServerStats{
+		DbStats:          dbStats,
+		ConnectedClients: handler.nm.ClientsCount(),
+		UptimeSeconds:    int64(time.Since(handler.startedAt) / time.Second),
+	})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling stats: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: statsJsonBytes,
+	})
+}
+
+// handleUnlock removes the login lockout of the username and/or the ip form values
+func (handler *AdminHandler) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	username := r.FormValue("username")
+	ip := r.FormValue("ip")
+	if len(username) == 0 && len(ip) == 0 {
+		sendSimpleBadRequestResponse(w, "username or ip missing")
+		return
+	}
+
+	if !handler.limiter.Unlock(username, ip) {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not locked")
+		return
+	}
+
+	requestLog(r).Warnf("audit: admin [%s] unlocked login of user [%s] ip [%s]", mux.Vars(r)["username"], username, ip)
+	sendSimpleResponse(w, "unlocked")
+}
@@ -0,0 +1,421 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	sseRetryMillis     = 1000
+	sseKeepAlivePeriod = 5 * time.Second
+)
+
+// AgentHandler serves agents behind proxies that kill websocket upgrades. Reminders are received over SSE or long
+// poll, from the same client queue the websocket uses, and acked over REST.
+type AgentHandler struct {
+	db      BuddyDb
+	limiter *LoginLimiter
+	nm      *NotificationManager
+	router  *mux.Router
+}
+
+func NewAgentHandler(db BuddyDb, limiter *LoginLimiter, nm *NotificationManager, agentRouter *mux.Router) {
+	handler := &AgentHandler{
+		db:      db,
+		limiter: limiter,
+		nm:      nm,
+		router:  agentRouter,
+	}
+
+	agentRouter.HandleFunc("/{username}/events", handler.handleEvents).Methods("GET")
+	agentRouter.HandleFunc("/{username}/poll", handler.handlePoll).Methods("GET")
+	agentRouter.HandleFunc("/{username}/ack", handler.handleAck).Methods("POST")
+	agentRouter.HandleFunc("/{username}/snooze", handler.handleSnooze).Methods("POST")
+	agentRouter.HandleFunc("/{username}/received", handler.handleReceived).Methods("POST")
+	agentRouter.HandleFunc("/{username}/accept", handler.handleAccept).Methods("POST")
+	agentRouter.HandleFunc("/{username}/decline", handler.handleDecline).Methods("POST")
+	agentRouter.HandleFunc("/{username}/dnd", handler.handleDnd).Methods("POST")
+	agentRouter.HandleFunc("/{username}/command/started", handler.handleCommandStarted).Methods("POST")
+	agentRouter.HandleFunc("/{username}/command/finished", handler.handleCommandFinished).Methods("POST")
+}
+
+// agentDevice is the optional device name sent by HTTP agents
+func agentDevice(r *http.Request) string {
+	return r.Header.Get("Term-Buddy-Device")
+}
+
+// handleEvents streams queued messages as server sent events. The stream ends before the server write timeout,
+// the retry field makes the client reconnect right away.
+func (handler *AgentHandler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	nc := handler.nm.AttachClient(user, agentDevice(r), TransportSSE)
+	defer nc.Touch()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disables response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	streamEnd := time.After(maxAgentWait)
+	keepAlive := time.NewTicker(sseKeepAlivePeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-nc.Queue.Done():
+			return
+		case <-streamEnd:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-nc.Queue.Ready():
+			for _, message := range nc.Queue.Drain() {
+				if err := writeSseEvent(w, message); err != nil {
+					requestLog(r).WithField("conn_id", nc.ConnId).Errorf("failed to write SSE event to user %s: %s", user.Username, err)
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSseEvent(w http.ResponseWriter, message []byte) error {
+	var event strings.Builder
+	for _, line := range strings.Split(string(message), "\n") {
+		event.WriteString("data: ")
+		event.WriteString(line)
+		event.WriteString("\n")
+	}
+	event.WriteString("\n")
+	_, err := w.Write([]byte(event.String()))
+	return err
+}
+
+// handlePoll waits until there are queued messages or the timeout (in seconds) passes, and returns the messages
+func (handler *AgentHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	timeout := maxAgentWait
+	if timeoutStr := r.URL.Query().Get("timeout"); len(timeoutStr) > 0 {
+		timeoutSeconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || timeoutSeconds < 0 {
+			sendSimpleBadRequestResponse(w, "timeout value invalid")
+			return
+		}
+		if t := time.Duration(timeoutSeconds) * time.Second; t < timeout {
+			timeout = t
+		}
+	}
+
+	nc := handler.nm.AttachClient(user, agentDevice(r), TransportLongPoll)
+	defer nc.Touch()
+
+	var messages [][]byte
+	select {
+	case <-nc.Queue.Ready():
+		messages = nc.Queue.Drain()
+	case <-time.After(timeout):
+	case <-nc.Queue.Done():
+	case <-r.Context().Done():
+		return
+	}
+
+	messagesJsonBytes, err := json.Marshal(queueMessagesJson(messages))
+	if err != nil {
+		requestLog(r).Errorf("error marshaling poll messages for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: messagesJsonBytes,
+	})
+}
+
+// queueMessagesJson keeps json messages as they are, anything else becomes a json string
+func queueMessagesJson(messages [][]byte) []json.RawMessage {
+	jsonMessages := []json.RawMessage{}
+	for _, message := range messages {
+		if json.Valid(message) {
+			jsonMessages = append(jsonMessages, message)
+			continue
+		}
+		messageJson, _ := json.Marshal(string(message))
+		jsonMessages = append(jsonMessages, messageJson)
+	}
+	return jsonMessages
+}
+
+func (handler *AgentHandler) handleAck(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	reminderId, ok := reminderIdFormValue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := handler.nm.AckReminder(user, reminderId); err != nil {
+		sendReminderUpdateErrResponse(w, r, user, reminderId, err)
+		return
+	}
+
+	sendSimpleResponse(w, "acked")
+}
+
+func (handler *AgentHandler) handleAccept(w http.ResponseWriter, r *http.Request) {
+	handler.respondAssignment(w, r, true)
+}
+
+func (handler *AgentHandler) handleDecline(w http.ResponseWriter, r *http.Request) {
+	handler.respondAssignment(w, r, false)
+}
+
+// respondAssignment answers a reminder assigned to the user by another user
+func (handler *AgentHandler) respondAssignment(w http.ResponseWriter, r *http.Request, accept bool) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	reminderId, ok := reminderIdFormValue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := handler.nm.RespondAssignment(user, reminderId, accept); err != nil {
+		sendReminderUpdateErrResponse(w, r, user, reminderId, err)
+		return
+	}
+
+	if accept {
+		sendSimpleResponse(w, "accepted")
+	} else {
+		sendSimpleResponse(w, "declined")
+	}
+}
+
+func (handler *AgentHandler) handleSnooze(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	reminderId, ok := reminderIdFormValue(w, r)
+	if !ok {
+		return
+	}
+
+	snoozeMinutes := 0
+	if minutesStr := r.FormValue("minutes"); len(minutesStr) > 0 {
+		var err error
+		if snoozeMinutes, err = strconv.Atoi(minutesStr); err != nil || snoozeMinutes < 0 {
+			sendSimpleBadRequestResponse(w, "minutes value invalid")
+			return
+		}
+	}
+
+	if err := handler.nm.SnoozeReminder(user, reminderId, snoozeMinutes); err != nil {
+		sendReminderUpdateErrResponse(w, r, user, reminderId, err)
+		return
+	}
+
+	sendSimpleResponse(w, "snoozed")
+}
+
+// handleReceived is the delivery receipt, sent by the agent as soon as it gets the reminder
+func (handler *AgentHandler) handleReceived(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	reminderId, ok := reminderIdFormValue(w, r)
+	if !ok {
+		return
+	}
+
+	deliveryId := int64(0)
+	if deliveryIdStr := r.FormValue("delivery_id"); len(deliveryIdStr) > 0 {
+		var err error
+		if deliveryId, err = strconv.ParseInt(deliveryIdStr, 10, 64); err != nil {
+			sendSimpleBadRequestResponse(w, "delivery id invalid")
+			return
+		}
+	}
+
+	device := agentDevice(r)
+	if len(device) == 0 {
+		device = defaultDevice
+	}
+
+	if err := handler.nm.ReceiptReminder(user, device, reminderId, deliveryId); err != nil {
+		sendReminderUpdateErrResponse(w, r, user, reminderId, err)
+		return
+	}
+
+	sendSimpleResponse(w, "received")
+}
+
+// handleDnd turns do not disturb on or off, same as the "dnd" websocket message
+func (handler *AgentHandler) handleDnd(w http.ResponseWriter, r *http.Request) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	dnd, err := strconv.ParseBool(r.FormValue("dnd"))
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "dnd value missing / invalid")
+		return
+	}
+
+	if err := handler.nm.SetDnd(user, dnd); err != nil {
+		requestLog(r).Errorf("failed to set do not disturb for %s: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot set do not disturb")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleCommandStarted is the "command_started" websocket message, for HTTP agents and devices without agent
+func (handler *AgentHandler) handleCommandStarted(w http.ResponseWriter, r *http.Request) {
+	handler.reportCommand(w, r, false)
+}
+
+// handleCommandFinished is the "command_finished" websocket message, for HTTP agents and devices without agent
+func (handler *AgentHandler) handleCommandFinished(w http.ResponseWriter, r *http.Request) {
+	handler.reportCommand(w, r, true)
+}
+
+func (handler *AgentHandler) reportCommand(w http.ResponseWriter, r *http.Request, finished bool) {
+	user, ok := headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	event := &CommandEvent{
+		Id:      r.FormValue("command_id"),
+		Command: r.FormValue("command"),
+		Host:    r.FormValue("host"),
+	}
+	if exitCodeStr := r.FormValue("exit_code"); len(exitCodeStr) > 0 {
+		var err error
+		if event.ExitCode, err = strconv.Atoi(exitCodeStr); err != nil {
+			sendSimpleBadRequestResponse(w, "exit code invalid")
+			return
+		}
+	}
+	if durationStr := r.FormValue("duration_ms"); len(durationStr) > 0 {
+		var err error
+		if event.DurationMs, err = strconv.ParseInt(durationStr, 10, 64); err != nil {
+			sendSimpleBadRequestResponse(w, "duration invalid")
+			return
+		}
+	}
+
+	device := agentDevice(r)
+	if len(device) == 0 {
+		device = defaultDevice
+	}
+
+	var err error
+	if finished {
+		err = handler.nm.CommandFinished(user, device, event)
+	} else {
+		err = handler.nm.CommandStarted(user, device, event)
+	}
+	if err == errorCommandMissing || err == errorCommandDuration {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("failed to report command of user %s: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot report command")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+func reminderIdFormValue(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return 0, false
+	}
+
+	reminderId, err := strconv.ParseInt(r.FormValue("reminder_id"), 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "reminder id missing / invalid")
+		return 0, false
+	}
+
+	return reminderId, true
+}
+
+func sendReminderUpdateErrResponse(w http.ResponseWriter, r *http.Request, user *User, reminderId int64, err error) {
+	if err == errorReminderNotFound || err == errorDeliveryNotFound || err == errorAssignmentNotFound {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err == errorTeamReminderSnooze {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
+	if err == errorAssignmentAnswered {
+		sendSimpleErrResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	requestLog(r).Errorf("failed to update reminder %d of user %s: %s", reminderId, user.Username, err.Error())
+	sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot update reminder")
+}
@@ -0,0 +1,38 @@
+package internal
+
+const (
+	AssignmentPending  = "pending"  // the assignee did not answer yet, the reminder goes to the assignee meanwhile
+	AssignmentAccepted = "accepted" // the reminder goes to the assignee
+	AssignmentDeclined = "declined" // the reminder goes to its creator again
+	// only in notices to the creator, the assignment keeps its status when acked
+	AssignmentAcked = "acked"
+)
+
+// ReminderAssignment gives the reminder of its creator, the reminder user, to the assignee
+type ReminderAssignment struct {
+	Id          int64  `json:"-"`
+	ReminderId  int64  `json:"reminder_id" pg:",unique,notnull"`
+	AssigneeId  int64  `json:"-" pg:",notnull"`
+	Status      string `json:"status" pg:",notnull"`
+	AssignedAt  int64  `json:"assigned_at" pg:",notnull"`
+	RespondedAt int64  `json:"responded_at,omitempty"`
+}
+
+// Active assignments take the reminder away from its creator
+func (a *ReminderAssignment) Active() bool {
+	return a.Status != AssignmentDeclined
+}
+
+// AssignmentNotice tells the assignee about a new assignment, and the creator about the answer and the ack
+type AssignmentNotice struct {
+	ReminderId int64  `json:"reminder_id"`
+	Message    string `json:"message"`
+	DueDate    int64  `json:"due_date"`
+	AssignedBy string `json:"assigned_by"`
+	AssignedTo string `json:"assigned_to"`
+	Status     string `json:"status"`
+}
+
+type AssignmentMessage struct {
+	Assignment *AssignmentNotice `json:"assignment"`
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type clientIpKey struct{}
+
+// clientAddress is the resolved client address of a request
+type clientAddress struct {
+	ip string
+	// the request came from a trusted proxy which did not say who the client is, ip is the proxy address
+	unknown bool
+}
+
+// proxyPolicy resolves the client IP of requests coming through trusted reverse proxies, from X-Forwarded-For or
+// X-Real-IP. The headers of other peers are ignored, anyone can send them. The trusted proxies can change while the
+// server runs.
+type proxyPolicy struct {
+	mutex   sync.RWMutex
+	trusted []*net.IPNet
+}
+
+func newProxyPolicy(proxies []string) *proxyPolicy {
+	p := &proxyPolicy{}
+	p.set(proxies)
+	return p
+}
+
+// set takes IPs and CIDRs, invalid entries are left out (the config check reports them)
+func (p *proxyPolicy) set(proxies []string) {
+	var trusted []*net.IPNet
+	for _, proxy := range proxies {
+		ipNet, err := parseIpOrCidr(proxy)
+		if err != nil {
+			log.Errorf("trusted proxy %q ignored: %s", proxy, err)
+			continue
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.trusted = trusted
+}
+
+func parseIpOrCidr(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func (p *proxyPolicy) trustedIp(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve walks X-Forwarded-For from the right, the nearest hop first, and takes the first address which is not
+// a trusted proxy. X-Real-IP is used if there is no X-Forwarded-For.
+func (p *proxyPolicy) resolve(r *http.Request) clientAddress {
+	peer := remoteIp(r.RemoteAddr)
+	if !p.trustedIp(peer) {
+		return clientAddress{ip: peer}
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = r.Header.Values("X-Real-IP")
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if ip := net.ParseIP(hop); ip == nil {
+			// not an address, the hops before it cannot be trusted either
+			break
+		}
+		if !p.trustedIp(hop) {
+			return clientAddress{ip: hop}
+		}
+		peer = hop
+	}
+	return clientAddress{ip: peer, unknown: true}
+}
+
+// clientIpHandler resolves the client address of every request once, for clientIp and limitedIp
+func (p *proxyPolicy) clientIpHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIpKey{}, p.resolve(r))))
+	})
+}
+
+// contextClientAddress is the address resolved by clientIpHandler, empty outside of requests
+func contextClientAddress(ctx context.Context) clientAddress {
+	address, _ := ctx.Value(clientIpKey{}).(clientAddress)
+	return address
+}
+
+// limited is the client address for login limits, empty if only the proxy address is known, so failures of
+// unknown clients do not lock out everyone behind the proxy
+func (a clientAddress) limited() string {
+	if a.unknown {
+		return ""
+	}
+	return a.ip
+}
+
+func requestClientAddress(r *http.Request) clientAddress {
+	if address := contextClientAddress(r.Context()); len(address.ip) > 0 {
+		return address
+	}
+	return clientAddress{ip: remoteIp(r.RemoteAddr)}
+}
+
+// clientIp is the address of the client, for logs. It is the proxy address if the proxy did not say who the
+// client is.
+func clientIp(r *http.Request) string {
+	return requestClientAddress(r).ip
+}
+
+// limitedIp is the client address for login limits, see clientAddress.limited
+func limitedIp(r *http.Request) string {
+	return requestClientAddress(r).limited()
+}
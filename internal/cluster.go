@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	// a client of the user on Device is connected to the From instance, sent on connect and repeated while it stays
+	busMessageConnected = "connected"
+	// the client of the user on Device left the From instance
+	busMessageDisconnected = "disconnected"
+	// asks all instances to send connected messages for their clients, sent on start
+	busMessageSync = "sync"
+	// close the client of the user on Device, or all clients of the user if Device is empty, wherever they are
+	// connected, e.g. after a password change
+	busMessageDisconnect = "disconnect"
+	// deliver the reminders to the clients of the user connected to the To instance
+	busMessageDeliver = "deliver"
+	// send the digest of At to the clients of the user connected to the To instance
+	busMessageDigest = "digest"
+	// push the Payload agent message to the clients of the user connected to the To instance, except the one on Device
+	busMessagePush = "push"
+)
+
+// BusMessage goes to all server instances, ids instead of reminders keep it small
+type BusMessage struct {
+	Type        string  `json:"type"`
+	From        string  `json:"from"`
+	To          string  `json:"to,omitempty"` // empty for all instances
+	Username    string  `json:"username,omitempty"`
+	ConnectedAt int64   `json:"connected_at,omitempty"` // unix nanos, which of two clients of the user on the device is newer
+	ReminderIds []int64 `json:"reminder_ids,omitempty"`
+	At          int64   `json:"at,omitempty"`
+	// agent message, JSON
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// the device of the connected, disconnected or disconnect client, the pushed agent message is not for the client
+	// on it
+	Device string `json:"device,omitempty"`
+}
+
+// Bus carries messages between server instances sharing the DB, e.g. deliveries to the instance holding the
+// socket of the user. Messages can get lost, e.g. while reconnecting, so they are repeated or redelivered.
+type Bus interface {
+	Publish(message *BusMessage) error
+	// Messages are the published messages of all instances, own ones included
+	Messages() <-chan *BusMessage
+	Close() error
+}
+
+// LeaderElector picks one of the server instances sharing the DB to run the reminder and webhook scans
+type LeaderElector interface {
+	Leader() bool
+	Close() error
+}
+
+// Cluster is how the instance works together with other instances sharing the DB
+type Cluster struct {
+	InstanceId string
+	Bus        Bus
+	Leader     LeaderElector
+}
+
+// NewCluster uses Postgres to talk to other instances. Memory DB servers run alone.
+func NewCluster(db BuddyDb) (*Cluster, error) {
+	cluster := &Cluster{InstanceId: newInstanceId()}
+
+	psDb, ok := db.(*PostgresDBClient)
+	if !ok {
+		cluster.Bus = standaloneBus{}
+		cluster.Leader = standaloneLeader{}
+		return cluster, nil
+	}
+
+	bus, err := NewPostgresBus(psDb)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Bus = bus
+	cluster.Leader = NewPostgresLeaderElector(psDb, cluster.InstanceId)
+	return cluster, nil
+}
+
+func (c *Cluster) Close() error {
+	leaderErr := c.Leader.Close()
+	if err := c.Bus.Close(); err != nil {
+		return err
+	}
+	return leaderErr
+}
+
+// newInstanceId is the host name with a random suffix, instances on one host still differ
+func newInstanceId() string {
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		host = "tb"
+	}
+	return fmt.Sprintf("%s-%s", host, newLogId()[:8])
+}
+
+// standaloneBus has no other instances to talk to
+type standaloneBus struct{}
+
+func (standaloneBus) Publish(_ *BusMessage) error {
+	return nil
+}
+
+func (standaloneBus) Messages() <-chan *BusMessage {
+	return nil
+}
+
+func (standaloneBus) Close() error {
+	return nil
+}
+
+// standaloneLeader is the leader, there are no other instances
+type standaloneLeader struct{}
+
+func (standaloneLeader) Leader() bool {
+	return true
+}
+
+func (standaloneLeader) Close() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// longer commands are cut, the command is only shown to the user
+	maxCommandLength = 1024
+	// started commands not finished this long after are forgotten
+	maxCommandAge = 24 * time.Hour
+	// the oldest started command of the device is forgotten when it has more
+	maxRunningCommands = 100
+)
+
+// CommandEvent is a command the agent of the user ran in a terminal, reported when it starts and when it finishes
+type CommandEvent struct {
+	Id         string `json:"id,omitempty"` // set by the agent, matches the finished command to the started one
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Host       string `json:"host,omitempty"`
+	Device     string `json:"device"` // device of the agent reporting the command
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+func (e *CommandEvent) Duration() time.Duration {
+	return time.Duration(e.DurationMs) * time.Millisecond
+}
+
+// key matches the finished command to the started one, by id, or by command and host if the agent sends no id
+func (e *CommandEvent) key() string {
+	if len(e.Id) > 0 {
+		return e.Id
+	}
+	return e.Host + "\x00" + e.Command
+}
+
+// validate trims the command, and cuts it to the max length
+func (e *CommandEvent) validate() error {
+	e.Command = strings.TrimSpace(e.Command)
+	if len(e.Command) == 0 {
+		return errorCommandMissing
+	}
+	if e.DurationMs < 0 {
+		return errorCommandDuration
+	}
+	if runes := []rune(e.Command); len(runes) > maxCommandLength {
+		e.Command = string(runes[:maxCommandLength])
+	}
+	return nil
+}
+
+// CommandMessage tells the other devices of the user a long command finished
+type CommandMessage struct {
+	Command *CommandEvent `json:"command"`
+}
+
+// runningCommands keeps the start of commands by user and device, for finished commands reported without duration.
+// Commands are only known to the instance they were started on.
+type runningCommands struct {
+	mutex    sync.Mutex
+	commands map[string]map[string]time.Time // username + device <-> command key <-> started at
+}
+
+func newRunningCommands() *runningCommands {
+	return &runningCommands{commands: make(map[string]map[string]time.Time)}
+}
+
+func runningCommandsKey(username string, device string) string {
+	return username + "\x00" + device
+}
+
+func (rc *runningCommands) start(username string, device string, key string, at time.Time) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	deviceKey := runningCommandsKey(username, device)
+	commands, ok := rc.commands[deviceKey]
+	if !ok {
+		commands = make(map[string]time.Time)
+		rc.commands[deviceKey] = commands
+	}
+
+	oldestKey, oldestAt := "", at
+	for k, startedAt := range commands {
+		if at.Sub(startedAt) > maxCommandAge {
+			delete(commands, k)
+			continue
+		}
+		if startedAt.Before(oldestAt) {
+			oldestKey, oldestAt = k, startedAt
+		}
+	}
+	if _, ok := commands[key]; !ok && len(commands) >= maxRunningCommands {
+		delete(commands, oldestKey)
+	}
+	commands[key] = at
+}
+
+// finish forgets the started command, and returns when it started
+func (rc *runningCommands) finish(username string, device string, key string) (time.Time, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	deviceKey := runningCommandsKey(username, device)
+	commands, ok := rc.commands[deviceKey]
+	if !ok {
+		return time.Time{}, false
+	}
+	startedAt, ok := commands[key]
+	delete(commands, key)
+	if len(commands) == 0 {
+		delete(rc.commands, deviceKey)
+	}
+	return startedAt, ok
+}
@@ -1,6 +1,11 @@
 package internal
 
-import "errors"
+import (
+	"context"
+	"errors"
+
+	"TerminalBuddyServer/config"
+)
 
 // use ORM for postgres
 // https://github.com/go-pg/pg
@@ -12,16 +17,190 @@ const (
 	PsDB
 )
 
-var errorUserNotFound = errors.New("user not found")
+var (
+	errorUserNotFound     = errors.New("user not found")
+	errorReminderNotFound = errors.New("reminder not found")
+	errorWebhookNotFound  = errors.New("webhook not found")
+	errorDeliveryNotFound = errors.New("delivery not found")
+	errorUsernameTaken    = errors.New("username taken")
+	errorTeamNotFound     = errors.New("team not found")
+	errorTeamNameTaken    = errors.New("team name taken")
+	errorNotTeamMember    = errors.New("not a team member")
+
+	errorAssignmentNotFound = errors.New("assignment not found")
+
+	errorDeviceAuthorizationNotFound = errors.New("device authorization not found")
+	errorDeviceTokenNotFound         = errors.New("device token not found")
+)
+
+// OpenDb connects to the DB of the given type. Postgres schema is created and migrated if needed.
+func OpenDb(tbConfig *config.TBConfig, dbType BuddyDbType, recreateDb bool) (BuddyDb, error) {
+	var db BuddyDb
+	switch dbType {
+	case InMemDB:
+		db = NewMemDb()
+	case PsDB:
+		psDb, err := NewPostgresDBClient(tbConfig, recreateDb)
+		if err != nil {
+			return nil, err
+		}
+		db = psDb
+	default:
+		return nil, errors.New("unknown DB type")
+	}
+
+	if !db.DbOk() {
+		return nil, errors.New("DB connection not happy ...")
+	}
+	return db, nil
+}
 
 type BuddyDb interface {
 	DbOk() bool
+	// Ping checks the DB answers, until ctx is done
+	Ping(ctx context.Context) error
 	Close() error
+	// WithContext is the same DB, logging its queries with the request_id of ctx
+	WithContext(ctx context.Context) BuddyDb
 
 	AllUsers() []*User
+	// SaveUser inserts the user if its id is 0, otherwise updates it. Returns errorUsernameTaken if another user
+	// has the same username.
 	SaveUser(user *User) error
+	// SetUserDnd updates only the do not disturb flag, so a stale user does not write back other columns
+	SetUserDnd(userId int64, dnd bool) error
+	// SetUserLastDigestAt updates only the time of the last digest
+	SetUserLastDigestAt(userId int64, at int64) error
+	// UseTotpStep stores the step of an accepted TOTP code, false if the step or a later one was used already
+	UseTotpStep(userId int64, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code hash, false if the user does not have it (anymore)
+	UseRecoveryCode(userId int64, codeHash string) (bool, error)
+	// DeleteUser removes the user with all its reminders, webhooks, device tokens, team memberships and delivery
+	// history
+	DeleteUser(userId int64) error
 	GetUser(username string) (*User, error)
+	GetUserById(userId int64) (*User, error)
+	// GetUsersPage returns at most limit users with id greater than cursor, ordered by id, without reminders
+	GetUsersPage(cursor int64, limit int) ([]*User, error)
+	CountUsersWithRole(role string) (int, error)
+	GetStats() (*DbStats, error)
+	GetUserByFeedToken(feedToken string) (*User, error)
 	AckReminder(reminderId int64, ack bool) error
+	GetReminder(userId, reminderId int64) (*Reminder, error)
+	// GetRemindersPage returns at most limit reminders of the user with id greater than cursor, ordered by id
+	GetRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error)
+	RemindersCount(userId int64) (int, error)
+	// RemindersVersion changes whenever a reminder of the user is added, changed or deleted, without loading the
+	// reminders
+	RemindersVersion(userId int64) (string, error)
 	SaveReminder(reminder *Reminder) error
-	NewReminder(username string, message string, dueDate int64) error
+	// SetReminderFallbackSent updates only the fallback flag, an ack or edit meanwhile is kept
+	SetReminderFallbackSent(reminderId int64) error
+	// NewReminder stores a new reminder for the user, or updates the existing one with the same Uid
+	NewReminder(username string, reminder *Reminder) error
+	// SearchReminders returns user reminders matching the query, best ranked first
+	SearchReminders(userId int64, query ReminderSearchQuery) ([]*ReminderSearchResult, error)
+
+	SaveWebhook(webhook *Webhook) error
+	GetWebhook(userId, webhookId int64) (*Webhook, error)
+	GetWebhooks(userId int64) ([]*Webhook, error)
+	DeleteWebhook(userId, webhookId int64) error
+	// SaveWebhookDelivery inserts the delivery if its id is 0, otherwise updates it
+	SaveWebhookDelivery(delivery *WebhookDelivery) error
+	// GetPendingWebhookDeliveries returns pending deliveries with next attempt not after the given unix time
+	GetPendingWebhookDeliveries(before int64, limit int) ([]*WebhookDelivery, error)
+	// GetWebhookDeliveries returns the latest deliveries of the webhook, newest first
+	GetWebhookDeliveries(webhookId int64, limit int) ([]*WebhookDelivery, error)
+
+	// SaveReminderDelivery inserts the delivery if its id is 0, otherwise updates it
+	SaveReminderDelivery(delivery *ReminderDelivery) error
+	// GetReminderDeliveries returns all delivery attempts of the reminder, oldest first
+	GetReminderDeliveries(reminderId int64) ([]*ReminderDelivery, error)
+
+	// SaveLoginFailure inserts or updates the failures of the login failure key
+	SaveLoginFailure(failure *LoginFailure) error
+	DeleteLoginFailure(key string) error
+	GetLoginFailures() ([]*LoginFailure, error)
+
+	// SaveDeviceAuthorization inserts or updates the authorization with the same device code hash
+	SaveDeviceAuthorization(authorization *DeviceAuthorization) error
+	GetDeviceAuthorization(deviceCodeHash string) (*DeviceAuthorization, error)
+	GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error)
+	// DeleteDeviceAuthorization returns errorDeviceAuthorizationNotFound if there was nothing to delete, e.g. a
+	// concurrent request deleted it first
+	DeleteDeviceAuthorization(deviceCodeHash string) error
+	// DeleteExpiredDeviceAuthorizations removes authorizations expiring before the given unix time
+	DeleteExpiredDeviceAuthorizations(before int64) error
+
+	// SaveDeviceToken inserts the token if its id is 0, otherwise updates it
+	SaveDeviceToken(token *DeviceToken) error
+	GetDeviceToken(tokenHash string) (*DeviceToken, error)
+	GetDeviceTokens(userId int64) ([]*DeviceToken, error)
+	DeleteDeviceToken(userId, tokenId int64) error
+	DeleteDeviceTokens(userId int64) error
+
+	// SaveTeam inserts the team if its id is 0, otherwise updates it. Returns errorTeamNameTaken if another team
+	// has the same name.
+	SaveTeam(team *Team) error
+	GetTeam(name string) (*Team, error)
+	// DeleteTeam removes the team with its members and team reminders
+	DeleteTeam(teamId int64) error
+	// GetUserTeams returns the teams the user is a member of or invited to, ordered by name
+	GetUserTeams(userId int64) ([]*UserTeam, error)
+	// SaveTeamMember inserts the member, or updates the role, invited state and joined time if the user is a member
+	// already
+	SaveTeamMember(member *TeamMember) error
+	// GetTeamMember returns errorNotTeamMember if the user is neither a member of the team nor invited to it
+	GetTeamMember(teamId, userId int64) (*TeamMember, error)
+	// GetTeamMembers returns the members of the team and the invited users with their usernames, ordered by username
+	GetTeamMembers(teamId int64) ([]*TeamMember, error)
+	DeleteTeamMember(teamId, userId int64) error
+	// NewTeamReminder stores a new reminder of the team the reminder TeamId is set to
+	NewTeamReminder(reminder *Reminder) error
+	GetTeamReminder(teamId, reminderId int64) (*Reminder, error)
+	// GetTeamReminders returns all reminders of the team ordered by id, without member acks
+	GetTeamReminders(teamId int64) ([]*Reminder, error)
+	DeleteTeamReminder(teamId, reminderId int64) error
+	// GetMemberTeamReminders returns the reminders of all teams of the user, with the ack of the user and the team
+	// name set. Teams the user is only invited to are left out.
+	GetMemberTeamReminders(userId int64) ([]*Reminder, error)
+	// AckTeamReminder stores the ack of the team reminder by the user, acking again keeps the first ack
+	AckTeamReminder(reminderId, userId int64) error
+	GetTeamReminderAcks(reminderId int64) ([]*TeamReminderAck, error)
+
+	// SaveReminderAssignment inserts the assignment if its id is 0, otherwise updates it
+	SaveReminderAssignment(assignment *ReminderAssignment) error
+	GetReminderAssignment(reminderId int64) (*ReminderAssignment, error)
+	// GetReminderAssignments returns the assignments of the reminders of the user, the creator
+	GetReminderAssignments(userId int64) ([]*ReminderAssignment, error)
+	// GetAssignedReminders returns the reminders of others assigned to the user and not declined, ordered by id,
+	// with their origin set
+	GetAssignedReminders(userId int64) ([]*Reminder, error)
+	// GetVisibleRemindersPage is GetRemindersPage with the reminders assigned to the user and not declined, the
+	// origin of assigned reminders is set on both sides
+	GetVisibleRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error)
+}
+
+type DbStats struct {
+	Users            int `json:"users"`
+	Reminders        int `json:"reminders"`
+	UnackedReminders int `json:"unacked_reminders"`
+	Webhooks         int `json:"webhooks"`
+}
+
+// allUserReminders loads every reminder of the user, page by page
+func allUserReminders(db BuddyDb, userId int64) ([]*Reminder, error) {
+	var reminders []*Reminder
+	cursor := int64(0)
+	for {
+		page, err := db.GetRemindersPage(userId, cursor, maxRemindersPageLimit)
+		if err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, page...)
+		if len(page) < maxRemindersPageLimit {
+			return reminders, nil
+		}
+		cursor = page[len(page)-1].Id
+	}
 }
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+)
+
+const maxDeliveryQueueSize = 1000
+
+var (
+	errorQueueFull   = errors.New("delivery queue full")
+	errorQueueClosed = errors.New("delivery queue closed")
+)
+
+// DeliveryQueue holds messages for one agent client until its transport (websocket, SSE or long poll) sends them
+type DeliveryQueue struct {
+	mutex    sync.Mutex
+	messages [][]byte
+	ready    chan Signal // has a signal while there are messages
+	done     chan Signal // closed when the queue is closed
+	closed   bool
+}
+
+func NewDeliveryQueue() *DeliveryQueue {
+	return &DeliveryQueue{
+		ready: make(chan Signal, 1),
+		done:  make(chan Signal),
+	}
+}
+
+func (q *DeliveryQueue) Push(message []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errorQueueClosed
+	}
+	if len(q.messages) >= maxDeliveryQueueSize {
+		return errorQueueFull
+	}
+
+	q.messages = append(q.messages, message)
+	select {
+	case q.ready <- EmptySignal:
+	default:
+	}
+
+	return nil
+}
+
+// Drain removes and returns all queued messages
+func (q *DeliveryQueue) Drain() [][]byte {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	messages := q.messages
+	q.messages = nil
+	select {
+	case <-q.ready:
+	default:
+	}
+
+	return messages
+}
+
+// Ready receives a signal when there are messages to drain
+func (q *DeliveryQueue) Ready() <-chan Signal {
+	return q.ready
+}
+
+// Done is closed when the queue is closed
+func (q *DeliveryQueue) Done() <-chan Signal {
+	return q.done
+}
+
+func (q *DeliveryQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// deviceApprovePage is the RFC 8628 verification page. It posts the form to handleDeviceApprove and shows the
+// response message, so the API stays the same for agents and scripts approving devices.
+var deviceApprovePage = template.Must(template.New("device_approve").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Terminal Buddy - approve device</title>
+</head>
+<body>
+<h1>Approve device</h1>
+<p>Approve only if the code matches the one your terminal shows.</p>
+<form id="approve" method="post">
+<p><label>User code <input name="user_code" value="{{.UserCode}}" required autocomplete="off"></label></p>
+<p><label>Username <input name="username" required autocomplete="username"></label></p>
+<p><label>Password <input name="password" type="password" required autocomplete="current-password"></label></p>
+<p><label>TOTP code (if enabled) <input name="totp_code" autocomplete="one-time-code"></label></p>
+<p><button type="submit" name="deny" value="false">Approve</button> <button type="submit" name="deny" value="true">Deny</button></p>
+</form>
+<p id="result"></p>
+<script>
+document.getElementById("approve").addEventListener("submit", function (e) {
+	e.preventDefault();
+	var body = new URLSearchParams(new FormData(e.target));
+	body.set("deny", e.submitter ? e.submitter.value : "false");
+	fetch(e.target.action, {method: "POST", body: body}).then(function (resp) {
+		return resp.json();
+	}).then(function (resp) {
+		document.getElementById("result").textContent = resp.ok ? "Device " + resp.message + "." : "Error: " + resp.message;
+	}).catch(function () {
+		document.getElementById("result").textContent = "Error: no response";
+	});
+});
+</script>
+</body>
+</html>
+`))
+
+// handleDeviceApprovePage serves the approval page the device authorization points users to, with the user_code
+// of verification_uri_complete filled in
+func (handler *UserHandler) handleDeviceApprovePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the page takes credentials, it must not be framed by other sites
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+
+	data := struct{ UserCode string }{UserCode: r.URL.Query().Get("user_code")}
+	if err := deviceApprovePage.Execute(w, data); err != nil {
+		requestLog(r).Errorf("error rendering device approval page: %s", err.Error())
+	}
+}
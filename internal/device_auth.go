@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Device authorization grant, RFC 8628. The agent gets a device code and a short user code, the user approves
+// the user code from a logged in session, and the agent polling with the device code gets a device token.
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+
+	deviceCodeTTL       = 10 * time.Minute
+	deviceCodeInterval  = 5                      // seconds, min wait between polls
+	userCodeAlphabet    = "BCDFGHJKLMNPQRSTVWXZ" // no vowels, so no words, as RFC 8628 suggests
+	userCodeLength      = 8
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// RFC 8628 token endpoint error codes
+const (
+	deviceErrorAuthorizationPending = "authorization_pending"
+	deviceErrorSlowDown             = "slow_down"
+	deviceErrorAccessDenied         = "access_denied"
+	deviceErrorExpiredToken         = "expired_token"
+)
+
+// DeviceAuthorization is a pending device login, stored until the agent gets its token or it expires
+type DeviceAuthorization struct {
+	DeviceCodeHash string `pg:",pk"` // sha256 of the device code, only the agent knows the code
+	UserCode       string `pg:",unique,notnull"`
+	Device         string `pg:",notnull"`
+	Status         string `pg:",notnull"`
+	UserId         int64  // set on approval
+	ExpiresAt      int64  `pg:",notnull"`
+	LastPolledAt   int64  `pg:",use_zero"`
+}
+
+// DeviceToken lets one agent device connect without the user credentials
+type DeviceToken struct {
+	Id         int64  `json:"id"`
+	UserId     int64  `json:"-" pg:",notnull"`
+	Device     string `json:"device" pg:",notnull"`
+	TokenHash  string `json:"-" pg:",unique,notnull"`
+	CreatedAt  int64  `json:"created_at" pg:",notnull"`
+	LastUsedAt int64  `json:"last_used_at"`
+}
+
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Device      string `json:"device"`
+}
+
+func (a *DeviceAuthorization) expired(now time.Time) bool {
+	return now.Unix() >= a.ExpiresAt
+}
+
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, userCodeLength)
+	for i := range b {
+		// modulo bias is negligible for a code which expires in minutes
+		code[i] = userCodeAlphabet[int(b[i])%len(userCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// formatUserCode is how the user code is shown, XXXX-XXXX
+func formatUserCode(userCode string) string {
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// normalizeUserCode accepts the code as typed, in any case and with or without the dash
+func normalizeUserCode(userCode string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(userCode))
+}
+
+// secretHash is how device codes and device tokens are stored
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
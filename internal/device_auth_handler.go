@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const maxDeviceNameLength = 64
+
+// handleDeviceCode starts the device authorization, the agent shows the user code and polls handleDeviceToken
+func (handler *UserHandler) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	device := r.FormValue("device")
+	if len(device) == 0 {
+		device = defaultDevice
+	}
+	if len(device) > maxDeviceNameLength {
+		sendSimpleBadRequestResponse(w, "device name too long")
+		return
+	}
+
+	now := time.Now()
+	if err := db.DeleteExpiredDeviceAuthorizations(now.Unix()); err != nil {
+		requestLog(r).Errorf("error deleting expired device authorizations: %s", err.Error())
+	}
+
+	deviceCode, err := newRandomToken()
+	if err != nil {
+		requestLog(r).Errorf("error creating device code: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create device code")
+		return
+	}
+
+	authorization := &DeviceAuthorization{
+		DeviceCodeHash: secretHash(deviceCode),
+		Device:         device,
+		Status:         DeviceAuthorizationPending,
+		ExpiresAt:      now.Add(deviceCodeTTL).Unix(),
+	}
+	// user codes are short, a collision with a pending one is unlikely but possible
+	for attempt := 0; attempt < 3; attempt++ {
+		if authorization.UserCode, err = newUserCode(); err != nil {
+			break
+		}
+		if err = db.SaveDeviceAuthorization(authorization); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		requestLog(r).Errorf("error saving device authorization: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create device code")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	verificationUri := fmt.Sprintf("%s://%s/user/device/approve", scheme, r.Host)
+	userCode := formatUserCode(authorization.UserCode)
+
+	codeJsonBytes, err := json.Marshal(DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: verificationUri + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(deviceCodeTTL / time.Second),
+		Interval:                deviceCodeInterval,
+	})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling device code: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: codeJsonBytes,
+	})
+}
+
+// handleDeviceApprove approves (or with deny=true denies) the device showing the user_code, from a logged in
+// session. Users with TOTP enabled have to send the second factor too.
+func (handler *UserHandler) handleDeviceApprove(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	deny := false
+	if denyStr := r.FormValue("deny"); len(denyStr) > 0 {
+		var err error
+		if deny, err = strconv.ParseBool(denyStr); err != nil {
+			sendSimpleBadRequestResponse(w, "deny value invalid")
+			return
+		}
+	}
+
+	authorization, err := db.GetDeviceAuthorizationByUserCode(normalizeUserCode(r.FormValue("user_code")))
+	if err == errorDeviceAuthorizationNotFound || (err == nil && authorization.expired(time.Now())) {
+		sendSimpleErrResponse(w, http.StatusNotFound, "user code not found / expired")
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("error getting device authorization for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get device authorization")
+		return
+	}
+	if authorization.Status != DeviceAuthorizationPending {
+		sendSimpleErrResponse(w, http.StatusConflict, "user code already used")
+		return
+	}
+
+	authorization.Status = DeviceAuthorizationApproved
+	if deny {
+		authorization.Status = DeviceAuthorizationDenied
+	}
+	authorization.UserId = user.Id
+	if err := db.SaveDeviceAuthorization(authorization); err != nil {
+		requestLog(r).Errorf("error saving device authorization for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save device authorization")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] %s device [%s] from %s", user.Username, authorization.Status, authorization.Device, clientIp(r))
+
+	sendSimpleResponse(w, authorization.Status)
+}
+
+// handleDeviceToken is polled by the agent with its device_code. Until the user approves, the response message is
+// one of the RFC 8628 error codes, after approval the device token is sent once.
+func (handler *UserHandler) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	if grantType := r.FormValue("grant_type"); len(grantType) > 0 && grantType != deviceCodeGrantType {
+		sendSimpleBadRequestResponse(w, "unsupported_grant_type")
+		return
+	}
+
+	deviceCodeHash := secretHash(r.FormValue("device_code"))
+	authorization, err := db.GetDeviceAuthorization(deviceCodeHash)
+	if err == errorDeviceAuthorizationNotFound {
+		sendSimpleBadRequestResponse(w, "invalid_grant")
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("error getting device authorization: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get device authorization")
+		return
+	}
+
+	now := time.Now()
+	if authorization.expired(now) {
+		handler.deleteDeviceAuthorization(r, deviceCodeHash)
+		sendSimpleBadRequestResponse(w, deviceErrorExpiredToken)
+		return
+	}
+
+	switch authorization.Status {
+	case DeviceAuthorizationDenied:
+		handler.deleteDeviceAuthorization(r, deviceCodeHash)
+		sendSimpleBadRequestResponse(w, deviceErrorAccessDenied)
+	case DeviceAuthorizationApproved:
+		handler.sendDeviceToken(w, r, authorization)
+	default:
+		tooFast := now.Unix()-authorization.LastPolledAt < deviceCodeInterval
+		authorization.LastPolledAt = now.Unix()
+		if err := db.SaveDeviceAuthorization(authorization); err != nil {
+			requestLog(r).Errorf("error saving device authorization poll: %s", err.Error())
+		}
+		if tooFast {
+			sendSimpleBadRequestResponse(w, deviceErrorSlowDown)
+			return
+		}
+		sendSimpleBadRequestResponse(w, deviceErrorAuthorizationPending)
+	}
+}
+
+// sendDeviceToken creates the device token of the approved authorization, the authorization is used up
+func (handler *UserHandler) sendDeviceToken(w http.ResponseWriter, r *http.Request, authorization *DeviceAuthorization) {
+	db := handler.db.WithContext(r.Context())
+	token, err := newRandomToken()
+	if err != nil {
+		requestLog(r).Errorf("error creating device token: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create device token")
+		return
+	}
+
+	// deleted first, so a concurrent poll cannot get a second token: only one of them deletes it
+	err = db.DeleteDeviceAuthorization(authorization.DeviceCodeHash)
+	if err == errorDeviceAuthorizationNotFound {
+		sendSimpleBadRequestResponse(w, "invalid_grant")
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("error deleting device authorization: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create device token")
+		return
+	}
+
+	deviceToken := &DeviceToken{
+		UserId:    authorization.UserId,
+		Device:    authorization.Device,
+		TokenHash: secretHash(token),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := db.SaveDeviceToken(deviceToken); err != nil {
+		requestLog(r).Errorf("error saving device token of user %d: %s", authorization.UserId, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save device token")
+		return
+	}
+
+	tokenJsonBytes, err := json.Marshal(DeviceTokenResponse{
+		AccessToken: token,
+		TokenType:   "device",
+		Device:      deviceToken.Device,
+	})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling device token: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: tokenJsonBytes,
+	})
+}
+
+func (handler *UserHandler) deleteDeviceAuthorization(r *http.Request, deviceCodeHash string) {
+	err := handler.db.WithContext(r.Context()).DeleteDeviceAuthorization(deviceCodeHash)
+	if err != nil && err != errorDeviceAuthorizationNotFound {
+		requestLog(r).Errorf("error deleting device authorization: %s", err.Error())
+	}
+}
+
+// handleDeviceTokens lists the device tokens of the user
+func (handler *UserHandler) handleDeviceTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := handler.db.WithContext(r.Context()).GetDeviceTokens(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting device tokens of user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get device tokens")
+		return
+	}
+	if tokens == nil {
+		tokens = []*DeviceToken{}
+	}
+
+	tokensJsonBytes, err := json.Marshal(tokens)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling device tokens of user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: tokensJsonBytes,
+	})
+}
+
+// handleDeviceRevoke deletes the device token with the given id and disconnects the agent of the device, the device
+// has to be authorized again
+func (handler *UserHandler) handleDeviceRevoke(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokenId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id missing / invalid")
+		return
+	}
+
+	tokens, err := db.GetDeviceTokens(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting device tokens of user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot revoke device token")
+		return
+	}
+	var device string
+	for _, token := range tokens {
+		if token.Id == tokenId {
+			device = token.Device
+		}
+	}
+
+	if err := db.DeleteDeviceToken(user.Id, tokenId); err != nil {
+		if err == errorDeviceTokenNotFound {
+			sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+			return
+		}
+		requestLog(r).Errorf("error revoking device token %d of user [%s]: %s", tokenId, user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot revoke device token")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] revoked device token %d", user.Username, tokenId)
+	if len(device) > 0 {
+		handler.nm.DisconnectDevice(user.Username, device)
+	}
+
+	sendSimpleResponse(w, "revoked")
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	digestDateFormat = "2006-01-02"
+	// digest is sent at most this late after the user digest time, e.g. if server was down
+	digestSendWindow = time.Hour
+)
+
+// Digest is the daily summary of user reminders which are not acked yet
+type Digest struct {
+	Date     string      `json:"date"` // in user timezone
+	Today    []*Reminder `json:"today"`
+	Overdue  []*Reminder `json:"overdue"`
+	Upcoming []*Reminder `json:"upcoming"` // rest of the week
+}
+
+type DigestMessage struct {
+	Digest *Digest `json:"digest"`
+}
+
+// BuildDigest sorts not acked reminders into overdue, due today and due in the next 7 days, in user timezone
+func BuildDigest(user *User, reminders []*Reminder, now time.Time) *Digest {
+	local := now.In(user.Location())
+	todayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	tomorrowStart := todayStart.AddDate(0, 0, 1)
+	weekEnd := todayStart.AddDate(0, 0, 8)
+
+	digest := &Digest{
+		Date:     local.Format(digestDateFormat),
+		Today:    []*Reminder{},
+		Overdue:  []*Reminder{},
+		Upcoming: []*Reminder{},
+	}
+	for _, r := range reminders {
+		if r.Ack {
+			continue
+		}
+		dueDate := time.Unix(r.DueDate, 0)
+		switch {
+		case dueDate.Before(todayStart):
+			digest.Overdue = append(digest.Overdue, r)
+		case dueDate.Before(tomorrowStart):
+			digest.Today = append(digest.Today, r)
+		case dueDate.Before(weekEnd):
+			digest.Upcoming = append(digest.Upcoming, r)
+		}
+	}
+
+	for _, list := range [][]*Reminder{digest.Overdue, digest.Today, digest.Upcoming} {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].DueDate < list[j].DueDate
+		})
+	}
+
+	return digest
+}
+
+func (d *Digest) Empty() bool {
+	return len(d.Today) == 0 && len(d.Overdue) == 0 && len(d.Upcoming) == 0
+}
+
+// Text renders the digest for terminals and emails, times in the given location
+func (d *Digest) Text(location *time.Location) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Your reminders for %s\n", d.Date))
+
+	sections := []struct {
+		title      string
+		reminders  []*Reminder
+		timeFormat string
+	}{
+		{"Overdue", d.Overdue, "Mon Jan 2 15:04"},
+		{"Today", d.Today, "15:04"},
+		{"This week", d.Upcoming, "Mon Jan 2 15:04"},
+	}
+	for _, s := range sections {
+		if len(s.reminders) == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\n%s:\n", s.title))
+		for _, r := range s.reminders {
+			priority := ""
+			if r.HighPriority() {
+				priority = " (!)"
+			}
+			dueDate := time.Unix(r.DueDate, 0).In(location).Format(s.timeFormat)
+			sb.WriteString(fmt.Sprintf("  %s  %s%s\n", dueDate, r.Message, priority))
+		}
+	}
+
+	if d.Empty() {
+		sb.WriteString("\nNothing to do, enjoy your day.\n")
+	}
+
+	return sb.String()
+}
+
+// digestDue is true if now is in the send window after user digest time, and digest was not sent today
+func (u *User) digestDue(now time.Time) bool {
+	if len(u.DigestTime) == 0 {
+		return false
+	}
+	digestMinute, err := minuteOfDay(u.DigestTime)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(u.Location())
+	minute := local.Hour()*60 + local.Minute()
+	if minute < digestMinute || minute >= digestMinute+int(digestSendWindow/time.Minute) {
+		return false
+	}
+
+	if u.LastDigestAt == 0 {
+		return true
+	}
+	lastDigestDate := time.Unix(u.LastDigestAt, 0).In(u.Location()).Format(digestDateFormat)
+	return lastDigestDate != local.Format(digestDateFormat)
+}
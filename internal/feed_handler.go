@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FeedHandler serves read only iCalendar feeds, calendar clients poll them using the secret feed token
+type FeedHandler struct {
+	db     BuddyDb
+	router *mux.Router
+}
+
+func NewFeedHandler(db BuddyDb, feedRouter *mux.Router) {
+	handler := &FeedHandler{
+		db:     db,
+		router: feedRouter,
+	}
+
+	feedRouter.HandleFunc("/{token}.ics", handler.handleFeed).Methods("GET", "HEAD")
+}
+
+// newRandomToken returns 32 random bytes, hex encoded
+func newRandomToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+func feedPath(feedToken string) string {
+	return fmt.Sprintf("/feed/%s.ics", feedToken)
+}
+
+func (handler *FeedHandler) handleFeed(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	token := mux.Vars(r)["token"]
+	user, err := db.GetUserByFeedToken(token)
+	if err != nil || user.Disabled {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	asEvents := r.URL.Query().Get("type") == "event"
+
+	// polled often, so the ETag comes from the reminders version, the reminders are loaded only if they changed.
+	// DTSTAMP changes with every render, so the ETag is weak.
+	version, err := db.RemindersVersion(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] reminders version for feed: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
+		return
+	}
+	etag := feedETag(version, asEvents)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	reminders, err := allUserReminders(db, user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] reminders for feed: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
+		return
+	}
+
+	if _, err := w.Write(EncodeICalendar(reminders, asEvents, time.Now())); err != nil {
+		requestLog(r).Warnf("failed to send ics feed to user [%s]: %s", user.Username, err)
+	}
+}
+
+func feedETag(remindersVersion string, asEvents bool) string {
+	hash := sha256.New()
+	hash.Write([]byte(remindersVersion))
+	if asEvents {
+		hash.Write([]byte("event"))
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum(nil)[:16])
+}
+
+// etagMatches checks the If-None-Match header value, using weak comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
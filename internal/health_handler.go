@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DB check fails if the DB does not answer in this time
+	healthDbTimeout = 2 * time.Second
+	// scheduler check of the leader fails if no reminders scan finished (or, before the first scan, the scan loop
+	// started or the instance became leader) this long ago
+	maxScanAge = 3 * scanInterval
+)
+
+type ComponentStatus struct {
+	Ok         bool   `json:"ok"`
+	Message    string `json:"message"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	// unix seconds of the last finished reminders scan, scheduler only
+	LastScanAt int64 `json:"last_scan_at,omitempty"`
+}
+
+type Readiness struct {
+	Ready      bool                        `json:"ready"`
+	Components map[string]*ComponentStatus `json:"components"`
+}
+
+// HealthHandler serves the liveness and readiness checks of orchestrators and load balancers. Liveness only says
+// the server answers, readiness checks what the server needs to serve users.
+type HealthHandler struct {
+	db     BuddyDb
+	nm     *NotificationManager
+	router *mux.Router
+}
+
+func NewHealthHandler(db BuddyDb, nm *NotificationManager, healthRouter *mux.Router) {
+	handler := &HealthHandler{
+		db:     db,
+		nm:     nm,
+		router: healthRouter,
+	}
+
+	healthRouter.HandleFunc("/live", handler.handleLive).Methods("GET", "HEAD")
+	healthRouter.HandleFunc("/ready", handler.handleReady).Methods("GET", "HEAD")
+}
+
+func (handler *HealthHandler) handleLive(w http.ResponseWriter, r *http.Request) {
+	sendSimpleResponse(w, "i'm fine <3")
+}
+
+// handleReady answers 503 if any component is not ok, the message names them
+func (handler *HealthHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{
+		Ready: true,
+		Components: map[string]*ComponentStatus{
+			"db":        handler.checkDb(r),
+			"scheduler": handler.checkScheduler(),
+		},
+	}
+
+	var failed []string
+	for name, status := range readiness.Components {
+		if !status.Ok {
+			readiness.Ready = false
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+
+	readinessJsonBytes, err := json.Marshal(readiness)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling readiness: %s", err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	if !readiness.Ready {
+		requestLog(r).Warnf("not ready: %s", strings.Join(failed, ", "))
+		sendResp(w, http.StatusServiceUnavailable, Response{
+			Ok:            false,
+			Message:       "not ready: " + strings.Join(failed, ", "),
+			DataJsonBytes: readinessJsonBytes,
+		})
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ready",
+		DataJsonBytes: readinessJsonBytes,
+	})
+}
+
+// checkDb pings the DB, and gives up after healthDbTimeout even if the DB driver does not
+func (handler *HealthHandler) checkDb(r *http.Request) *ComponentStatus {
+	ctx, cancel := context.WithTimeout(r.Context(), healthDbTimeout)
+	defer cancel()
+
+	start := time.Now()
+	pingResult := make(chan error, 1)
+	go func() {
+		pingResult <- handler.db.WithContext(r.Context()).Ping(ctx)
+	}()
+
+	select {
+	case err := <-pingResult:
+		status := &ComponentStatus{Ok: err == nil, Message: "ok", DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			status.Message = fmt.Sprintf("ping failed: %s", err)
+		}
+		return status
+	case <-ctx.Done():
+		return &ComponentStatus{
+			Ok:         false,
+			Message:    fmt.Sprintf("no answer in %s", healthDbTimeout),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+	}
+}
+
+func (handler *HealthHandler) checkScheduler() *ComponentStatus {
+	state := handler.nm.SchedulerState()
+	if !state.Running {
+		return &ComponentStatus{Ok: false, Message: "reminders scan not started"}
+	}
+	if !state.Leader {
+		return &ComponentStatus{Ok: true, Message: "standing by, another instance scans reminders"}
+	}
+
+	if state.LastScanAt.IsZero() {
+		age := time.Since(state.Since)
+		return &ComponentStatus{
+			Ok:      age <= maxScanAge,
+			Message: fmt.Sprintf("no scan finished yet, started %s ago", age.Truncate(time.Second)),
+		}
+	}
+
+	age := time.Since(state.LastScanAt)
+	return &ComponentStatus{
+		Ok:         age <= maxScanAge,
+		Message:    fmt.Sprintf("last scan finished %s ago", age.Truncate(time.Second)),
+		LastScanAt: state.LastScanAt.Unix(),
+	}
+}
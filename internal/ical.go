@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minimal iCalendar (RFC 5545) support, just enough to move reminders in and out of calendar apps
+
+const (
+	icsProdId         = "-//terminal-buddy//terminal-buddy-server//EN"
+	icsDateTimeFormat = "20060102T150405Z"
+	icsMaxLineOctets  = 75
+)
+
+// reminderUid returns the UID used for the reminder in iCalendar data
+func reminderUid(reminder *Reminder) string {
+	if len(reminder.Uid) > 0 {
+		return reminder.Uid
+	}
+	return fmt.Sprintf("tb-reminder-%d@terminal-buddy", reminder.Id)
+}
+
+// reminderIdFromUid returns the id of a reminder exported by us, or false if the UID came from somewhere else
+func reminderIdFromUid(uid string) (int64, bool) {
+	if !strings.HasPrefix(uid, "tb-reminder-") || !strings.HasSuffix(uid, "@terminal-buddy") {
+		return 0, false
+	}
+	idStr := strings.TrimSuffix(strings.TrimPrefix(uid, "tb-reminder-"), "@terminal-buddy")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// EncodeICalendar renders reminders as VTODO components, or as VEVENT components if asEvents is set,
+// each with a display alarm at the due date
+func EncodeICalendar(reminders []*Reminder, asEvents bool, now time.Time) []byte {
+	var buf bytes.Buffer
+	writeIcsLine(&buf, "BEGIN:VCALENDAR")
+	writeIcsLine(&buf, "VERSION:2.0")
+	writeIcsLine(&buf, "PRODID:"+icsProdId)
+	writeIcsLine(&buf, "CALSCALE:GREGORIAN")
+
+	dtStamp := now.UTC().Format(icsDateTimeFormat)
+	for _, r := range reminders {
+		dueDate := time.Unix(r.DueDate, 0).UTC().Format(icsDateTimeFormat)
+		if asEvents {
+			writeIcsLine(&buf, "BEGIN:VEVENT")
+		} else {
+			writeIcsLine(&buf, "BEGIN:VTODO")
+		}
+		writeIcsLine(&buf, "UID:"+escapeIcsText(reminderUid(r)))
+		writeIcsLine(&buf, "DTSTAMP:"+dtStamp)
+		writeIcsLine(&buf, "SUMMARY:"+escapeIcsText(r.Message))
+		if len(r.Tags) > 0 {
+			var tags []string
+			for _, t := range r.Tags {
+				tags = append(tags, escapeIcsText(t))
+			}
+			writeIcsLine(&buf, "CATEGORIES:"+strings.Join(tags, ","))
+		}
+		if asEvents {
+			writeIcsLine(&buf, "DTSTART:"+dueDate)
+		} else {
+			writeIcsLine(&buf, "DUE:"+dueDate)
+			if r.Ack {
+				writeIcsLine(&buf, "STATUS:COMPLETED")
+			} else {
+				writeIcsLine(&buf, "STATUS:NEEDS-ACTION")
+			}
+		}
+		writeIcsLine(&buf, "BEGIN:VALARM")
+		writeIcsLine(&buf, "ACTION:DISPLAY")
+		writeIcsLine(&buf, "DESCRIPTION:"+escapeIcsText(r.Message))
+		if asEvents {
+			writeIcsLine(&buf, "TRIGGER:PT0S")
+		} else {
+			writeIcsLine(&buf, "TRIGGER;RELATED=END:PT0S")
+		}
+		writeIcsLine(&buf, "END:VALARM")
+		if asEvents {
+			writeIcsLine(&buf, "END:VEVENT")
+		} else {
+			writeIcsLine(&buf, "END:VTODO")
+		}
+	}
+
+	writeIcsLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// writeIcsLine writes a content line, folding it so no line is longer than 75 octets
+func writeIcsLine(buf *bytes.Buffer, line string) {
+	limit := icsMaxLineOctets
+	for len(line) > limit {
+		// do not split multi byte characters
+		cut := limit
+		for cut > 0 && !isUtf8Start(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space, which counts
+		limit = icsMaxLineOctets - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isUtf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func escapeIcsText(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(text)
+}
+
+func unescapeIcsText(text string) string {
+	return strings.NewReplacer(
+		`\\`, `\`,
+		`\;`, ";",
+		`\,`, ",",
+		`\n`, "\n",
+		`\N`, "\n",
+	).Replace(text)
+}
+
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseICalendar reads VTODO and VEVENT components into reminders. UIDs are kept in Reminder.Uid so
+// the same calendar can be imported again without duplicating reminders.
+func ParseICalendar(reader io.Reader) ([]*Reminder, error) {
+	lines, err := unfoldIcsLines(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var reminders []*Reminder
+	var current *Reminder
+	var components []string
+	for i, line := range lines {
+		prop, err := parseIcsProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		switch prop.name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(prop.value))
+			if len(components) == 2 && (components[1] == "VTODO" || components[1] == "VEVENT") {
+				current = &Reminder{}
+			}
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != strings.ToUpper(prop.value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", i+1, prop.value)
+			}
+			components = components[:len(components)-1]
+			if len(components) == 1 && current != nil {
+				if len(current.Uid) == 0 {
+					return nil, fmt.Errorf("line %d: component without UID", i+1)
+				}
+				if current.DueDate == 0 {
+					return nil, fmt.Errorf("line %d: component %s without due date", i+1, current.Uid)
+				}
+				reminders = append(reminders, current)
+				current = nil
+			}
+			continue
+		}
+
+		// only properties of the component itself, not of nested alarms
+		if current == nil || len(components) != 2 {
+			continue
+		}
+
+		switch prop.name {
+		case "UID":
+			current.Uid = unescapeIcsText(prop.value)
+		case "SUMMARY":
+			current.Message = unescapeIcsText(prop.value)
+		case "CATEGORIES":
+			for _, t := range splitIcsList(prop.value) {
+				current.Tags = append(current.Tags, ParseTags(unescapeIcsText(t))...)
+			}
+		case "STATUS":
+			current.Ack = strings.ToUpper(prop.value) == "COMPLETED"
+		case "DUE", "DTSTART":
+			// DUE wins over DTSTART for todos
+			if prop.name == "DTSTART" && current.DueDate != 0 {
+				continue
+			}
+			t, err := parseIcsTime(prop)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current.DueDate = t.Unix()
+		}
+	}
+
+	if len(components) != 0 {
+		return nil, fmt.Errorf("unterminated %s", components[len(components)-1])
+	}
+
+	return reminders, nil
+}
+
+func unfoldIcsLines(reader io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func parseIcsProperty(line string) (icsProperty, error) {
+	prop := icsProperty{params: make(map[string]string)}
+
+	// the value starts after the first colon that is not inside a quoted parameter value
+	inQuotes := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("malformed content line: %q", line)
+	}
+
+	prop.value = line[colon+1:]
+	nameAndParams := strings.Split(line[:colon], ";")
+	prop.name = strings.ToUpper(nameAndParams[0])
+	for _, p := range nameAndParams[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		prop.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	return prop, nil
+}
+
+// splitIcsList splits a comma separated value, respecting escaped commas
+func splitIcsList(value string) []string {
+	var items []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == ',' {
+			items = append(items, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, value[start:])
+}
+
+func parseIcsTime(prop icsProperty) (time.Time, error) {
+	value := prop.value
+	if prop.params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		return time.ParseInLocation("20060102", value, time.UTC)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse(icsDateTimeFormat, value)
+	}
+
+	location := time.UTC
+	if tzId, ok := prop.params["TZID"]; ok {
+		if loc, err := time.LoadLocation(tzId); err == nil {
+			location = loc
+		}
+	}
+	return time.ParseInLocation("20060102T150405", value, location)
+}
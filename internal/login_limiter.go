@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"TerminalBuddyServer/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// failures are forgotten when there was none for this long and the key is not locked
+	loginFailuresTTL = 24 * time.Hour
+	// stale keys are pruned when more keys than this are tracked
+	maxLoginFailureKeys = 10000
+)
+
+// LoginFailure counts failed credential checks of one username or one client IP
+type LoginFailure struct {
+	Key           string `json:"key" pg:",pk"` // user:<username>, totp:<username> or ip:<address>
+	Failures      int    `json:"failures" pg:",use_zero"`
+	LastFailureAt int64  `json:"last_failure_at" pg:",use_zero"`
+	LockedUntil   int64  `json:"locked_until" pg:",use_zero"`
+}
+
+// usernames are lower cased, they are the same user regardless of case
+func usernameLoginKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// second factor failures are counted apart, a right password must not reset them
+func totpLoginKey(username string) string {
+	return "totp:" + strings.ToLower(username)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginLimiter locks out usernames and client IPs after too many failed credential checks. Client IPs are empty,
+// and not limited, when the client is behind a trusted proxy which does not tell its address. Each failure after
+// the limit doubles the lockout, up to the max lockout. Failures are kept in memory, and also in the DB if the
+// limits say so, to survive restarts.
+type LoginLimiter struct {
+	limits   config.LoginLimits
+	db       BuddyDb // nil if failures are not persisted
+	mutex    sync.Mutex
+	failures map[string]*LoginFailure
+	now      func() time.Time
+}
+
+func NewLoginLimiter(limits config.LoginLimits, db BuddyDb) *LoginLimiter {
+	limiter := &LoginLimiter{
+		limits:   limits,
+		failures: make(map[string]*LoginFailure),
+		now:      time.Now,
+	}
+
+	if limits.Persist {
+		limiter.db = db
+		failures, err := db.GetLoginFailures()
+		if err != nil {
+			log.Errorf("failed to load login failures: %s", err)
+		}
+		for _, f := range failures {
+			limiter.failures[f.Key] = f
+		}
+	}
+
+	return limiter
+}
+
+// SetLimits changes the limits of the next failures, current lockouts stay. Persistence cannot be changed.
+func (l *LoginLimiter) SetLimits(limits config.LoginLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limits.Persist = l.limits.Persist
+	l.limits = limits
+}
+
+func (l *LoginLimiter) enabled() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limits.MaxFailures > 0
+}
+
+// Locked returns how long the username or the ip is still locked out, 0 if neither is
+func (l *LoginLimiter) Locked(username string, ip string) time.Duration {
+	if !l.enabled() {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now().Unix()
+	var lockedUntil int64
+	for _, key := range loginKeys(ip, usernameLoginKey(username), totpLoginKey(username)) {
+		if f, ok := l.failures[key]; ok && f.LockedUntil > lockedUntil {
+			lockedUntil = f.LockedUntil
+		}
+	}
+	if lockedUntil <= now {
+		return 0
+	}
+	return time.Duration(lockedUntil-now) * time.Second
+}
+
+// loginKeys are the username keys, and the ip key unless the ip is unknown (empty)
+func loginKeys(ip string, usernameKeys ...string) []string {
+	if len(ip) == 0 {
+		return usernameKeys
+	}
+	return append(usernameKeys, ipLoginKey(ip))
+}
+
+// Fail counts a failed credential check for both the username and the ip
+func (l *LoginLimiter) Fail(username string, ip string) {
+	l.fail(loginKeys(ip, usernameLoginKey(username))...)
+}
+
+// FailUnknownUser counts a login of a username which does not exist for the ip only, so requests with made up
+// usernames do not create failure keys
+func (l *LoginLimiter) FailUnknownUser(ip string) {
+	l.fail(loginKeys(ip)...)
+}
+
+// FailSecondFactor counts a wrong TOTP or recovery code for both the username and the ip
+func (l *LoginLimiter) FailSecondFactor(username string, ip string) {
+	l.fail(loginKeys(ip, totpLoginKey(username))...)
+}
+
+func (l *LoginLimiter) fail(keys ...string) {
+	if !l.enabled() {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.failures) > maxLoginFailureKeys {
+		l.prune()
+	}
+
+	now := l.now()
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok || now.Sub(time.Unix(f.LastFailureAt, 0)) > loginFailuresTTL {
+			f = &LoginFailure{Key: key}
+			l.failures[key] = f
+		}
+		f.Failures++
+		f.LastFailureAt = now.Unix()
+
+		if f.Failures >= l.limits.MaxFailures {
+			lockout := l.lockout(f.Failures)
+			f.LockedUntil = now.Add(lockout).Unix()
+			log.Warnf("audit: %s locked out for %s after %d failed logins", key, lockout, f.Failures)
+		}
+
+		l.persist(f)
+	}
+}
+
+// Succeed forgets the failures of the username, failures of the ip stay, they can be against other users
+func (l *LoginLimiter) Succeed(username string) {
+	l.succeed(usernameLoginKey(username))
+}
+
+// SucceedSecondFactor forgets the second factor failures of the username
+func (l *LoginLimiter) SucceedSecondFactor(username string) {
+	l.succeed(totpLoginKey(username))
+}
+
+func (l *LoginLimiter) succeed(key string) {
+	if !l.enabled() {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.failures[key]; ok {
+		l.remove(key)
+	}
+}
+
+// Unlock removes the lockout and failures of the username and/or the ip, returns false if neither was tracked
+func (l *LoginLimiter) Unlock(username string, ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var keys []string
+	if len(username) > 0 {
+		keys = append(keys, usernameLoginKey(username), totpLoginKey(username))
+	}
+	if len(ip) > 0 {
+		keys = append(keys, ipLoginKey(ip))
+	}
+
+	unlocked := false
+	for _, key := range keys {
+		if _, ok := l.failures[key]; ok {
+			l.remove(key)
+			unlocked = true
+			log.Warnf("audit: %s unlocked", key)
+		}
+	}
+	return unlocked
+}
+
+// lockout is the first lockout at the failures limit, doubled with each failure after it
+func (l *LoginLimiter) lockout(failures int) time.Duration {
+	first := time.Duration(l.limits.LockoutSeconds) * time.Second
+	max := time.Duration(l.limits.MaxLockoutSeconds) * time.Second
+
+	exponent := failures - l.limits.MaxFailures
+	if exponent > 30 {
+		exponent = 30
+	}
+	lockout := time.Duration(float64(first) * math.Pow(2, float64(exponent)))
+	if max > 0 && lockout > max {
+		lockout = max
+	}
+	return lockout
+}
+
+func (l *LoginLimiter) prune() {
+	now := l.now()
+	for key, f := range l.failures {
+		if f.LockedUntil < now.Unix() && now.Sub(time.Unix(f.LastFailureAt, 0)) > loginFailuresTTL {
+			l.remove(key)
+		}
+	}
+}
+
+func (l *LoginLimiter) remove(key string) {
+	delete(l.failures, key)
+	if l.db == nil {
+		return
+	}
+	if err := l.db.DeleteLoginFailure(key); err != nil {
+		log.Errorf("failed to delete login failures of %s: %s", key, err)
+	}
+}
+
+func (l *LoginLimiter) persist(f *LoginFailure) {
+	if l.db == nil {
+		return
+	}
+	if err := l.db.SaveLoginFailure(f); err != nil {
+		log.Errorf("failed to save login failures of %s: %s", f.Key, err)
+	}
+}
+
+// remoteIp is the address part of a host:port remote address
+func remoteIp(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return fmt.Sprintf("%d", int64(math.Ceil(retryAfter.Seconds())))
+}
@@ -1,30 +1,90 @@
 package internal
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
 // TODO: solve multi thread problems
 
 type MemDb struct {
-	users         map[int64]*User
-	reminder2user map[int64]int64
+	users          map[int64]*User
+	lastUserId     int64
+	reminder2user  map[int64]int64
+	lastReminderId int64
+	// inverted index: search token -> reminder id -> token occurrences
+	searchIndex map[string]map[int64]int
+
+	webhooks              map[int64]*Webhook
+	webhookDeliveries     map[int64]*WebhookDelivery
+	lastWebhookId         int64
+	lastWebhookDeliveryId int64
+
+	reminderDeliveries     map[int64][]*ReminderDelivery // reminder id -> deliveries
+	lastReminderDeliveryId int64
+
+	loginFailures map[string]*LoginFailure
+
+	deviceAuthorizations map[string]*DeviceAuthorization // device code hash -> authorization
+	deviceTokens         map[int64]*DeviceToken
+	lastDeviceTokenId    int64
+
+	teams            map[int64]*Team
+	lastTeamId       int64
+	teamMembers      map[int64]*TeamMember
+	lastTeamMemberId int64
+	teamReminders    map[int64]*Reminder          // reminder id -> team reminder, ids shared with user reminders
+	teamReminderAcks map[int64][]*TeamReminderAck // reminder id -> member acks
+
+	assignments      map[int64]*ReminderAssignment // reminder id -> assignment
+	lastAssignmentId int64
 }
 
 func (db *MemDb) DbOk() bool {
 	return true
 }
 
+func (db *MemDb) Ping(_ context.Context) error {
+	return nil
+}
+
 func (db *MemDb) Close() error {
 	return nil
 }
 
+// WithContext is the DB itself, memory DB has no queries to log
+func (db *MemDb) WithContext(_ context.Context) BuddyDb {
+	return db
+}
+
 func NewMemDb() *MemDb {
 	return &MemDb{
 		users:         make(map[int64]*User),
 		reminder2user: make(map[int64]int64),
+		searchIndex:   make(map[string]map[int64]int),
+
+		webhooks:          make(map[int64]*Webhook),
+		webhookDeliveries: make(map[int64]*WebhookDelivery),
+
+		reminderDeliveries: make(map[int64][]*ReminderDelivery),
+
+		loginFailures: make(map[string]*LoginFailure),
+
+		deviceAuthorizations: make(map[string]*DeviceAuthorization),
+		deviceTokens:         make(map[int64]*DeviceToken),
+
+		teams:            make(map[int64]*Team),
+		teamMembers:      make(map[int64]*TeamMember),
+		teamReminders:    make(map[int64]*Reminder),
+		teamReminderAcks: make(map[int64][]*TeamReminderAck),
+
+		assignments: make(map[int64]*ReminderAssignment),
 	}
 }
 
@@ -36,14 +96,178 @@ func (db *MemDb) AllUsers() []*User {
 	return allUsers
 }
 
+func (db *MemDb) SetUserDnd(userId int64, dnd bool) error {
+	user, ok := db.users[userId]
+	if !ok {
+		return errorUserNotFound
+	}
+	user.Dnd = dnd
+	return nil
+}
+
+func (db *MemDb) SetUserLastDigestAt(userId int64, at int64) error {
+	user, ok := db.users[userId]
+	if !ok {
+		return errorUserNotFound
+	}
+	user.LastDigestAt = at
+	return nil
+}
+
+func (db *MemDb) UseTotpStep(userId int64, step int64) (bool, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return false, errorUserNotFound
+	}
+	if user.TotpLastStep >= step {
+		return false, nil
+	}
+	user.TotpLastStep = step
+	return true, nil
+}
+
+func (db *MemDb) UseRecoveryCode(userId int64, codeHash string) (bool, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return false, errorUserNotFound
+	}
+	for i, h := range user.RecoveryCodes {
+		if h == codeHash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (db *MemDb) SaveUser(user *User) error {
+	for id, u := range db.users {
+		if id != user.Id && strings.EqualFold(u.Username, user.Username) {
+			return errorUsernameTaken
+		}
+	}
+	if user.Id == 0 {
+		db.lastUserId++
+		user.Id = db.lastUserId
+	}
 	db.users[user.Id] = user
 	return nil
 }
 
+func (db *MemDb) DeleteUser(userId int64) error {
+	user, ok := db.users[userId]
+	if !ok {
+		return errorUserNotFound
+	}
+
+	for _, reminder := range user.Reminders {
+		db.unindexReminder(reminder)
+		delete(db.reminder2user, reminder.Id)
+		delete(db.reminderDeliveries, reminder.Id)
+		delete(db.assignments, reminder.Id)
+	}
+	for reminderId, assignment := range db.assignments {
+		if assignment.AssigneeId == userId {
+			delete(db.assignments, reminderId)
+		}
+	}
+	for id, webhook := range db.webhooks {
+		if webhook.UserId == userId {
+			delete(db.webhooks, id)
+		}
+	}
+	for id, delivery := range db.webhookDeliveries {
+		if delivery.UserId == userId {
+			delete(db.webhookDeliveries, id)
+		}
+	}
+	if err := db.DeleteDeviceTokens(userId); err != nil {
+		return err
+	}
+	for id, member := range db.teamMembers {
+		if member.UserId == userId {
+			delete(db.teamMembers, id)
+		}
+	}
+	for reminderId, acks := range db.teamReminderAcks {
+		db.teamReminderAcks[reminderId] = removeUserAcks(acks, userId)
+	}
+	for reminderId, deliveries := range db.reminderDeliveries {
+		if _, ok := db.teamReminders[reminderId]; ok {
+			db.reminderDeliveries[reminderId] = removeUserDeliveries(deliveries, userId)
+		}
+	}
+	delete(db.users, userId)
+
+	return nil
+}
+
 func (db *MemDb) GetUser(username string) (*User, error) {
 	for id, _ := range db.users {
-		if db.users[id].Username == username {
+		if strings.EqualFold(db.users[id].Username, username) {
+			return db.users[id], nil
+		}
+	}
+	return nil, errorUserNotFound
+}
+
+func (db *MemDb) GetUserById(userId int64) (*User, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return nil, errorUserNotFound
+	}
+	return user, nil
+}
+
+func (db *MemDb) GetUsersPage(cursor int64, limit int) ([]*User, error) {
+	var users []*User
+	for id, u := range db.users {
+		if id > cursor {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (db *MemDb) CountUsersWithRole(role string) (int, error) {
+	count := 0
+	for _, u := range db.users {
+		if u.Role == role {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *MemDb) GetStats() (*DbStats, error) {
+	stats := &DbStats{
+		Users:    len(db.users),
+		Webhooks: len(db.webhooks),
+	}
+	for _, u := range db.users {
+		stats.Reminders += len(u.Reminders)
+		for _, r := range u.Reminders {
+			if !r.Ack {
+				stats.UnackedReminders++
+			}
+		}
+	}
+	stats.Reminders += len(db.teamReminders)
+	return stats, nil
+}
+
+func (db *MemDb) GetUserByFeedToken(feedToken string) (*User, error) {
+	if len(feedToken) == 0 {
+		return nil, errorUserNotFound
+	}
+	for id, _ := range db.users {
+		if db.users[id].FeedToken == feedToken {
 			return db.users[id], nil
 		}
 	}
@@ -83,37 +307,710 @@ func (db *MemDb) getReminder(userId, reminderId int64) (*Reminder, error) {
 		}
 	}
 
-	return nil, errors.New("not found")
+	return nil, errorReminderNotFound
+}
+
+func (db *MemDb) GetReminder(userId, reminderId int64) (*Reminder, error) {
+	return db.getReminder(userId, reminderId)
+}
+
+func (db *MemDb) GetRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return nil, errorUserNotFound
+	}
+
+	var page []*Reminder
+	for _, r := range user.Reminders {
+		if len(page) >= limit {
+			break
+		}
+		if r.Id > cursor {
+			page = append(page, r)
+		}
+	}
+
+	return page, nil
+}
+
+func (db *MemDb) RemindersCount(userId int64) (int, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return 0, errorUserNotFound
+	}
+	return len(user.Reminders), nil
+}
+
+// RemindersVersion hashes the reminders, they are in memory anyway
+func (db *MemDb) RemindersVersion(userId int64) (string, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return "", errorUserNotFound
+	}
+	hash := sha256.New()
+	for _, r := range user.Reminders {
+		fmt.Fprintf(hash, "%d\x00%s\x00%d\x00%q\x00%s\x00%s\x00%t\n", r.Id, r.Message, r.DueDate, r.Tags, r.Uid, r.Priority, r.Ack)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (db *MemDb) SaveReminder(reminder *Reminder) error {
-	foundReminder, err := db.getReminder(reminder.UserId, reminder.Id)
+	var foundReminder *Reminder
+	var err error
+	if reminder.TeamId != 0 {
+		foundReminder, err = db.GetTeamReminder(reminder.TeamId, reminder.Id)
+	} else {
+		foundReminder, err = db.getReminder(reminder.UserId, reminder.Id)
+	}
 	if err != nil {
 		return err
 	}
 
+	db.unindexReminder(foundReminder)
+
 	foundReminder.Ack = reminder.Ack
 	foundReminder.Message = reminder.Message
 	foundReminder.DueDate = reminder.DueDate
+	foundReminder.Tags = reminder.Tags
+	foundReminder.FallbackSent = reminder.FallbackSent
+	foundReminder.Priority = reminder.Priority
+
+	db.indexReminder(foundReminder)
 
 	return nil
 }
 
-func (db *MemDb) NewReminder(username string, message string, dueDate int64) error {
+func (db *MemDb) SetReminderFallbackSent(reminderId int64) error {
+	userId, ok := db.reminder2user[reminderId]
+	if !ok {
+		return errorReminderNotFound
+	}
+	reminder, err := db.getReminder(userId, reminderId)
+	if err != nil {
+		return err
+	}
+	reminder.FallbackSent = true
+	return nil
+}
+
+func (db *MemDb) NewReminder(username string, reminder *Reminder) error {
 	user, err := db.GetUser(username)
 	if err != nil {
 		return err
 	}
 
-	reminderId := time.Now().Unix()
+	reminder.UserId = user.Id
+
+	if len(reminder.Uid) > 0 {
+		for _, r := range user.Reminders {
+			if r.Uid == reminder.Uid {
+				reminder.Id = r.Id
+				return db.SaveReminder(reminder)
+			}
+		}
+	}
+
+	// ids are increasing, reminders pages rely on that
+	db.lastReminderId++
+	reminder.Id = db.lastReminderId
+
+	db.reminder2user[reminder.Id] = user.Id
+
+	user.Reminders = append(user.Reminders, reminder)
+	db.indexReminder(reminder)
+
+	return nil
+}
+
+func (db *MemDb) reminderTokens(reminder *Reminder) []string {
+	tokens := searchTokens(reminder.Message)
+	for _, t := range reminder.Tags {
+		tokens = append(tokens, searchTokens(t)...)
+	}
+	return tokens
+}
+
+func (db *MemDb) indexReminder(reminder *Reminder) {
+	for _, token := range db.reminderTokens(reminder) {
+		if _, ok := db.searchIndex[token]; !ok {
+			db.searchIndex[token] = make(map[int64]int)
+		}
+		db.searchIndex[token][reminder.Id]++
+	}
+}
+
+func (db *MemDb) unindexReminder(reminder *Reminder) {
+	for _, token := range db.reminderTokens(reminder) {
+		delete(db.searchIndex[token], reminder.Id)
+		if len(db.searchIndex[token]) == 0 {
+			delete(db.searchIndex, token)
+		}
+	}
+}
+
+func (db *MemDb) SearchReminders(userId int64, query ReminderSearchQuery) ([]*ReminderSearchResult, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return nil, errorUserNotFound
+	}
+
+	// without text, every user reminder is a candidate
+	var ranks map[int64]float64
+	if queryTokens := searchTokens(query.Text); len(queryTokens) > 0 {
+		ranks = make(map[int64]float64)
+		for i, token := range queryTokens {
+			matches := make(map[int64]float64)
+			for reminderId, occurrences := range db.searchIndex[token] {
+				if i == 0 {
+					matches[reminderId] = float64(occurrences)
+				} else if rank, ok := ranks[reminderId]; ok {
+					matches[reminderId] = rank + float64(occurrences)
+				}
+			}
+			// all query tokens have to match
+			ranks = matches
+		}
+	}
+
+	var results []*ReminderSearchResult
+	for _, r := range user.Reminders {
+		rank := 0.0
+		if ranks != nil {
+			var ok bool
+			if rank, ok = ranks[r.Id]; !ok {
+				continue
+			}
+		}
+		if !query.inDueDateRange(r.DueDate) || !r.HasTags(query.Tags) {
+			continue
+		}
+		results = append(results, &ReminderSearchResult{
+			Reminder: r,
+			Rank:     rank,
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].DueDate < results[j].DueDate
+	})
+
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+
+	return results, nil
+}
+
+func (db *MemDb) SaveWebhook(webhook *Webhook) error {
+	if webhook.Id == 0 {
+		db.lastWebhookId++
+		webhook.Id = db.lastWebhookId
+	}
+	db.webhooks[webhook.Id] = webhook
+	return nil
+}
+
+func (db *MemDb) GetWebhook(userId, webhookId int64) (*Webhook, error) {
+	webhook, ok := db.webhooks[webhookId]
+	if !ok || webhook.UserId != userId {
+		return nil, errorWebhookNotFound
+	}
+	return webhook, nil
+}
+
+func (db *MemDb) GetWebhooks(userId int64) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	for _, webhook := range db.webhooks {
+		if webhook.UserId == userId {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].Id < webhooks[j].Id
+	})
+	return webhooks, nil
+}
+
+func (db *MemDb) DeleteWebhook(userId, webhookId int64) error {
+	if _, err := db.GetWebhook(userId, webhookId); err != nil {
+		return err
+	}
+	delete(db.webhooks, webhookId)
+	return nil
+}
+
+func (db *MemDb) SaveWebhookDelivery(delivery *WebhookDelivery) error {
+	if delivery.Id == 0 {
+		db.lastWebhookDeliveryId++
+		delivery.Id = db.lastWebhookDeliveryId
+	}
+	db.webhookDeliveries[delivery.Id] = delivery
+	return nil
+}
+
+func (db *MemDb) GetPendingWebhookDeliveries(before int64, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	for _, d := range db.webhookDeliveries {
+		if d.Status == WebhookDeliveryPending && d.NextAttemptAt <= before {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt < deliveries[j].NextAttemptAt
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (db *MemDb) GetWebhookDeliveries(webhookId int64, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	for _, d := range db.webhookDeliveries {
+		if d.WebhookId == webhookId {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id > deliveries[j].Id
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (db *MemDb) SaveReminderDelivery(delivery *ReminderDelivery) error {
+	if delivery.Id == 0 {
+		db.lastReminderDeliveryId++
+		delivery.Id = db.lastReminderDeliveryId
+		db.reminderDeliveries[delivery.ReminderId] = append(db.reminderDeliveries[delivery.ReminderId], delivery)
+		return nil
+	}
+
+	for i, d := range db.reminderDeliveries[delivery.ReminderId] {
+		if d.Id == delivery.Id {
+			db.reminderDeliveries[delivery.ReminderId][i] = delivery
+			return nil
+		}
+	}
+	return errors.New("reminder delivery not found")
+}
+
+func (db *MemDb) GetReminderDeliveries(reminderId int64) ([]*ReminderDelivery, error) {
+	return db.reminderDeliveries[reminderId], nil
+}
+
+func (db *MemDb) SaveLoginFailure(failure *LoginFailure) error {
+	db.loginFailures[failure.Key] = failure
+	return nil
+}
+
+func (db *MemDb) DeleteLoginFailure(key string) error {
+	delete(db.loginFailures, key)
+	return nil
+}
+
+func (db *MemDb) GetLoginFailures() ([]*LoginFailure, error) {
+	var failures []*LoginFailure
+	for _, f := range db.loginFailures {
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+func (db *MemDb) SaveDeviceAuthorization(authorization *DeviceAuthorization) error {
+	for hash, a := range db.deviceAuthorizations {
+		if hash != authorization.DeviceCodeHash && a.UserCode == authorization.UserCode {
+			return errors.New("user code not unique")
+		}
+	}
+	db.deviceAuthorizations[authorization.DeviceCodeHash] = authorization
+	return nil
+}
+
+func (db *MemDb) GetDeviceAuthorization(deviceCodeHash string) (*DeviceAuthorization, error) {
+	authorization, ok := db.deviceAuthorizations[deviceCodeHash]
+	if !ok {
+		return nil, errorDeviceAuthorizationNotFound
+	}
+	return authorization, nil
+}
+
+func (db *MemDb) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	for _, a := range db.deviceAuthorizations {
+		if a.UserCode == userCode {
+			return a, nil
+		}
+	}
+	return nil, errorDeviceAuthorizationNotFound
+}
+
+func (db *MemDb) DeleteDeviceAuthorization(deviceCodeHash string) error {
+	if _, ok := db.deviceAuthorizations[deviceCodeHash]; !ok {
+		return errorDeviceAuthorizationNotFound
+	}
+	delete(db.deviceAuthorizations, deviceCodeHash)
+	return nil
+}
+
+func (db *MemDb) DeleteExpiredDeviceAuthorizations(before int64) error {
+	for hash, a := range db.deviceAuthorizations {
+		if a.ExpiresAt < before {
+			delete(db.deviceAuthorizations, hash)
+		}
+	}
+	return nil
+}
+
+func (db *MemDb) SaveDeviceToken(token *DeviceToken) error {
+	if token.Id == 0 {
+		db.lastDeviceTokenId++
+		token.Id = db.lastDeviceTokenId
+	}
+	db.deviceTokens[token.Id] = token
+	return nil
+}
+
+func (db *MemDb) GetDeviceToken(tokenHash string) (*DeviceToken, error) {
+	for _, t := range db.deviceTokens {
+		if t.TokenHash == tokenHash {
+			return t, nil
+		}
+	}
+	return nil, errorDeviceTokenNotFound
+}
+
+func (db *MemDb) GetDeviceTokens(userId int64) ([]*DeviceToken, error) {
+	var tokens []*DeviceToken
+	for _, t := range db.deviceTokens {
+		if t.UserId == userId {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens, nil
+}
+
+func (db *MemDb) DeleteDeviceToken(userId, tokenId int64) error {
+	token, ok := db.deviceTokens[tokenId]
+	if !ok || token.UserId != userId {
+		return errorDeviceTokenNotFound
+	}
+	delete(db.deviceTokens, tokenId)
+	return nil
+}
+
+func (db *MemDb) DeleteDeviceTokens(userId int64) error {
+	for id, t := range db.deviceTokens {
+		if t.UserId == userId {
+			delete(db.deviceTokens, id)
+		}
+	}
+	return nil
+}
+
+func (db *MemDb) SaveTeam(team *Team) error {
+	for id, t := range db.teams {
+		if id != team.Id && strings.EqualFold(t.Name, team.Name) {
+			return errorTeamNameTaken
+		}
+	}
+	if team.Id == 0 {
+		db.lastTeamId++
+		team.Id = db.lastTeamId
+	}
+	db.teams[team.Id] = team
+	return nil
+}
+
+func (db *MemDb) GetTeam(name string) (*Team, error) {
+	for _, t := range db.teams {
+		if strings.EqualFold(t.Name, name) {
+			return t, nil
+		}
+	}
+	return nil, errorTeamNotFound
+}
+
+func (db *MemDb) DeleteTeam(teamId int64) error {
+	if _, ok := db.teams[teamId]; !ok {
+		return errorTeamNotFound
+	}
+	for id, reminder := range db.teamReminders {
+		if reminder.TeamId == teamId {
+			delete(db.teamReminders, id)
+			delete(db.teamReminderAcks, id)
+			delete(db.reminderDeliveries, id)
+		}
+	}
+	for id, member := range db.teamMembers {
+		if member.TeamId == teamId {
+			delete(db.teamMembers, id)
+		}
+	}
+	delete(db.teams, teamId)
+	return nil
+}
+
+func (db *MemDb) GetUserTeams(userId int64) ([]*UserTeam, error) {
+	var teams []*UserTeam
+	for _, member := range db.teamMembers {
+		if member.UserId == userId {
+			teams = append(teams, &UserTeam{Team: db.teams[member.TeamId], Role: member.Role, Invited: member.Invited})
+		}
+	}
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].Name < teams[j].Name
+	})
+	return teams, nil
+}
+
+func (db *MemDb) SaveTeamMember(member *TeamMember) error {
+	if existing, err := db.GetTeamMember(member.TeamId, member.UserId); err == nil {
+		existing.Role = member.Role
+		existing.Invited = member.Invited
+		existing.JoinedAt = member.JoinedAt
+		member.Id = existing.Id
+		return nil
+	}
+	db.lastTeamMemberId++
+	member.Id = db.lastTeamMemberId
+	db.teamMembers[member.Id] = member
+	return nil
+}
+
+func (db *MemDb) GetTeamMember(teamId, userId int64) (*TeamMember, error) {
+	for _, member := range db.teamMembers {
+		if member.TeamId == teamId && member.UserId == userId {
+			return member, nil
+		}
+	}
+	return nil, errorNotTeamMember
+}
+
+func (db *MemDb) GetTeamMembers(teamId int64) ([]*TeamMember, error) {
+	var members []*TeamMember
+	for _, member := range db.teamMembers {
+		if member.TeamId != teamId {
+			continue
+		}
+		if user, ok := db.users[member.UserId]; ok {
+			member.Username = user.Username
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members, nil
+}
+
+func (db *MemDb) DeleteTeamMember(teamId, userId int64) error {
+	member, err := db.GetTeamMember(teamId, userId)
+	if err != nil {
+		return err
+	}
+	delete(db.teamMembers, member.Id)
+	return nil
+}
+
+func (db *MemDb) NewTeamReminder(reminder *Reminder) error {
+	if _, ok := db.teams[reminder.TeamId]; !ok {
+		return errorTeamNotFound
+	}
+	db.lastReminderId++
+	reminder.Id = db.lastReminderId
+	db.teamReminders[reminder.Id] = reminder
+	return nil
+}
+
+func (db *MemDb) GetTeamReminder(teamId, reminderId int64) (*Reminder, error) {
+	reminder, ok := db.teamReminders[reminderId]
+	if !ok || reminder.TeamId != teamId {
+		return nil, errorReminderNotFound
+	}
+	return reminder, nil
+}
 
-	db.reminder2user[reminderId] = user.Id
+func (db *MemDb) GetTeamReminders(teamId int64) ([]*Reminder, error) {
+	var reminders []*Reminder
+	for _, reminder := range db.teamReminders {
+		if reminder.TeamId == teamId {
+			reminders = append(reminders, reminder)
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].Id < reminders[j].Id
+	})
+	return reminders, nil
+}
 
-	user.Reminders = append(user.Reminders, &Reminder{
-		Id:      reminderId,
-		Message: message,
-		DueDate: dueDate,
+func (db *MemDb) DeleteTeamReminder(teamId, reminderId int64) error {
+	if _, err := db.GetTeamReminder(teamId, reminderId); err != nil {
+		return err
+	}
+	delete(db.teamReminders, reminderId)
+	delete(db.teamReminderAcks, reminderId)
+	delete(db.reminderDeliveries, reminderId)
+	return nil
+}
+
+// GetMemberTeamReminders returns copies, the ack is the one of the user
+func (db *MemDb) GetMemberTeamReminders(userId int64) ([]*Reminder, error) {
+	var reminders []*Reminder
+	for _, reminder := range db.teamReminders {
+		if member, err := db.GetTeamMember(reminder.TeamId, userId); err != nil || member.Invited {
+			continue
+		}
+		memberReminder := *reminder
+		memberReminder.Team = db.teams[reminder.TeamId].Name
+		for _, ack := range db.teamReminderAcks[reminder.Id] {
+			if ack.UserId == userId {
+				memberReminder.Ack = true
+			}
+		}
+		reminders = append(reminders, &memberReminder)
+	}
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].Id < reminders[j].Id
+	})
+	return reminders, nil
+}
+
+func (db *MemDb) AckTeamReminder(reminderId, userId int64) error {
+	if _, ok := db.teamReminders[reminderId]; !ok {
+		return errorReminderNotFound
+	}
+	for _, ack := range db.teamReminderAcks[reminderId] {
+		if ack.UserId == userId {
+			return nil
+		}
+	}
+	db.teamReminderAcks[reminderId] = append(db.teamReminderAcks[reminderId], &TeamReminderAck{
+		ReminderId: reminderId,
+		UserId:     userId,
+		AckedAt:    time.Now().Unix(),
 	})
+	return nil
+}
+
+func (db *MemDb) GetTeamReminderAcks(reminderId int64) ([]*TeamReminderAck, error) {
+	return db.teamReminderAcks[reminderId], nil
+}
+
+func removeUserAcks(acks []*TeamReminderAck, userId int64) []*TeamReminderAck {
+	var kept []*TeamReminderAck
+	for _, ack := range acks {
+		if ack.UserId != userId {
+			kept = append(kept, ack)
+		}
+	}
+	return kept
+}
+
+func removeUserDeliveries(deliveries []*ReminderDelivery, userId int64) []*ReminderDelivery {
+	var kept []*ReminderDelivery
+	for _, delivery := range deliveries {
+		if delivery.UserId != userId {
+			kept = append(kept, delivery)
+		}
+	}
+	return kept
+}
 
+func (db *MemDb) SaveReminderAssignment(assignment *ReminderAssignment) error {
+	if assignment.Id == 0 {
+		if _, ok := db.assignments[assignment.ReminderId]; ok {
+			return errors.New("reminder assigned already")
+		}
+		db.lastAssignmentId++
+		assignment.Id = db.lastAssignmentId
+	}
+	db.assignments[assignment.ReminderId] = assignment
 	return nil
 }
+
+func (db *MemDb) GetReminderAssignment(reminderId int64) (*ReminderAssignment, error) {
+	assignment, ok := db.assignments[reminderId]
+	if !ok {
+		return nil, errorAssignmentNotFound
+	}
+	return assignment, nil
+}
+
+func (db *MemDb) GetReminderAssignments(userId int64) ([]*ReminderAssignment, error) {
+	var assignments []*ReminderAssignment
+	for reminderId, assignment := range db.assignments {
+		if db.reminder2user[reminderId] == userId {
+			assignments = append(assignments, assignment)
+		}
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].ReminderId < assignments[j].ReminderId
+	})
+	return assignments, nil
+}
+
+// withOrigin is a copy of the reminder with the origin of its assignment set, if it is assigned
+func (db *MemDb) withOrigin(reminder *Reminder) *Reminder {
+	assignment, ok := db.assignments[reminder.Id]
+	if !ok {
+		return reminder
+	}
+	withOrigin := *reminder
+	withOrigin.AssignedBy = db.users[reminder.UserId].Username
+	if assignee, ok := db.users[assignment.AssigneeId]; ok {
+		withOrigin.AssignedTo = assignee.Username
+	}
+	withOrigin.Assignment = assignment.Status
+	return &withOrigin
+}
+
+func (db *MemDb) GetAssignedReminders(userId int64) ([]*Reminder, error) {
+	var reminders []*Reminder
+	for reminderId, assignment := range db.assignments {
+		if assignment.AssigneeId != userId || !assignment.Active() {
+			continue
+		}
+		reminder, err := db.getReminder(db.reminder2user[reminderId], reminderId)
+		if err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, db.withOrigin(reminder))
+	}
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].Id < reminders[j].Id
+	})
+	return reminders, nil
+}
+
+func (db *MemDb) GetVisibleRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error) {
+	user, ok := db.users[userId]
+	if !ok {
+		return nil, errorUserNotFound
+	}
+	assigned, err := db.GetAssignedReminders(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var reminders []*Reminder
+	for _, r := range append(user.Reminders[:len(user.Reminders):len(user.Reminders)], assigned...) {
+		if r.Id > cursor {
+			reminders = append(reminders, db.withOrigin(r))
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].Id < reminders[j].Id
+	})
+	if len(reminders) > limit {
+		reminders = reminders[:limit]
+	}
+	return reminders, nil
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorAssignmentAnswered is returned when the assignee accepts or declines a reminder a second time
+var errorAssignmentAnswered = errors.New("assignment answered already")
+
+// AssignReminder gives the new reminder of the creator to the assignee, whose agent is asked to accept or decline it
+func (nm *NotificationManager) AssignReminder(creator *User, assignee *User, reminder *Reminder) error {
+	assignment := &ReminderAssignment{
+		ReminderId: reminder.Id,
+		AssigneeId: assignee.Id,
+		Status:     AssignmentPending,
+		AssignedAt: time.Now().Unix(),
+	}
+	if err := nm.db.SaveReminderAssignment(assignment); err != nil {
+		return err
+	}
+	log.Tracef("reminder %d of %s assigned to %s", reminder.Id, creator.Username, assignee.Username)
+
+	nm.pushAssignmentNotice(assignee, creator.Username, assignee.Username, reminder, AssignmentPending)
+	return nil
+}
+
+// RespondAssignment accepts or declines the reminder assigned to the user, used by all agent transports. The
+// creator is told, and gets declined reminders again.
+func (nm *NotificationManager) RespondAssignment(user *User, reminderId int64, accept bool) error {
+	assignment, err := nm.db.GetReminderAssignment(reminderId)
+	if err != nil {
+		return err
+	}
+	if assignment.AssigneeId != user.Id {
+		return errorAssignmentNotFound
+	}
+	if assignment.Status != AssignmentPending {
+		return errorAssignmentAnswered
+	}
+
+	reminder, err := nm.userReminder(user, reminderId)
+	if err != nil {
+		return err
+	}
+	creator, err := nm.db.GetUser(reminder.AssignedBy)
+	if err != nil {
+		return err
+	}
+
+	assignment.Status = AssignmentDeclined
+	if accept {
+		assignment.Status = AssignmentAccepted
+	}
+	assignment.RespondedAt = time.Now().Unix()
+	if err := nm.db.SaveReminderAssignment(assignment); err != nil {
+		return err
+	}
+	log.Tracef("reminder %d %s by %s", reminderId, assignment.Status, user.Username)
+
+	nm.pushAssignmentNotice(creator, creator.Username, user.Username, reminder, assignment.Status)
+	return nil
+}
+
+// assignedReminderAcked tells the creator the assignee acked the reminder, acking accepts a pending assignment
+func (nm *NotificationManager) assignedReminderAcked(user *User, reminder *Reminder) {
+	if reminder.AssignedTo != user.Username {
+		return
+	}
+
+	if reminder.Assignment == AssignmentPending {
+		assignment, err := nm.db.GetReminderAssignment(reminder.Id)
+		if err == nil {
+			assignment.Status = AssignmentAccepted
+			assignment.RespondedAt = time.Now().Unix()
+			err = nm.db.SaveReminderAssignment(assignment)
+		}
+		if err != nil {
+			log.Errorf("failed to accept assignment of acked reminder %d: %s", reminder.Id, err)
+		}
+	}
+
+	creator, err := nm.db.GetUser(reminder.AssignedBy)
+	if err != nil {
+		log.Errorf("failed to get creator %s of acked reminder %d: %s", reminder.AssignedBy, reminder.Id, err)
+		return
+	}
+	nm.pushAssignmentNotice(creator, creator.Username, user.Username, reminder, AssignmentAcked)
+}
+
+func (nm *NotificationManager) pushAssignmentNotice(to *User, assignedBy string, assignedTo string, reminder *Reminder, status string) {
+	notice := AssignmentMessage{Assignment: &AssignmentNotice{
+		ReminderId: reminder.Id,
+		Message:    reminder.Message,
+		DueDate:    reminder.DueDate,
+		AssignedBy: assignedBy,
+		AssignedTo: assignedTo,
+		Status:     status,
+	}}
+
+	err := nm.agentNotifier.Push(to, notice)
+	if err == errorNotifierUnavailable {
+		log.Tracef("no agent of user %s for %s notice of reminder %d", to.Username, status, reminder.Id)
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to push %s notice of reminder %d to user %s: %s", status, reminder.Id, to.Username, err)
+	}
+}
+
+// scannedReminders are the reminders the scan sends to the user: own reminders not assigned to others, reminders
+// of others assigned to the user, and team reminders, which fan out to every member with its own ack and deliveries
+func (nm *NotificationManager) scannedReminders(user *User) []*Reminder {
+	assignments, err := nm.db.GetReminderAssignments(user.Id)
+	if err != nil {
+		log.Errorf("failed to get reminder assignments of user %s: %s", user.Username, err)
+	}
+	assignedAway := make(map[int64]bool)
+	for _, assignment := range assignments {
+		if assignment.Active() {
+			assignedAway[assignment.ReminderId] = true
+		}
+	}
+
+	var reminders []*Reminder
+	for _, reminder := range user.Reminders {
+		if !assignedAway[reminder.Id] {
+			reminders = append(reminders, reminder)
+		}
+	}
+
+	assigned, err := nm.db.GetAssignedReminders(user.Id)
+	if err != nil {
+		log.Errorf("failed to get reminders assigned to user %s: %s", user.Username, err)
+	}
+	reminders = append(reminders, assigned...)
+
+	teamReminders, err := nm.db.GetMemberTeamReminders(user.Id)
+	if err != nil {
+		log.Errorf("failed to get team reminders of user %s: %s", user.Username, err)
+	}
+	return append(reminders, teamReminders...)
+}
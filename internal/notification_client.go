@@ -1,14 +1,77 @@
 package internal
 
-import "github.com/gorilla/websocket"
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TransportWebsocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "longpoll"
+	TransportEmail     = "email"
+)
+
+// used when agent does not name its device
+const defaultDevice = "default"
 
 type NotificationClient struct {
-	User *User
-	// one user can have only one device connected for now
-	WsConn *websocket.Conn
+	// identifies the connection in logs, websocket clients get it before the init message
+	ConnId string
+	User   *User
+	// each device of the user has one client
+	Device    string
+	Transport string
+	WsConn    *websocket.Conn // only set for websocket transport
+	// messages for the client, all transports send from here
+	Queue *DeliveryQueue
+	// unix nanos, the newer of two clients of the user on the same device and different server instances stays
+	ConnectedAt int64
+	// unix nanos, SSE and long poll clients are removed when they stop coming back
+	lastSeen int64
+}
+
+func NewNotificationClient(connId string, user *User, device string, transport string, wsConn *websocket.Conn) *NotificationClient {
+	if len(device) == 0 {
+		device = defaultDevice
+	}
+	return &NotificationClient{
+		ConnId:      connId,
+		User:        user,
+		Device:      device,
+		Transport:   transport,
+		WsConn:      wsConn,
+		Queue:       NewDeliveryQueue(),
+		ConnectedAt: time.Now().UnixNano(),
+		lastSeen:    time.Now().UnixNano(),
+	}
+}
+
+// Log is the log entry of the client, with its connection id
+func (nc *NotificationClient) Log() *log.Entry {
+	return log.WithFields(log.Fields{
+		"conn_id":   nc.ConnId,
+		"user":      nc.User.Username,
+		"device":    nc.Device,
+		"transport": nc.Transport,
+	})
+}
+
+func (nc *NotificationClient) Touch() {
+	atomic.StoreInt64(&nc.lastSeen, time.Now().UnixNano())
+}
+
+func (nc *NotificationClient) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&nc.lastSeen))
 }
 
 type InitWsConnectionData struct {
 	Username     string `json:"username"`
 	PasswordHash string `json:"password"`
+	Device       string `json:"device"` // optional device name, used in delivery history
+	// device token from the device authorization flow, used instead of username and password
+	Token string `json:"token"`
 }
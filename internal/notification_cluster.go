@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// instances repeat the connected messages of their clients this often
+	presenceRefreshInterval = 2 * time.Minute
+	// clients of other instances are forgotten if not repeated for this long, e.g. the instance died
+	remoteClientTTL = 3 * presenceRefreshInterval
+	// reminder ids per deliver message, to stay below the bus message size limit
+	maxForwardedReminders = 500
+)
+
+// remoteClient is the client of a user on one device, connected to another server instance
+type remoteClient struct {
+	instance    string
+	connectedAt int64
+	seenAt      time.Time
+}
+
+func (nm *NotificationManager) publish(message *BusMessage) error {
+	message.From = nm.cluster.InstanceId
+	return nm.cluster.Bus.Publish(message)
+}
+
+func (nm *NotificationManager) publishOrLog(message *BusMessage) {
+	if err := nm.publish(message); err != nil {
+		log.Errorf("failed to publish %s bus message for user %s: %s", message.Type, message.Username, err)
+	}
+}
+
+// announceClient tells other instances the client of the user is connected here, they close older clients of the
+// user on the same device, so each device of the user still has one client
+func (nm *NotificationManager) announceClient(nc *NotificationClient) {
+	nm.forgetRemoteClient(nc.User.Username, nc.Device, "")
+	nm.publishOrLog(connectedMessage(nc))
+}
+
+func connectedMessage(nc *NotificationClient) *BusMessage {
+	return &BusMessage{
+		Type:        busMessageConnected,
+		Username:    nc.User.Username,
+		Device:      nc.Device,
+		ConnectedAt: nc.ConnectedAt,
+	}
+}
+
+// messageDevice is the device of a connected or disconnected message, instances which do not send it have one
+// client per user
+func messageDevice(message *BusMessage) string {
+	if len(message.Device) == 0 {
+		return defaultDevice
+	}
+	return message.Device
+}
+
+// remoteInstances are the other instances clients of the user are connected to, leaving out the client on
+// exceptDevice if not empty
+func (nm *NotificationManager) remoteInstances(username string, exceptDevice string) []string {
+	nm.remoteMutex.RLock()
+	defer nm.remoteMutex.RUnlock()
+	seen := make(map[string]bool)
+	var instances []string
+	for device, rc := range nm.remoteClients[username] {
+		if device == exceptDevice || seen[rc.instance] || time.Since(rc.seenAt) > remoteClientTTL {
+			continue
+		}
+		seen[rc.instance] = true
+		instances = append(instances, rc.instance)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// forgetRemoteClient forgets the remote client of the user on the device, or all remote clients of the user if the
+// device is empty. Only clients on the instance are forgotten if it is not empty.
+func (nm *NotificationManager) forgetRemoteClient(username string, device string, instance string) {
+	nm.remoteMutex.Lock()
+	defer nm.remoteMutex.Unlock()
+	devices := nm.remoteClients[username]
+	for d, rc := range devices {
+		if (len(device) == 0 || d == device) && (len(instance) == 0 || rc.instance == instance) {
+			delete(devices, d)
+		}
+	}
+	if len(devices) == 0 {
+		delete(nm.remoteClients, username)
+	}
+}
+
+// forwardReminders asks the instance to deliver the reminders to the clients of the user
+func (nm *NotificationManager) forwardReminders(instance string, user *User, reminders []*Reminder) error {
+	var ids []int64
+	for _, reminder := range reminders {
+		ids = append(ids, reminder.Id)
+	}
+	for start := 0; start < len(ids); start += maxForwardedReminders {
+		end := start + maxForwardedReminders
+		if end > len(ids) {
+			end = len(ids)
+		}
+		message := &BusMessage{Type: busMessageDeliver, To: instance, Username: user.Username, ReminderIds: ids[start:end]}
+		if err := nm.publish(message); err != nil {
+			return err
+		}
+	}
+	log.Tracef("forwarded %d reminders of user %s to instance %s", len(ids), user.Username, instance)
+	return nil
+}
+
+// forwardDigest asks the instance to send the digest of the user to its clients
+func (nm *NotificationManager) forwardDigest(instance string, user *User, at time.Time) error {
+	return nm.publish(&BusMessage{Type: busMessageDigest, To: instance, Username: user.Username, At: at.Unix()})
+}
+
+// forwardPush asks the instance to push the agent message to the clients of the user, except the one on the device
+func (nm *NotificationManager) forwardPush(instance string, username string, exceptDevice string, message []byte) error {
+	return nm.publish(&BusMessage{Type: busMessagePush, To: instance, Username: username, Device: exceptDevice, Payload: message})
+}
+
+// WatchBus handles the messages of other instances, and repeats the connected messages of the local clients
+func (nm *NotificationManager) WatchBus() {
+	nm.publishOrLog(&BusMessage{Type: busMessageSync})
+
+	refresh := time.NewTicker(presenceRefreshInterval)
+	defer refresh.Stop()
+	for {
+		select {
+		case message, ok := <-nm.cluster.Bus.Messages():
+			if !ok {
+				log.Warn("stopped watching the bus")
+				return
+			}
+			if message.From == nm.cluster.InstanceId || (len(message.To) > 0 && message.To != nm.cluster.InstanceId) {
+				continue
+			}
+			nm.handleBusMessage(message)
+		case <-refresh.C:
+			nm.announceLocalClients()
+		}
+	}
+}
+
+func (nm *NotificationManager) announceLocalClients() {
+	for _, nc := range nm.clients() {
+		nm.publishOrLog(connectedMessage(nc))
+	}
+}
+
+func (nm *NotificationManager) handleBusMessage(message *BusMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("handling %s bus message recovered from panic: %s", message.Type, r)
+		}
+	}()
+
+	switch message.Type {
+	case busMessageConnected:
+		nm.remoteClientConnected(message)
+	case busMessageDisconnected:
+		nm.forgetRemoteClient(message.Username, messageDevice(message), message.From)
+	case busMessageSync:
+		nm.announceLocalClients()
+	case busMessageDisconnect:
+		nm.forgetRemoteClient(message.Username, message.Device, "")
+		nm.disconnectLocal(message.Username, message.Device)
+	case busMessageDeliver:
+		nm.deliverForwarded(message)
+	case busMessageDigest:
+		nm.sendForwardedDigest(message)
+	case busMessagePush:
+		nm.pushForwarded(message)
+	default:
+		log.Warnf("unknown bus message %s from instance %s", message.Type, message.From)
+	}
+}
+
+// remoteClientConnected keeps the newer client of the user on the device, the local client on the device is closed
+// if the remote one is newer
+func (nm *NotificationManager) remoteClientConnected(message *BusMessage) {
+	device := messageDevice(message)
+	if nc, ok := nm.GetClient(message.Username, device); ok {
+		if nc.ConnectedAt >= message.ConnectedAt {
+			return
+		}
+		nc.Log().Debugf("client replaced by client on instance %s", message.From)
+		nm.RemoveNotificationClient(nc)
+	}
+
+	nm.remoteMutex.Lock()
+	defer nm.remoteMutex.Unlock()
+	devices, ok := nm.remoteClients[message.Username]
+	if !ok {
+		devices = make(map[string]*remoteClient)
+		nm.remoteClients[message.Username] = devices
+	}
+	if rc, ok := devices[device]; ok && rc.instance != message.From && rc.connectedAt > message.ConnectedAt {
+		return
+	}
+	devices[device] = &remoteClient{
+		instance:    message.From,
+		connectedAt: message.ConnectedAt,
+		seenAt:      time.Now(),
+	}
+}
+
+// deliverForwarded delivers reminders the leader forwarded to the local clients of the user. If the clients are gone
+// meanwhile, the reminders are redelivered with a later scan.
+func (nm *NotificationManager) deliverForwarded(message *BusMessage) {
+	clients := nm.userClients(message.Username)
+	if len(clients) == 0 {
+		log.Debugf("clients of user %s gone, %d forwarded reminders not delivered", message.Username, len(message.ReminderIds))
+		return
+	}
+
+	user, err := nm.db.GetUser(message.Username)
+	if err != nil {
+		log.Errorf("failed to get user %s of forwarded reminders: %s", message.Username, err)
+		return
+	}
+
+	var reminders []*Reminder
+	for _, id := range message.ReminderIds {
+		reminder, err := nm.userReminder(user, id)
+		if err != nil {
+			log.Errorf("failed to get forwarded reminder %d of user %s: %s", id, message.Username, err)
+			continue
+		}
+		reminders = append(reminders, reminder)
+	}
+
+	for _, nc := range clients {
+		var err error
+		if len(reminders) == 1 {
+			err = nm.agentNotifier.notifyClient(nc, user, reminders[0])
+		} else if len(reminders) > 1 {
+			err = nm.agentNotifier.notifyClientBatch(nc, user, reminders)
+		}
+		if err != nil {
+			nc.Log().Errorf("forwarded notification failed: %s", err)
+		}
+	}
+}
+
+func (nm *NotificationManager) sendForwardedDigest(message *BusMessage) {
+	clients := nm.userClients(message.Username)
+	if len(clients) == 0 {
+		log.Debugf("clients of user %s gone, forwarded digest not sent", message.Username)
+		return
+	}
+
+	user, err := nm.db.GetUser(message.Username)
+	if err != nil {
+		log.Errorf("failed to get user %s of forwarded digest: %s", message.Username, err)
+		return
+	}
+	reminders, err := allUserReminders(nm.db, user.Id)
+	if err != nil {
+		log.Errorf("failed to get reminders of user %s for forwarded digest: %s", message.Username, err)
+		return
+	}
+	digest := BuildDigest(user, reminders, time.Unix(message.At, 0))
+	for _, nc := range clients {
+		if err := nm.agentNotifier.notifyClientDigest(nc, digest); err != nil {
+			nc.Log().Errorf("forwarded digest failed: %s", err)
+		}
+	}
+}
+
+func (nm *NotificationManager) pushForwarded(message *BusMessage) {
+	clients := nm.userClients(message.Username)
+	if len(clients) == 0 {
+		log.Debugf("clients of user %s gone, forwarded message not pushed", message.Username)
+		return
+	}
+	for _, nc := range clients {
+		if len(message.Device) > 0 && nc.Device == message.Device {
+			continue
+		}
+		if err := nc.Queue.Push(message.Payload); err != nil {
+			nc.Log().Errorf("forwarded message push failed: %s", err)
+		}
+	}
+}
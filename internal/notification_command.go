@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errorCommandMissing  = errors.New("command missing")
+	errorCommandDuration = errors.New("command duration invalid")
+)
+
+// CommandStarted keeps the start of the command, used when the agent reports it finished without its duration
+func (nm *NotificationManager) CommandStarted(user *User, device string, event *CommandEvent) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+	nm.commands.start(user.Username, device, event.key(), time.Now())
+	log.Tracef("command of user %s started on %s", user.Username, device)
+	return nil
+}
+
+// CommandFinished relays the command to the other device of the user and to the webhooks, if it ran for at least
+// the command notify interval. Used by all agent transports.
+func (nm *NotificationManager) CommandFinished(user *User, device string, event *CommandEvent) error {
+	if err := event.validate(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	startedAt, started := nm.commands.finish(user.Username, device, event.key())
+	if event.DurationMs == 0 && started {
+		event.DurationMs = now.Sub(startedAt).Milliseconds()
+	}
+	event.Device = device
+	event.FinishedAt = now.Unix()
+
+	notifyAfter := nm.Intervals().CommandNotifyAfter
+	if notifyAfter <= 0 || event.Duration() < notifyAfter {
+		log.Tracef("command of user %s finished on %s in %s, not relayed", user.Username, device, event.Duration())
+		return nil
+	}
+
+	nm.webhookDispatcher.EnqueueCommand(user, WebhookEventCommandFinished, event)
+
+	err := nm.agentNotifier.PushOtherDevice(user, device, CommandMessage{Command: event})
+	if err == errorNotifierUnavailable {
+		log.Tracef("no other device of user %s for finished command", user.Username)
+		return nil
+	}
+	return err
+}
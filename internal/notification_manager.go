@@ -1,8 +1,12 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,156 +18,612 @@ const (
 	pongWait = 60 * time.Second
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+	// Used when agent snoozes a reminder without saying for how long.
+	defaultSnoozeMinutes = 10
+	// Reminders due longer ago than this do not get the fallback notification anymore.
+	maxFallbackAge = 24 * time.Hour
+	// SSE and long poll clients not coming back for this long are removed.
+	httpClientTTL = 2 * time.Minute
+	// Time allowed to write a message to the websocket peer.
+	wsWriteWait = 10 * time.Second
+	// Reminders of all users are scanned this often.
+	scanInterval = time.Minute
+	// Fallback (email) notifications are sent off the scan by this many workers, so a slow SMTP server does not
+	// hold up the reminders of all users.
+	fallbackWorkers = 4
+	// Fallback notifications not fitting in the queue are tried again with the next scan.
+	fallbackQueueSize = 1000
 )
 
+// errorTeamReminderSnooze is returned for snoozes of team reminders, the due date is the same for all members
+var errorTeamReminderSnooze = errors.New("team reminders cannot be snoozed")
+
 type Signal struct{}
 
 var EmptySignal = Signal{}
 
+// NotificationIntervals can be changed while the server runs, see Server.Reload
+type NotificationIntervals struct {
+	// fallback notifier is used if reminder is not acked this long after it is due
+	FallbackAfter time.Duration
+	// reminder is sent again if no agent confirms receiving it in this time
+	RedeliveryAfter time.Duration
+	// finished commands running at least this long are relayed to other devices and webhooks, 0 disables it
+	CommandNotifyAfter time.Duration
+}
+
 type NotificationManager struct {
 	db                  BuddyDb
+	loginLimiter        *LoginLimiter
+	webhookDispatcher   *WebhookDispatcher
+	cluster             *Cluster
+	agentNotifier       *AgentNotifier
+	notifiers           []Notifier // tried in order until one delivers the reminder
+	fallbackNotifier    Notifier   // used once if reminder is not acked in time, can be nil
+	fallbackJobs        chan func()
+	fallbackMutex       sync.Mutex
+	fallbackInFlight    map[int64]bool // reminders with a queued or running fallback notification
+	intervalsMutex      sync.RWMutex
+	intervals           NotificationIntervals
 	stopWorkChan        chan Signal
-	notificationClients map[string]*NotificationClient
-	pongWait            time.Duration // time allowed to read the next pong message from the client
+	clientsMutex        sync.RWMutex
+	notificationClients map[string]map[string]*NotificationClient // by username and device
+	pongWait            time.Duration                             // time allowed to read the next pong message from the client
+	// clients of users connected to other server instances, by username and device
+	remoteMutex   sync.RWMutex
+	remoteClients map[string]map[string]*remoteClient
+	// commands the agents of the users reported as started
+	commands *runningCommands
+	// unix nanos, for readiness checks
+	scanSince  int64
+	lastScanAt int64
 }
 
-func NewNotificationManager(db BuddyDb) *NotificationManager {
+func NewNotificationManager(db BuddyDb, loginLimiter *LoginLimiter, webhookDispatcher *WebhookDispatcher, fallbackNotifier Notifier, intervals NotificationIntervals, cluster *Cluster) *NotificationManager {
 	nm := &NotificationManager{
 		db:                  db,
+		loginLimiter:        loginLimiter,
+		webhookDispatcher:   webhookDispatcher,
+		cluster:             cluster,
+		fallbackNotifier:    fallbackNotifier,
+		intervals:           intervals,
 		stopWorkChan:        make(chan Signal, 1),
-		notificationClients: make(map[string]*NotificationClient), // username <-> conn
+		notificationClients: make(map[string]map[string]*NotificationClient),
 		pongWait:            60 * time.Second,
+		remoteClients:       make(map[string]map[string]*remoteClient),
+		commands:            newRunningCommands(),
+	}
+	nm.agentNotifier = NewAgentNotifier(nm)
+	nm.notifiers = []Notifier{nm.agentNotifier}
+
+	if fallbackNotifier != nil {
+		nm.fallbackJobs = make(chan func(), fallbackQueueSize)
+		nm.fallbackInFlight = make(map[int64]bool)
+		for i := 0; i < fallbackWorkers; i++ {
+			go nm.runFallbackJobs()
+		}
 	}
 
 	go nm.ScanDeadWsConnections()
+	go nm.WatchBus()
 
 	return nm
 }
 
-func (nm *NotificationManager) NewClient(connClient *websocket.Conn) {
-	log.Debugf("notification manager got new client, total before: %d", len(nm.notificationClients))
+func (nm *NotificationManager) Intervals() NotificationIntervals {
+	nm.intervalsMutex.RLock()
+	defer nm.intervalsMutex.RUnlock()
+	return nm.intervals
+}
+
+// SetIntervals takes effect with the next reminders scan
+func (nm *NotificationManager) SetIntervals(intervals NotificationIntervals) {
+	nm.intervalsMutex.Lock()
+	defer nm.intervalsMutex.Unlock()
+	nm.intervals = intervals
+}
+
+// RegisterClient adds the client, replacing (and closing) the previous client of the user on the same device. The
+// clients of the user on other devices stay.
+func (nm *NotificationManager) RegisterClient(nc *NotificationClient) {
+	nm.clientsMutex.Lock()
+	devices, ok := nm.notificationClients[nc.User.Username]
+	if !ok {
+		devices = make(map[string]*NotificationClient)
+		nm.notificationClients[nc.User.Username] = devices
+	}
+	previous, ok := devices[nc.Device]
+	devices[nc.Device] = nc
+	nm.clientsMutex.Unlock()
+
+	if ok && previous != nc {
+		previous.Log().Debugf("client replaced by %s client %s", nc.Transport, nc.ConnId)
+		nm.closeClient(previous)
+	}
+
+	nm.announceClient(nc)
+}
+
+// AttachClient returns the current client of the user on the device if it uses the same transport, so SSE and long
+// poll clients keep their queue between requests. Otherwise a new client is registered.
+func (nm *NotificationManager) AttachClient(user *User, device string, transport string) *NotificationClient {
+	if len(device) == 0 {
+		device = defaultDevice
+	}
+	if nc, ok := nm.GetClient(user.Username, device); ok && nc.Transport == transport {
+		nc.Touch()
+		return nc
+	}
+	nc := NewNotificationClient(newLogId(), user, device, transport, nil)
+	nm.RegisterClient(nc)
+	nc.Log().Debugf("%s client attached", transport)
+	return nc
+}
+
+// GetClient returns the local client of the user on the device
+func (nm *NotificationManager) GetClient(username string, device string) (*NotificationClient, bool) {
+	nm.clientsMutex.RLock()
+	defer nm.clientsMutex.RUnlock()
+	nc, ok := nm.notificationClients[username][device]
+	return nc, ok
+}
+
+// userClients are the local clients of the user, one per device
+func (nm *NotificationManager) userClients(username string) []*NotificationClient {
+	nm.clientsMutex.RLock()
+	defer nm.clientsMutex.RUnlock()
+	var clients []*NotificationClient
+	for _, nc := range nm.notificationClients[username] {
+		clients = append(clients, nc)
+	}
+	return clients
+}
+
+func (nm *NotificationManager) clients() []*NotificationClient {
+	nm.clientsMutex.RLock()
+	defer nm.clientsMutex.RUnlock()
+	var clients []*NotificationClient
+	for _, devices := range nm.notificationClients {
+		for _, nc := range devices {
+			clients = append(clients, nc)
+		}
+	}
+	return clients
+}
+
+func (nm *NotificationManager) ClientsCount() int {
+	nm.clientsMutex.RLock()
+	defer nm.clientsMutex.RUnlock()
+	count := 0
+	for _, devices := range nm.notificationClients {
+		count += len(devices)
+	}
+	return count
+}
+
+// NewClient authorizes and registers the websocket client, ctx is the one of the upgraded request
+func (nm *NotificationManager) NewClient(ctx context.Context, connClient *websocket.Conn) {
+	connId := newLogId()
+	address := contextClientAddress(ctx)
+	connLog := contextLog(ctx).WithFields(log.Fields{"conn_id": connId, "ip": address.ip})
+	connLog.Debugf("notification manager got new client, total before: %d", nm.ClientsCount())
 
-	// client has to first send its init message (username, password), then we add the connection
+	// client has to first send its init message (username and password, or device token), then we add the connection
 	initData := &InitWsConnectionData{}
 	_, initMessage, err := connClient.ReadMessage()
 	if err != nil {
-		log.Errorf("notification manager read init message error: %s", err.Error())
+		connLog.Errorf("notification manager read init message error: %s", err.Error())
 		connClient.Close()
 		return
 	}
 
 	err = json.Unmarshal(initMessage, initData)
 	if err != nil {
-		log.Errorf("failed to read init data for %s", connClient.RemoteAddr())
+		connLog.Errorf("failed to read init data for %s", connClient.RemoteAddr())
 		if err := connClient.WriteMessage(websocket.TextMessage, []byte("corrupt init data")); err != nil {
-			log.Errorf("ws corrupt init file, failed to send error response to client %s: %s", initData.Username, err.Error())
+			connLog.Errorf("ws corrupt init file, failed to send error response to client %s: %s", initData.Username, err.Error())
 		}
 		connClient.Close()
 		return
 	}
 
-	user, err := nm.db.GetUser(initData.Username)
-	if err != nil {
-		log.Errorf("ws conn failed, cannot find user %s", initData.Username)
-		if err := connClient.WriteMessage(websocket.TextMessage, []byte("wrong user data")); err != nil {
-			log.Errorf("ws cannot fund user, failed to send error response to client %s: %s", initData.Username, err.Error())
-		}
-		connClient.Close()
-		return
+	var user *User
+	device := initData.Device
+	authorized := false
+	if len(initData.Token) > 0 {
+		user, device, authorized = nm.deviceTokenUser(connLog, connClient, initData.Token, address.ip)
+	} else {
+		user, authorized = nm.credentialsUser(connLog, connClient, initData, address)
 	}
-
-	if user.PasswordHash != initData.PasswordHash {
-		log.Errorf("ws conn failed, wrong credentials for %s", initData.Username)
-		if err := connClient.WriteMessage(websocket.TextMessage, []byte("wrong user data")); err != nil {
-			log.Errorf("ws wrong credentials, failed to send error response to client %s: %s", initData.Username, err.Error())
-		}
+	if !authorized {
 		connClient.Close()
 		return
 	}
 
-	nc := &NotificationClient{
-		User:   user,
-		WsConn: connClient,
-	}
-
-	nm.notificationClients[user.Username] = nc
+	nc := NewNotificationClient(connId, user, device, TransportWebsocket, connClient)
+	nm.RegisterClient(nc)
+	nc.Log().WithField("request_id", requestIdFromContext(ctx)).Debug("websocket client connected")
 
 	connClient.SetPongHandler(func(string) error {
 		//log.Tracef("sending pong to %s", connClient.RemoteAddr())
 		if err := connClient.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-			log.Errorf("failed to SetReadDeadline: %s", err.Error())
+			nc.Log().Errorf("failed to SetReadDeadline: %s", err.Error())
 		}
 		return nil
 	})
 
 	connClient.SetPingHandler(func(appData string) error {
-		log.Tracef("received ping: %s", appData)
+		nc.Log().Tracef("received ping: %s", appData)
 		return nil
 	})
 
-	err = nc.WsConn.WriteMessage(websocket.TextMessage, []byte("hi from TB server ;)"))
-	if err != nil {
-		log.Errorf("failed to send init message to client %s: %s", connClient.RemoteAddr(), err.Error())
+	if err := nc.Queue.Push([]byte("hi from TB server ;)")); err != nil {
+		nc.Log().Errorf("failed to send init message to client %s: %s", connClient.RemoteAddr(), err.Error())
 	}
 
+	go nm.writeWsClient(nc)
 	go nm.WatchWsClient(nc)
 }
 
+// credentialsUser checks the username and password of the init message, it sends the error message to the client
+func (nm *NotificationManager) credentialsUser(connLog *log.Entry, connClient *websocket.Conn, initData *InitWsConnectionData, address clientAddress) (*User, bool) {
+	ip := address.limited()
+	if retryAfter := nm.loginLimiter.Locked(initData.Username, ip); retryAfter > 0 {
+		connLog.Warnf("audit: rejected locked out ws login of user [%s] from %s", initData.Username, address.ip)
+		lockedMessage := fmt.Sprintf("too many failed logins, try again in %ss", retryAfterSeconds(retryAfter))
+		if err := connClient.WriteMessage(websocket.TextMessage, []byte(lockedMessage)); err != nil {
+			connLog.Errorf("ws locked out, failed to send error response to client %s: %s", initData.Username, err.Error())
+		}
+		return nil, false
+	}
+
+	user, err := nm.db.GetUser(initData.Username)
+	if err != nil {
+		nm.loginLimiter.FailUnknownUser(ip)
+		connLog.Errorf("ws conn failed, cannot find user %s", initData.Username)
+		if err := connClient.WriteMessage(websocket.TextMessage, []byte("wrong user data")); err != nil {
+			connLog.Errorf("ws cannot fund user, failed to send error response to client %s: %s", initData.Username, err.Error())
+		}
+		return nil, false
+	}
+
+	if user.PasswordHash != initData.PasswordHash {
+		nm.loginLimiter.Fail(initData.Username, ip)
+		connLog.Errorf("ws conn failed, wrong credentials for %s", initData.Username)
+		if err := connClient.WriteMessage(websocket.TextMessage, []byte("wrong user data")); err != nil {
+			connLog.Errorf("ws wrong credentials, failed to send error response to client %s: %s", initData.Username, err.Error())
+		}
+		return nil, false
+	}
+
+	nm.loginLimiter.Succeed(user.Username)
+
+	if user.Disabled {
+		connLog.Warnf("audit: rejected ws login of disabled user [%s] from %s", user.Username, address.ip)
+		if err := connClient.WriteMessage(websocket.TextMessage, []byte("account disabled")); err != nil {
+			connLog.Errorf("ws account disabled, failed to send error response to client %s: %s", user.Username, err.Error())
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// deviceTokenUser checks the device token of the init message, it sends the error message to the client
+func (nm *NotificationManager) deviceTokenUser(connLog *log.Entry, connClient *websocket.Conn, token string, ip string) (*User, string, bool) {
+	deviceToken, err := nm.db.GetDeviceToken(secretHash(token))
+	var user *User
+	if err == nil {
+		user, err = nm.db.GetUserById(deviceToken.UserId)
+	}
+	if err == nil && user.Disabled {
+		err = errors.New("user disabled")
+	}
+	if err != nil {
+		connLog.Errorf("ws conn failed, device token from %s: %s", ip, err.Error())
+		if err := connClient.WriteMessage(websocket.TextMessage, []byte("wrong device token")); err != nil {
+			connLog.Errorf("ws wrong device token, failed to send error response to client %s: %s", ip, err.Error())
+		}
+		return nil, "", false
+	}
+
+	deviceToken.LastUsedAt = time.Now().Unix()
+	if err := nm.db.SaveDeviceToken(deviceToken); err != nil {
+		connLog.Errorf("failed to save device token %d use: %s", deviceToken.Id, err.Error())
+	}
+
+	return user, deviceToken.Device, true
+}
+
+// writeWsClient is the only writer of (non control) websocket messages of the client, it sends the client queue
+func (nm *NotificationManager) writeWsClient(nc *NotificationClient) {
+	for {
+		select {
+		case <-nc.Queue.Done():
+			return
+		case <-nc.Queue.Ready():
+			for _, message := range nc.Queue.Drain() {
+				if err := nc.WsConn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+					nc.Log().Errorf("failed to SetWriteDeadline: %s", err.Error())
+				}
+				if err := nc.WsConn.WriteMessage(websocket.TextMessage, message); err != nil {
+					nc.Log().Errorf("notification manager write error for client %s: %s", nc.WsConn.RemoteAddr(), err.Error())
+					nm.RemoveNotificationClient(nc)
+					return
+				}
+			}
+		}
+	}
+}
+
 func (nm *NotificationManager) WatchWsClient(nc *NotificationClient) {
 	for {
-		log.Tracef("waiting for messages from conn client: %s", nc.WsConn.RemoteAddr())
+		nc.Log().Tracef("waiting for messages from conn client: %s", nc.WsConn.RemoteAddr())
 		msgType, message, err := nc.WsConn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Tracef("client %s going away (probably)", nc.WsConn.RemoteAddr())
+				nc.Log().Tracef("client %s going away (probably)", nc.WsConn.RemoteAddr())
 			} else {
-				log.Errorf("notification manager read message error: %s", err.Error())
+				nc.Log().Errorf("notification manager read message error: %s", err.Error())
 			}
 			nm.RemoveNotificationClient(nc)
 			break
 		}
 
-		log.Printf("notification manager received [type %d]: %s", msgType, message)
+		nc.Log().Printf("notification manager received [type %d]: %s", msgType, message)
+		nc.Touch()
 
 		// try to read agentMessage
 		var agentMessage AgentMessage
 		err = json.Unmarshal(message, &agentMessage)
 		if err != nil {
-			log.Errorf("unmarshal agentMessage error, incoming message is not agentMessage")
+			nc.Log().Errorf("unmarshal agentMessage error, incoming message is not agentMessage")
 		} else {
-			if agentMessage.Message == "ack" {
-				if err := nm.db.AckReminder(agentMessage.ReminderId, true); err != nil {
-					log.Errorf("failed to ACK reminder %d: %s", agentMessage.ReminderId, err)
-				} else {
-					log.Tracef("reminder %d ACKd", agentMessage.ReminderId)
+			switch agentMessage.Message {
+			case "ack":
+				if err := nm.AckReminder(nc.User, agentMessage.ReminderId); err != nil {
+					nc.Log().Errorf("failed to ACK reminder %d: %s", agentMessage.ReminderId, err)
+				}
+			case "snooze":
+				if err := nm.SnoozeReminder(nc.User, agentMessage.ReminderId, agentMessage.SnoozeMinutes); err != nil {
+					nc.Log().Errorf("failed to snooze reminder %d: %s", agentMessage.ReminderId, err)
+				}
+			case "received":
+				if err := nm.ReceiptReminder(nc.User, nc.Device, agentMessage.ReminderId, agentMessage.DeliveryId); err != nil {
+					nc.Log().Errorf("failed to receipt reminder %d: %s", agentMessage.ReminderId, err)
+				}
+			case "accept", "decline":
+				if err := nm.RespondAssignment(nc.User, agentMessage.ReminderId, agentMessage.Message == "accept"); err != nil {
+					nc.Log().Errorf("failed to %s reminder %d: %s", agentMessage.Message, agentMessage.ReminderId, err)
+				}
+			case "dnd":
+				if err := nm.SetDnd(nc.User, agentMessage.Dnd); err != nil {
+					nc.Log().Errorf("failed to set do not disturb for %s: %s", nc.User.Username, err)
+				}
+			case "command_started":
+				if err := nm.CommandStarted(nc.User, nc.Device, agentMessage.commandEvent()); err != nil {
+					nc.Log().Errorf("failed to start command: %s", err)
+				}
+			case "command_finished":
+				if err := nm.CommandFinished(nc.User, nc.Device, agentMessage.commandEvent()); err != nil {
+					nc.Log().Errorf("failed to finish command: %s", err)
 				}
 			}
 			continue
 		}
 
 		echoedMessage := fmt.Sprintf("[WIP] echo: %s", message)
-		err = nc.WsConn.WriteMessage(msgType, []byte(echoedMessage))
-		if err != nil {
-			log.Printf("notification manager write error: %s", err.Error())
-			// TODO: maybe check error before killing WS connection
-			nm.RemoveNotificationClient(nc)
+		if err := nc.Queue.Push([]byte(echoedMessage)); err != nil {
+			nc.Log().Printf("notification manager echo error: %s", err.Error())
+		}
+	}
+}
+
+// userReminder is the reminder of the user, a reminder assigned to the user with its origin, or the reminder of a
+// team of the user with the ack of the user
+func (nm *NotificationManager) userReminder(user *User, reminderId int64) (*Reminder, error) {
+	reminder, err := nm.db.GetReminder(user.Id, reminderId)
+	if err != errorReminderNotFound {
+		return reminder, err
+	}
+
+	assigned, err := nm.db.GetAssignedReminders(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, assignedReminder := range assigned {
+		if assignedReminder.Id == reminderId {
+			return assignedReminder, nil
+		}
+	}
+
+	teamReminders, err := nm.db.GetMemberTeamReminders(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, teamReminder := range teamReminders {
+		if teamReminder.Id == reminderId {
+			return teamReminder, nil
+		}
+	}
+	return nil, errorReminderNotFound
+}
+
+// AckReminder marks the user reminder acknowledged, used by all agent transports. Team reminders are acked for the
+// user only, other members still get them.
+func (nm *NotificationManager) AckReminder(user *User, reminderId int64) error {
+	reminder, err := nm.userReminder(user, reminderId)
+	if err != nil {
+		return err
+	}
+
+	if reminder.TeamId != 0 {
+		err = nm.db.AckTeamReminder(reminderId, user.Id)
+	} else {
+		err = nm.db.AckReminder(reminderId, true)
+	}
+	if err != nil {
+		return err
+	}
+	log.Tracef("reminder %d ACKd by %s", reminderId, user.Username)
+
+	nm.assignedReminderAcked(user, reminder)
+
+	reminder.Ack = true
+	nm.webhookDispatcher.Enqueue(user, WebhookEventReminderAcked, reminder)
+
+	return nil
+}
+
+// ReceiptReminder marks the delivery as received by the device. Without delivery id, the latest delivery to the
+// device is marked. Received is not acked - the user still has to ack the reminder.
+func (nm *NotificationManager) ReceiptReminder(user *User, device string, reminderId int64, deliveryId int64) error {
+	if _, err := nm.userReminder(user, reminderId); err != nil {
+		return err
+	}
+
+	deliveries, err := nm.db.GetReminderDeliveries(reminderId)
+	if err != nil {
+		return err
+	}
+
+	var delivery *ReminderDelivery
+	for _, d := range deliveries {
+		// team reminders have deliveries to all members
+		if d.UserId != user.Id {
+			continue
+		}
+		if deliveryId > 0 && d.Id == deliveryId {
+			delivery = d
 			break
 		}
+		if deliveryId == 0 && d.Device == device && d.Transport != TransportEmail {
+			delivery = d
+		}
+	}
+	if delivery == nil {
+		return errorDeliveryNotFound
+	}
+
+	delivery.Result = DeliveryResultReceived
+	delivery.ReceivedAt = time.Now().Unix()
+	if err := nm.db.SaveReminderDelivery(delivery); err != nil {
+		return err
+	}
+	log.Tracef("reminder %d delivery %d received by %s", reminderId, delivery.Id, delivery.Device)
+
+	return nil
+}
+
+// SnoozeReminder moves the reminder due date to snoozeMinutes from now, so it gets sent again
+func (nm *NotificationManager) SnoozeReminder(user *User, reminderId int64, snoozeMinutes int) error {
+	reminder, err := nm.userReminder(user, reminderId)
+	if err != nil {
+		return err
+	}
+	if reminder.TeamId != 0 {
+		return errorTeamReminderSnooze
+	}
+
+	if snoozeMinutes <= 0 {
+		snoozeMinutes = defaultSnoozeMinutes
+	}
+
+	reminder.DueDate = time.Now().Add(time.Duration(snoozeMinutes) * time.Minute).Unix()
+	reminder.Ack = false
+	reminder.FallbackSent = false
+	if err := nm.db.SaveReminder(reminder); err != nil {
+		return err
 	}
+	log.Tracef("reminder %d snoozed for %d minutes", reminderId, snoozeMinutes)
+
+	nm.webhookDispatcher.Enqueue(user, WebhookEventReminderSnoozed, reminder)
+
+	return nil
 }
 
 func (nm *NotificationManager) RemoveNotificationClient(nc *NotificationClient) {
-	log.Warnf("removing notification client for user %s", nc.User.Username)
-	delete(nm.notificationClients, nc.User.Username)
+	nm.clientsMutex.Lock()
+	// the client could have been replaced by a newer one on the device meanwhile
+	devices := nm.notificationClients[nc.User.Username]
+	current, removed := devices[nc.Device]
+	removed = removed && current == nc
+	if removed {
+		nc.Log().Warnf("removing %s notification client for user %s", nc.Transport, nc.User.Username)
+		delete(devices, nc.Device)
+		if len(devices) == 0 {
+			delete(nm.notificationClients, nc.User.Username)
+		}
+	}
+	nm.clientsMutex.Unlock()
+
+	nm.closeClient(nc)
+	if removed {
+		nm.publishOrLog(&BusMessage{Type: busMessageDisconnected, Username: nc.User.Username, Device: nc.Device})
+	}
+}
+
+// DisconnectUser removes and closes all clients of the user, e.g. when the user credentials change, also on other
+// server instances
+func (nm *NotificationManager) DisconnectUser(username string) {
+	nm.DisconnectDevice(username, "")
 }
 
+// DisconnectDevice removes and closes the client of the user on the device, e.g. when its device token is revoked,
+// also on other server instances. An empty device disconnects all clients of the user.
+func (nm *NotificationManager) DisconnectDevice(username string, device string) {
+	nm.disconnectLocal(username, device)
+	nm.forgetRemoteClient(username, device, "")
+	nm.publishOrLog(&BusMessage{Type: busMessageDisconnect, Username: username, Device: device})
+}
+
+// disconnectLocal closes the local client of the user on the device, or all local clients of the user if the device
+// is empty
+func (nm *NotificationManager) disconnectLocal(username string, device string) {
+	var disconnected []*NotificationClient
+	nm.clientsMutex.Lock()
+	devices := nm.notificationClients[username]
+	for d, nc := range devices {
+		if len(device) == 0 || d == device {
+			disconnected = append(disconnected, nc)
+			delete(devices, d)
+		}
+	}
+	if len(devices) == 0 {
+		delete(nm.notificationClients, username)
+	}
+	nm.clientsMutex.Unlock()
+
+	for _, nc := range disconnected {
+		nc.Log().Debugf("disconnecting %s notification client of user %s", nc.Transport, username)
+		nm.closeClient(nc)
+	}
+}
+
+func (nm *NotificationManager) closeClient(nc *NotificationClient) {
+	nc.Queue.Close()
+	if nc.WsConn != nil {
+		if err := nc.WsConn.Close(); err != nil {
+			nc.Log().Tracef("closing ws conn of user %s: %s", nc.User.Username, err)
+		}
+	}
+}
+
+// Start scans reminders every scanInterval, if this instance is the leader
 func (nm *NotificationManager) Start() {
+	atomic.StoreInt64(&nm.scanSince, time.Now().UnixNano())
 	for {
 		select {
 		case <-nm.stopWorkChan:
 			log.Println("stopping reminders scan")
 			return
-		case <-time.After(time.Minute):
+		case <-time.After(scanInterval):
+			if !nm.cluster.Leader.Leader() {
+				// a new leader has scanInterval from now to finish its first scan
+				atomic.StoreInt64(&nm.scanSince, time.Now().UnixNano())
+				atomic.StoreInt64(&nm.lastScanAt, 0)
+				continue
+			}
 			allUsers := nm.db.AllUsers()
 			//log.Printf("will scan for reminder notifications for %d users ...", len(allUsers))
 			nm.ScanRemindersForUsers(allUsers)
@@ -187,11 +647,20 @@ func (nm *NotificationManager) ScanDeadWsConnections() {
 			//if len(nm.notificationClients) > 0 {
 			//	log.Tracef("scanning %d clients for dead ws connections ...", len(nm.notificationClients))
 			//}
-			for _, c := range nm.notificationClients {
-				if err := c.WsConn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					log.Errorf("failed to write ping message: %s", err.Error())
-					log.Warnf("closing client conn %s", c.WsConn.RemoteAddr())
-					nm.RemoveNotificationClient(c)
+			for _, c := range nm.clients() {
+				switch c.Transport {
+				case TransportWebsocket:
+					// control messages can be written concurrently with writeWsClient
+					if err := c.WsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+						c.Log().Errorf("failed to write ping message: %s", err.Error())
+						c.Log().Warnf("closing client conn %s", c.WsConn.RemoteAddr())
+						nm.RemoveNotificationClient(c)
+					}
+				case TransportSSE, TransportLongPoll:
+					if time.Since(c.LastSeen()) > httpClientTTL {
+						c.Log().Debugf("%s client not seen for %s", c.Transport, httpClientTTL)
+						nm.RemoveNotificationClient(c)
+					}
 				}
 			}
 		}
@@ -207,43 +676,266 @@ func (nm *NotificationManager) ScanRemindersForUsers(users []*User) {
 
 	now := time.Now().Truncate(time.Minute)
 	for _, user := range users {
+		if user.Disabled {
+			continue
+		}
 		nm.scanNotificationsForUser(now, user)
+		nm.sendDigestIfDue(now, user)
+	}
+
+	// not reached if the scan panics
+	atomic.StoreInt64(&nm.lastScanAt, time.Now().UnixNano())
+}
+
+// SchedulerState is the reminders scan state, for readiness checks
+type SchedulerState struct {
+	Running bool // the scan loop started
+	Leader  bool // this instance scans, others stand by
+	// when the loop started, or last stood by
+	Since time.Time
+	// last finished scan since then, zero if none
+	LastScanAt time.Time
+}
+
+func (nm *NotificationManager) SchedulerState() SchedulerState {
+	since := unixNanoTime(atomic.LoadInt64(&nm.scanSince))
+	return SchedulerState{
+		Running:    !since.IsZero(),
+		Leader:     nm.cluster.Leader.Leader(),
+		Since:      since,
+		LastScanAt: unixNanoTime(atomic.LoadInt64(&nm.lastScanAt)),
 	}
 }
 
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
 func (nm *NotificationManager) scanNotificationsForUser(now time.Time, user *User) {
 	//log.Tracef("scanning %d reminders for user: %s", len(user.Reminders), user.Username)
-	for _, reminder := range user.Reminders {
+
+	// in quiet time only high priority reminders are sent, the rest are held and go out
+	// together as one batch with the first scan after quiet time
+	quiet := user.InQuietTime(now)
+
+	var toSend []*Reminder
+	for _, reminder := range nm.scannedReminders(user) {
 		dueDate := time.Unix(reminder.DueDate, 0).Truncate(time.Minute)
+		held := quiet && !reminder.HighPriority()
 		if now.Equal(dueDate) {
-			nm.sendNotification(user, reminder)
-		} else if !reminder.Ack && now.After(dueDate) { // reminder was not set - agent was offline
-			nm.sendNotification(user, reminder)
+			if !held {
+				toSend = append(toSend, reminder)
+			}
+			// webhooks get the due event once, not with every resend below
+			nm.webhookDispatcher.Enqueue(user, WebhookEventReminderDue, reminder)
+		} else if !reminder.Ack && now.After(dueDate) && !held && nm.needsRedelivery(user, reminder) {
+			// agent was offline, did not confirm receiving the reminder, or it was held in quiet time
+			toSend = append(toSend, reminder)
 		}
+		if !held {
+			nm.sendFallbackNotification(now, dueDate, user, reminder)
+		}
+	}
+
+	if len(toSend) == 1 {
+		nm.sendNotification(user, toSend[0])
+	} else if len(toSend) > 1 {
+		nm.sendBatchNotification(user, toSend)
 	}
 }
 
 func (nm *NotificationManager) sendNotification(user *User, reminder *Reminder) {
 	log.Tracef("will try sending notification (%s) to user %s", reminder.Message, user.Username)
 
-	reminderMessage := ReminderMessage{
-		Id:      reminder.Id,
-		Message: reminder.Message,
+	for _, n := range nm.notifiers {
+		err := n.Notify(user, reminder)
+		if err == nil {
+			return
+		}
+		if err != errorNotifierUnavailable {
+			log.Errorf("%s notification for reminder %d failed: %s", n.Name(), reminder.Id, err.Error())
+		}
+	}
+}
+
+func (nm *NotificationManager) sendBatchNotification(user *User, reminders []*Reminder) {
+	log.Tracef("will try sending %d notifications in a batch to user %s", len(reminders), user.Username)
+
+	for _, n := range nm.notifiers {
+		err := n.NotifyBatch(user, reminders)
+		if err == nil {
+			return
+		}
+		if err != errorNotifierUnavailable {
+			log.Errorf("%s batch notification for user %s failed: %s", n.Name(), user.Username, err.Error())
+		}
+	}
+}
+
+// sendDigestIfDue sends the daily digest to the agent, and by email if the user has one, once a day
+func (nm *NotificationManager) sendDigestIfDue(now time.Time, user *User) {
+	if !user.digestDue(now) {
+		return
+	}
+
+	digest := BuildDigest(user, user.Reminders, now)
+
+	for _, n := range nm.notifiers {
+		nm.sendDigest(n, user, digest)
+	}
+	if nm.fallbackNotifier != nil {
+		if !nm.queueFallbackJob(func() { nm.sendDigest(nm.fallbackNotifier, user, digest) }) {
+			log.Warnf("fallback queue full, %s digest for user %s not sent", nm.fallbackNotifier.Name(), user.Username)
+		}
+	}
+
+	// not retried if all channels failed, the digest is still available on request. Only the digest time is
+	// written, the user was loaded at the start of the scan.
+	user.LastDigestAt = now.Unix()
+	if err := nm.db.SetUserLastDigestAt(user.Id, user.LastDigestAt); err != nil {
+		log.Errorf("failed to save user %s after digest: %s", user.Username, err.Error())
+	}
+}
+
+func (nm *NotificationManager) sendDigest(n Notifier, user *User, digest *Digest) {
+	err := n.NotifyDigest(user, digest)
+	if err != nil && err != errorNotifierUnavailable {
+		log.Errorf("%s digest for user %s failed: %s", n.Name(), user.Username, err.Error())
 	}
-	reminderMessageBytes, err := json.Marshal(reminderMessage)
+}
+
+// SetDnd turns do not disturb on or off for the user, used by all agent transports
+func (nm *NotificationManager) SetDnd(user *User, dnd bool) error {
+	// the user of a long lived client is stale, only the flag is written
+	if err := nm.db.SetUserDnd(user.Id, dnd); err != nil {
+		return err
+	}
+	user.Dnd = dnd
+	log.Tracef("user %s do not disturb: %t", user.Username, dnd)
+	return nil
+}
+
+// needsRedelivery is true if no agent of the user confirmed receiving the reminder since it became due,
+// and the last delivery attempt is older than the redelivery interval
+func (nm *NotificationManager) needsRedelivery(user *User, reminder *Reminder) bool {
+	deliveries, err := nm.db.GetReminderDeliveries(reminder.Id)
 	if err != nil {
-		log.Errorf("marshal reminder message failed for reminder: %s", reminder.Id)
+		log.Errorf("failed to get deliveries of reminder %d: %s", reminder.Id, err)
+		return true
+	}
+
+	// the scan sends the reminder in the minute it is due, which can be before the due date seconds
+	dueMinute := time.Unix(reminder.DueDate, 0).Truncate(time.Minute).Unix()
+	for _, d := range deliveries {
+		// deliveries from before a snooze do not count, nor emails which have no receipts, nor deliveries of team
+		// reminders to other members
+		if d.SentAt < dueMinute || d.Transport == TransportEmail || d.UserId != user.Id {
+			continue
+		}
+		if d.Result == DeliveryResultReceived {
+			return false
+		}
+		if d.Result == DeliveryResultSent && time.Since(time.Unix(d.SentAt, 0)) < nm.Intervals().RedeliveryAfter {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sendFallbackNotification notifies the user over the fallback channel once, if the reminder is still not acked.
+// Team reminders have no fallback, FallbackSent would be shared by all members.
+func (nm *NotificationManager) sendFallbackNotification(now, dueDate time.Time, user *User, reminder *Reminder) {
+	if nm.fallbackNotifier == nil || reminder.Ack || reminder.FallbackSent || reminder.TeamId != 0 {
+		return
+	}
+	if now.Before(dueDate.Add(nm.Intervals().FallbackAfter)) || now.After(dueDate.Add(maxFallbackAge)) {
 		return
 	}
 
-	nc, ok := nm.notificationClients[user.Username]
-	if !ok {
-		//log.Tracef("agent for user %s not connected, skip sending notification", user.Username)
+	// a reminder still being sent is not queued again by the next scan
+	nm.fallbackMutex.Lock()
+	if nm.fallbackInFlight[reminder.Id] {
+		nm.fallbackMutex.Unlock()
 		return
 	}
+	nm.fallbackInFlight[reminder.Id] = true
+	nm.fallbackMutex.Unlock()
+
+	queued := nm.queueFallbackJob(func() {
+		defer nm.fallbackDone(reminder.Id)
+		nm.notifyFallback(user, reminder)
+	})
+	if !queued {
+		nm.fallbackDone(reminder.Id)
+		log.Warnf("fallback queue full, reminder %d is tried again with the next scan", reminder.Id)
+	}
+}
+
+func (nm *NotificationManager) fallbackDone(reminderId int64) {
+	nm.fallbackMutex.Lock()
+	defer nm.fallbackMutex.Unlock()
+	delete(nm.fallbackInFlight, reminderId)
+}
+
+// queueFallbackJob is false if the queue is full, the scan does not wait for the workers
+func (nm *NotificationManager) queueFallbackJob(job func()) bool {
+	select {
+	case nm.fallbackJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (nm *NotificationManager) runFallbackJobs() {
+	for job := range nm.fallbackJobs {
+		nm.runFallbackJob(job)
+	}
+}
 
-	err = nc.WsConn.WriteMessage(websocket.TextMessage, reminderMessageBytes)
+func (nm *NotificationManager) runFallbackJob(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("fallback notification recovered from panic: %s", r)
+		}
+	}()
+	job()
+}
+
+// notifyFallback sends the fallback notification and stores its delivery, it runs on a fallback worker
+func (nm *NotificationManager) notifyFallback(user *User, reminder *Reminder) {
+	err := nm.fallbackNotifier.Notify(user, reminder)
+	if err == errorNotifierUnavailable {
+		return
+	}
+
+	delivery := &ReminderDelivery{
+		ReminderId: reminder.Id,
+		UserId:     user.Id,
+		Device:     nm.fallbackNotifier.Name(),
+		Transport:  nm.fallbackNotifier.Name(),
+		Result:     DeliveryResultSent,
+		SentAt:     time.Now().Unix(),
+	}
 	if err != nil {
-		log.Errorf("failed to send reminder message to client %s: %s", nc.WsConn.RemoteAddr(), err.Error())
+		delivery.Result = DeliveryResultFailed
+		delivery.Error = err.Error()
+	}
+	if err := nm.db.SaveReminderDelivery(delivery); err != nil {
+		log.Errorf("failed to store %s delivery of reminder %d: %s", delivery.Transport, reminder.Id, err)
+	}
+
+	if err != nil {
+		log.Errorf("%s fallback notification for reminder %d failed: %s", nm.fallbackNotifier.Name(), reminder.Id, err.Error())
+		return
+	}
+	log.Tracef("%s fallback notification sent for reminder %d", nm.fallbackNotifier.Name(), reminder.Id)
+
+	if err := nm.db.SetReminderFallbackSent(reminder.Id); err != nil {
+		log.Errorf("failed to save reminder %d after fallback notification: %s", reminder.Id, err.Error())
 	}
 }
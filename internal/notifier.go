@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"TerminalBuddyServer/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errorNotifierUnavailable is returned when the channel cannot reach the user at all, e.g. no agent connected
+var errorNotifierUnavailable = errors.New("notification channel not available for user")
+
+// Notifier delivers reminders to users over one channel
+type Notifier interface {
+	Name() string
+	Notify(user *User, reminder *Reminder) error
+	NotifyBatch(user *User, reminders []*Reminder) error
+	NotifyDigest(user *User, digest *Digest) error
+}
+
+// AgentNotifier sends reminders to the connected agents of the user, one per device, over whichever transport each
+// uses (websocket, SSE, long poll)
+type AgentNotifier struct {
+	nm *NotificationManager
+}
+
+func NewAgentNotifier(nm *NotificationManager) *AgentNotifier {
+	return &AgentNotifier{nm: nm}
+}
+
+func (n *AgentNotifier) Name() string {
+	return "agent"
+}
+
+func (n *AgentNotifier) Notify(user *User, reminder *Reminder) error {
+	return n.toAllClients(user, "", func(nc *NotificationClient) error {
+		return n.notifyClient(nc, user, reminder)
+	}, func(instance string) error {
+		return n.nm.forwardReminders(instance, user, []*Reminder{reminder})
+	})
+}
+
+func (n *AgentNotifier) notifyClient(nc *NotificationClient, user *User, reminder *Reminder) error {
+	delivery, reminderMessage, err := n.newDelivery(nc, user, reminder)
+	if err != nil {
+		return err
+	}
+
+	reminderMessageBytes, err := json.Marshal(reminderMessage)
+	if err == nil {
+		err = nc.Queue.Push(reminderMessageBytes)
+	}
+	if err != nil {
+		n.failDeliveries(err, delivery)
+		return fmt.Errorf("failed to queue reminder message for %s client: %w", nc.Transport, err)
+	}
+
+	return nil
+}
+
+// NotifyBatch sends the reminders in one message
+func (n *AgentNotifier) NotifyBatch(user *User, reminders []*Reminder) error {
+	return n.toAllClients(user, "", func(nc *NotificationClient) error {
+		return n.notifyClientBatch(nc, user, reminders)
+	}, func(instance string) error {
+		return n.nm.forwardReminders(instance, user, reminders)
+	})
+}
+
+func (n *AgentNotifier) notifyClientBatch(nc *NotificationClient, user *User, reminders []*Reminder) error {
+	var deliveries []*ReminderDelivery
+	batchMessage := ReminderBatchMessage{}
+	for _, reminder := range reminders {
+		delivery, reminderMessage, err := n.newDelivery(nc, user, reminder)
+		if err != nil {
+			n.failDeliveries(err, deliveries...)
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		batchMessage.Batch = append(batchMessage.Batch, reminderMessage)
+	}
+
+	batchMessageBytes, err := json.Marshal(batchMessage)
+	if err == nil {
+		err = nc.Queue.Push(batchMessageBytes)
+	}
+	if err != nil {
+		n.failDeliveries(err, deliveries...)
+		return fmt.Errorf("failed to queue batch message for %s client: %w", nc.Transport, err)
+	}
+
+	return nil
+}
+
+// NotifyDigest queues the daily digest, digests have no delivery receipts
+func (n *AgentNotifier) NotifyDigest(user *User, digest *Digest) error {
+	now := time.Now()
+	return n.toAllClients(user, "", func(nc *NotificationClient) error {
+		return n.notifyClientDigest(nc, digest)
+	}, func(instance string) error {
+		return n.nm.forwardDigest(instance, user, now)
+	})
+}
+
+func (n *AgentNotifier) notifyClientDigest(nc *NotificationClient, digest *Digest) error {
+	digestMessageBytes, err := json.Marshal(DigestMessage{Digest: digest})
+	if err != nil {
+		return err
+	}
+	if err := nc.Queue.Push(digestMessageBytes); err != nil {
+		return fmt.Errorf("failed to queue digest message for %s client: %w", nc.Transport, err)
+	}
+
+	return nil
+}
+
+// Push queues the informational message for all agents of the user, wherever they are connected. Such messages have
+// no deliveries and are not sent again, they are lost if no agent of the user is connected.
+func (n *AgentNotifier) Push(user *User, message interface{}) error {
+	return n.push(user, "", message)
+}
+
+// PushOtherDevice is Push, except for the agent of the user on the device
+func (n *AgentNotifier) PushOtherDevice(user *User, device string, message interface{}) error {
+	return n.push(user, device, message)
+}
+
+func (n *AgentNotifier) push(user *User, exceptDevice string, message interface{}) error {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return n.toAllClients(user, exceptDevice, func(nc *NotificationClient) error {
+		if err := nc.Queue.Push(messageBytes); err != nil {
+			return fmt.Errorf("failed to queue message for %s client: %w", nc.Transport, err)
+		}
+		return nil
+	}, func(instance string) error {
+		return n.nm.forwardPush(instance, user.Username, exceptDevice, messageBytes)
+	})
+}
+
+// toAllClients sends to each local client of the user, and forwards to each other instance clients of the user are
+// connected to, which store the deliveries of their clients. The client on exceptDevice is left out if not empty.
+// It fails only if no client was reached, errorNotifierUnavailable if there is none.
+func (n *AgentNotifier) toAllClients(user *User, exceptDevice string, send func(nc *NotificationClient) error, forward func(instance string) error) error {
+	reached := false
+	var firstErr error
+	for _, nc := range n.nm.userClients(user.Username) {
+		if len(exceptDevice) > 0 && nc.Device == exceptDevice {
+			continue
+		}
+		if err := send(nc); err != nil {
+			nc.Log().Errorf("agent notification failed: %s", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		reached = true
+	}
+	for _, instance := range n.nm.remoteInstances(user.Username, exceptDevice) {
+		if err := forward(instance); err != nil {
+			log.Errorf("forwarding to instance %s for user %s failed: %s", instance, user.Username, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		reached = true
+	}
+
+	if reached {
+		return nil
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return errorNotifierUnavailable
+}
+
+// newDelivery stores the delivery attempt first, its id goes to the client and comes back with the receipt
+func (n *AgentNotifier) newDelivery(nc *NotificationClient, user *User, reminder *Reminder) (*ReminderDelivery, ReminderMessage, error) {
+	delivery := &ReminderDelivery{
+		ReminderId: reminder.Id,
+		UserId:     user.Id,
+		Device:     nc.Device,
+		Transport:  nc.Transport,
+		Result:     DeliveryResultSent,
+		SentAt:     time.Now().Unix(),
+	}
+	if err := n.nm.db.SaveReminderDelivery(delivery); err != nil {
+		return nil, ReminderMessage{}, fmt.Errorf("failed to store delivery of reminder %d: %w", reminder.Id, err)
+	}
+
+	return delivery, ReminderMessage{
+		Id:         reminder.Id,
+		Message:    reminder.Message,
+		Priority:   reminder.Priority,
+		Team:       reminder.Team,
+		AssignedBy: reminder.AssignedBy,
+		DeliveryId: delivery.Id,
+	}, nil
+}
+
+func (n *AgentNotifier) failDeliveries(cause error, deliveries ...*ReminderDelivery) {
+	for _, delivery := range deliveries {
+		delivery.Result = DeliveryResultFailed
+		delivery.Error = cause.Error()
+		if err := n.nm.db.SaveReminderDelivery(delivery); err != nil {
+			log.Errorf("failed to store failed delivery %d: %s", delivery.Id, err)
+		}
+	}
+}
+
+const (
+	defaultEmailSubjectTemplate = `[terminal-buddy] {{.Message}}`
+	defaultEmailBodyTemplate    = `Hi {{.Username}},
+
+you asked to be reminded:
+
+    {{.Message}}
+
+Due: {{.DueDate}}
+
+--
+terminal buddy
+`
+)
+
+type emailTemplateData struct {
+	Username   string
+	Message    string
+	DueDate    string
+	ReminderId int64
+}
+
+// EmailNotifier sends reminders to the user email address over SMTP
+type EmailNotifier struct {
+	addr            string
+	from            string
+	auth            smtp.Auth
+	subjectTemplate *template.Template
+	bodyTemplate    *template.Template
+	sendMail        func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewEmailNotifier(smtpConfig config.SmtpConfig) (*EmailNotifier, error) {
+	subjectTemplateText := smtpConfig.SubjectTemplate
+	if len(subjectTemplateText) == 0 {
+		subjectTemplateText = defaultEmailSubjectTemplate
+	}
+	subjectTemplate, err := template.New("subject").Parse(subjectTemplateText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email subject template: %w", err)
+	}
+
+	bodyTemplateText := smtpConfig.BodyTemplate
+	if len(bodyTemplateText) == 0 {
+		bodyTemplateText = defaultEmailBodyTemplate
+	}
+	bodyTemplate, err := template.New("body").Parse(bodyTemplateText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email body template: %w", err)
+	}
+
+	n := &EmailNotifier{
+		addr:            fmt.Sprintf("%s:%d", smtpConfig.Host, smtpConfig.Port),
+		from:            smtpConfig.From,
+		subjectTemplate: subjectTemplate,
+		bodyTemplate:    bodyTemplate,
+		sendMail:        smtp.SendMail,
+	}
+	if len(smtpConfig.Username) > 0 {
+		n.auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, smtpConfig.Host)
+	}
+
+	return n, nil
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) Notify(user *User, reminder *Reminder) error {
+	if len(user.Email) == 0 {
+		return errorNotifierUnavailable
+	}
+
+	data := emailTemplateData{
+		Username:   user.Username,
+		Message:    reminder.Message,
+		DueDate:    time.Unix(reminder.DueDate, 0).UTC().Format(time.RFC1123),
+		ReminderId: reminder.Id,
+	}
+
+	var subject, body bytes.Buffer
+	if err := n.subjectTemplate.Execute(&subject, data); err != nil {
+		return fmt.Errorf("cannot render email subject: %w", err)
+	}
+	if err := n.bodyTemplate.Execute(&body, data); err != nil {
+		return fmt.Errorf("cannot render email body: %w", err)
+	}
+
+	return n.sendMail(n.addr, n.auth, n.from, []string{user.Email}, n.message(user.Email, subject.String(), body.String()))
+}
+
+// NotifyBatch sends one email per reminder
+func (n *EmailNotifier) NotifyBatch(user *User, reminders []*Reminder) error {
+	for _, reminder := range reminders {
+		if err := n.Notify(user, reminder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *EmailNotifier) NotifyDigest(user *User, digest *Digest) error {
+	if len(user.Email) == 0 {
+		return errorNotifierUnavailable
+	}
+
+	subject := fmt.Sprintf("[terminal-buddy] your reminders for %s", digest.Date)
+	body := fmt.Sprintf("Hi %s,\n\n%s\n--\nterminal buddy\n", user.Username, digest.Text(user.Location()))
+
+	return n.sendMail(n.addr, n.auth, n.from, []string{user.Email}, n.message(user.Email, subject, body))
+}
+
+func (n *EmailNotifier) message(to string, subject string, body string) []byte {
+	// header values must stay on one line
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + n.from + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes()
+}
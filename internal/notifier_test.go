@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"TerminalBuddyServer/config"
+)
+
+// fakeSmtpServer accepts mails without auth or TLS, and keeps them
+type fakeSmtpServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	mails    []fakeMail
+}
+
+type fakeMail struct {
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSmtpServer{listener: listener}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSmtpServer) config() config.SmtpConfig {
+	host, portStr, _ := net.SplitHostPort(s.listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return config.SmtpConfig{Host: host, Port: port, From: "buddy@example.com"}
+}
+
+func (s *fakeSmtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSmtpServer) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost fake ESMTP")
+	var mail fakeMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		upper := strings.ToUpper(cmd)
+		switch {
+		case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			mail = fakeMail{from: strings.Trim(cmd[len("MAIL FROM:"):], "<> ")}
+			reply("250 ok")
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			mail.to = append(mail.to, strings.Trim(cmd[len("RCPT TO:"):], "<> "))
+			reply("250 ok")
+		case upper == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			mail.data = data.String()
+			s.mutex.Lock()
+			s.mails = append(s.mails, mail)
+			s.mutex.Unlock()
+			reply("250 queued")
+		case upper == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSmtpServer) received() []fakeMail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]fakeMail(nil), s.mails...)
+}
+
+func TestEmailNotifierSmtp(t *testing.T) {
+	server := newFakeSmtpServer(t)
+	defer server.listener.Close()
+
+	smtpConfig := server.config()
+	smtpConfig.SubjectTemplate = "due: {{.Message}}"
+	n, err := NewEmailNotifier(smtpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Username: "alice", Email: "alice@example.com"}
+	reminder := &Reminder{Id: 3, Message: "water the plants", DueDate: 1600000000}
+	if err := n.Notify(user, reminder); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := server.received()
+	if len(mails) != 1 {
+		t.Fatalf("expected 1 mail, got %d", len(mails))
+	}
+	mail := mails[0]
+	if mail.from != "buddy@example.com" || len(mail.to) != 1 || mail.to[0] != "alice@example.com" {
+		t.Errorf("unexpected envelope %+v", mail)
+	}
+	for _, want := range []string{"To: alice@example.com\r\n", "Subject: due: water the plants\r\n", "Hi alice,", "water the plants"} {
+		if !strings.Contains(mail.data, want) {
+			t.Errorf("mail misses %q:\n%s", want, mail.data)
+		}
+	}
+
+	if err := n.Notify(&User{Username: "bob"}, reminder); err != errorNotifierUnavailable {
+		t.Errorf("user without email: %v", err)
+	}
+}
+
+func TestFallbackNotificationOffScan(t *testing.T) {
+	n, err := NewEmailNotifier(config.SmtpConfig{Host: "smtp.example.com", Port: 25, From: "buddy@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a slow SMTP server
+	release := make(chan Signal)
+	sent := make(chan string, 10)
+	n.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		<-release
+		sent <- to[0]
+		return nil
+	}
+
+	db := NewMemDb()
+	user := &User{Username: "alice", Email: "alice@example.com"}
+	if err := db.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	reminder := &Reminder{Message: "call back", DueDate: time.Now().Add(-20 * time.Minute).Unix()}
+	if err := db.NewReminder("alice", reminder); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, _ := NewCluster(db)
+	wd := NewWebhookDispatcher(db, nil, cluster.Leader)
+	nm := NewNotificationManager(db, nil, wd, n, NotificationIntervals{FallbackAfter: 15 * time.Minute, RedeliveryAfter: time.Minute}, cluster)
+
+	scanned := make(chan Signal)
+	go func() {
+		nm.ScanRemindersForUsers([]*User{user})
+		// still in flight, not queued again
+		nm.ScanRemindersForUsers([]*User{user})
+		scanned <- EmptySignal
+	}()
+	select {
+	case <-scanned:
+	case <-time.After(time.Second):
+		t.Fatal("scan waits for the SMTP server")
+	}
+
+	close(release)
+	select {
+	case to := <-sent:
+		if to != "alice@example.com" {
+			t.Errorf("sent to %s", to)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fallback email not sent")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !fallbackStored(nm, reminder.Id) {
+		if time.Now().After(deadline) {
+			t.Fatal("fallback delivery not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-sent:
+		t.Error("fallback email sent twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func fallbackStored(nm *NotificationManager, reminderId int64) bool {
+	nm.fallbackMutex.Lock()
+	inFlight := nm.fallbackInFlight[reminderId]
+	nm.fallbackMutex.Unlock()
+	if inFlight {
+		return false
+	}
+	deliveries, _ := nm.db.GetReminderDeliveries(reminderId)
+	for _, d := range deliveries {
+		if d.Transport == "email" && d.Result == DeliveryResultSent {
+			return true
+		}
+	}
+	return false
+}
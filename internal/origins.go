@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, Term-Buddy-Pass-Hash"
+	corsMaxAge         = "600" // seconds browsers cache preflight responses
+)
+
+// originPolicy decides which browser origins can open websockets and make CORS requests, the allowed origins can
+// change while the server runs
+type originPolicy struct {
+	mutex   sync.RWMutex
+	origins []string
+}
+
+func newOriginPolicy(origins []string) *originPolicy {
+	p := &originPolicy{}
+	p.set(origins)
+	return p
+}
+
+func (p *originPolicy) set(origins []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.origins = append([]string{}, origins...)
+}
+
+func (p *originPolicy) empty() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.origins) == 0
+}
+
+func (p *originPolicy) listed(origin string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWsOrigin lets agents, which send no origin, connect. Browsers can connect from any origin if no origins
+// are configured, otherwise only from the listed ones.
+func (p *originPolicy) checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 || p.empty() {
+		return true
+	}
+	return p.listed(origin)
+}
+
+// corsHandler adds CORS headers for listed origins and answers their preflight requests, before routing, since
+// routes do not handle OPTIONS
+func (p *originPolicy) corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || !p.listed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+	log "github.com/sirupsen/logrus"
+)
+
+const dbBackupVersion = 1
+
+// dbBackup has every table of schemaModels in Postgres COPY text format. Columns are listed, so a backup can be
+// restored into a DB whose columns are in another order, e.g. created fresh instead of migrated.
+type dbBackup struct {
+	Version   int            `json:"version"`
+	CreatedAt int64          `json:"created_at"`
+	Tables    []*tableBackup `json:"tables"`
+}
+
+type tableBackup struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Rows    string   `json:"rows"`
+}
+
+func schemaTableNames() []string {
+	var names []string
+	for _, model := range schemaModels {
+		table := orm.GetTable(reflect.TypeOf(model).Elem())
+		names = append(names, strings.Trim(string(table.FullName), `"`))
+	}
+	return names
+}
+
+func tableColumns(db orm.DB, table string) ([]string, error) {
+	var columns []string
+	_, err := db.Query(&columns, `SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ? ORDER BY ordinal_position`, table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+func hasColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func copyColumns(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(column)
+	}
+	return fmt.Sprintf("%s (%s)", quoteIdent(table), strings.Join(quoted, ", "))
+}
+
+// Backup writes all tables as JSON, in one repeatable read transaction so the tables are consistent
+func (c *PostgresDBClient) Backup(w io.Writer) error {
+	backup := &dbBackup{
+		Version:   dbBackupVersion,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	err := c.db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return err
+		}
+		for _, table := range schemaTableNames() {
+			columns, err := tableColumns(tx, table)
+			if err != nil {
+				return err
+			}
+			var rows bytes.Buffer
+			if _, err := tx.CopyTo(&rows, fmt.Sprintf("COPY %s TO STDOUT", copyColumns(table, columns))); err != nil {
+				return fmt.Errorf("cannot copy %s: %w", table, err)
+			}
+			backup.Tables = append(backup.Tables, &tableBackup{
+				Name:    table,
+				Columns: columns,
+				Rows:    rows.String(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(backup)
+}
+
+// Restore replaces all data with the backup, in one transaction. Id sequences continue after the restored ids.
+func (c *PostgresDBClient) Restore(r io.Reader) error {
+	backup := &dbBackup{}
+	if err := json.NewDecoder(r).Decode(backup); err != nil {
+		return fmt.Errorf("cannot read backup: %w", err)
+	}
+	if backup.Version != dbBackupVersion {
+		return fmt.Errorf("backup version %d not supported", backup.Version)
+	}
+
+	tables := schemaTableNames()
+	known := make(map[string]bool)
+	for _, table := range tables {
+		known[table] = true
+	}
+	for _, t := range backup.Tables {
+		if !known[t.Name] {
+			return fmt.Errorf("backup has unknown table %s", t.Name)
+		}
+	}
+
+	return c.db.RunInTransaction(func(tx *pg.Tx) error {
+		quoted := make([]string, len(tables))
+		for i, table := range tables {
+			quoted[i] = quoteIdent(table)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("TRUNCATE %s", strings.Join(quoted, ", "))); err != nil {
+			return fmt.Errorf("cannot empty tables: %w", err)
+		}
+
+		for _, t := range backup.Tables {
+			res, err := tx.CopyFrom(strings.NewReader(t.Rows), fmt.Sprintf("COPY %s FROM STDIN", copyColumns(t.Name, t.Columns)))
+			if err != nil {
+				return fmt.Errorf("cannot restore %s: %w", t.Name, err)
+			}
+			log.Debugf("restored %d rows of %s", res.RowsAffected(), t.Name)
+
+			if !hasColumn(t.Columns, "id") {
+				continue
+			}
+			_, err = tx.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence(?, 'id'), coalesce(max(id), 1), max(id) IS NOT NULL) FROM %s`,
+				quoteIdent(t.Name)), t.Name)
+			if err != nil {
+				return fmt.Errorf("cannot reset id sequence of %s: %w", t.Name, err)
+			}
+		}
+		return nil
+	})
+}
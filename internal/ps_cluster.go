@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	busChannel = "terminal_buddy_bus"
+	// Postgres limit of NOTIFY payloads is 8000 bytes
+	maxBusPayload = 7900
+	// advisory lock of the scanning instance, "tb_scan"
+	scannerLockKey = int64(0x74625f7363616e)
+	// how often the leader checks it still holds the lock, and others try to get it
+	leaderCheckInterval = 10 * time.Second
+)
+
+// PostgresBus publishes with NOTIFY and receives with LISTEN, go-pg reconnects the listener if needed
+type PostgresBus struct {
+	db       *pg.DB
+	listener *pg.Listener
+	messages chan *BusMessage
+}
+
+func NewPostgresBus(c *PostgresDBClient) (*PostgresBus, error) {
+	// listening here, not in db.Listen, which drops the error
+	listener := c.db.Listen()
+	if err := listener.Listen(busChannel); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("cannot listen to %s: %w", busChannel, err)
+	}
+
+	bus := &PostgresBus{
+		db:       c.db,
+		listener: listener,
+		messages: make(chan *BusMessage, 100),
+	}
+	go bus.receive()
+	return bus, nil
+}
+
+func (b *PostgresBus) receive() {
+	defer close(b.messages)
+	for notification := range b.listener.Channel() {
+		message := &BusMessage{}
+		if err := json.Unmarshal([]byte(notification.Payload), message); err != nil {
+			log.Errorf("cannot read bus message: %s", err)
+			continue
+		}
+		b.messages <- message
+	}
+}
+
+func (b *PostgresBus) Publish(message *BusMessage) error {
+	return publishBusMessage(b.db, message)
+}
+
+// publishBusMessage notifies the instances listening on the DB, also used by the command line, which does not listen
+func publishBusMessage(db *pg.DB, message *BusMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxBusPayload {
+		return fmt.Errorf("bus message %s of %d bytes is too big", message.Type, len(payload))
+	}
+	_, err = db.Exec("SELECT pg_notify(?, ?)", busChannel, string(payload))
+	return err
+}
+
+func (b *PostgresBus) Messages() <-chan *BusMessage {
+	return b.messages
+}
+
+func (b *PostgresBus) Close() error {
+	return b.listener.Close()
+}
+
+// PostgresLeaderElector makes the instance holding the scanner advisory lock the leader. The lock is a session
+// lock on a connection of its own, so it goes away with the instance or its connection.
+type PostgresLeaderElector struct {
+	db         *pg.DB
+	instanceId string
+	mutex      sync.RWMutex
+	conn       *pg.Conn // only set while leader
+	leader     bool
+	stopChan   chan Signal
+	stopped    chan Signal
+}
+
+// NewPostgresLeaderElector tries to get the lock right away, so a single instance scans from the start
+func NewPostgresLeaderElector(c *PostgresDBClient, instanceId string) *PostgresLeaderElector {
+	e := &PostgresLeaderElector{
+		db:         c.db,
+		instanceId: instanceId,
+		stopChan:   make(chan Signal),
+		stopped:    make(chan Signal),
+	}
+	e.check()
+	go e.run()
+	return e
+}
+
+func (e *PostgresLeaderElector) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ticker.C:
+			e.check()
+		}
+	}
+}
+
+func (e *PostgresLeaderElector) Leader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leader
+}
+
+// check confirms the lock is still held, go-pg silently replaces a broken connection and the lock of its session
+// is gone then, or tries to get the lock. Only run and Close use the connection, the mutex is for leader, so
+// Leader does not wait for a slow DB.
+func (e *PostgresLeaderElector) check() {
+	if e.conn == nil {
+		e.conn = e.db.Conn()
+	}
+
+	var locked bool
+	_, err := e.conn.WithTimeout(leaderCheckInterval).QueryOne(pg.Scan(&locked), `
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory' AND objsubid = 1 AND granted AND pid = pg_backend_pid()
+				AND ((classid::bigint << 32) | objid::bigint) = ?0
+		) THEN true ELSE pg_try_advisory_lock(?0) END`, scannerLockKey)
+	if err != nil {
+		log.Errorf("scanner leader check of instance %s failed: %s", e.instanceId, err)
+		locked = false
+	}
+
+	if locked != e.Leader() {
+		if locked {
+			log.Infof("instance %s is the scanner leader now", e.instanceId)
+		} else {
+			log.Warnf("instance %s is not the scanner leader anymore", e.instanceId)
+		}
+	}
+	e.mutex.Lock()
+	e.leader = locked
+	e.mutex.Unlock()
+
+	if !locked {
+		e.releaseConn()
+	}
+}
+
+// releaseConn unlocks before the connection goes back to the pool, a pooled connection must not keep the lock
+func (e *PostgresLeaderElector) releaseConn() {
+	if e.conn == nil {
+		return
+	}
+	if _, err := e.conn.Exec("SELECT pg_advisory_unlock_all()"); err != nil {
+		log.Debugf("scanner lock release of instance %s: %s", e.instanceId, err)
+	}
+	_ = e.conn.Close()
+	e.conn = nil
+}
+
+func (e *PostgresLeaderElector) Close() error {
+	close(e.stopChan)
+	<-e.stopped
+
+	e.mutex.Lock()
+	e.leader = false
+	e.mutex.Unlock()
+	e.releaseConn()
+	return nil
+}
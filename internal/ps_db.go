@@ -1,9 +1,13 @@
 package internal
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"TerminalBuddyServer/config"
 
@@ -16,29 +20,73 @@ type PostgresDBClient struct {
 	db *pg.DB
 }
 
-func NewPostgresDBClient(config *config.TBConfig, dbPassword string, recreateDb bool) (*PostgresDBClient, error) {
+func NewPostgresDBClient(config *config.TBConfig, recreateDb bool) (*PostgresDBClient, error) {
+	dbConfig := config.Db()
+	tlsConfig, err := dbTlsConfig(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	c := &PostgresDBClient{db: pg.Connect(&pg.Options{
 		ApplicationName: "terminal-buddy",
-		Database:        config.DbName(),
-		User:            config.DbUser(),
-		Password:        dbPassword,
+		Addr:            dbConfig.Addr,
+		Database:        dbConfig.Name,
+		User:            dbConfig.User,
+		Password:        dbConfig.Password,
+		PoolSize:        dbConfig.PoolSize,
+		TLSConfig:       tlsConfig,
 	})}
+	c.db.AddQueryHook(queryLogHook{})
 
-	err := c.createSchema(recreateDb)
+	err = c.createSchema(recreateDb)
 	if err != nil {
 		return nil, err
 	}
 
-	if c.insertAdminUser() {
-		log.Debug("admin user added")
+	return c, nil
+}
+
+func (c *PostgresDBClient) WithContext(ctx context.Context) BuddyDb {
+	return &PostgresDBClient{db: c.db.WithContext(ctx)}
+}
+
+// dbTlsConfig maps the ssl mode to go-pg TLS config, as libpq does: require encrypts only, verify-full also
+// checks the server certificate and host name
+func dbTlsConfig(dbConfig config.DbConfig) (*tls.Config, error) {
+	switch dbConfig.SslMode {
+	case "", "disable":
+		return nil, nil
+	case "require":
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	case "verify-full":
+		host, _, err := net.SplitHostPort(dbConfig.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB address %q: %w", dbConfig.Addr, err)
+		}
+		return &tls.Config{ServerName: host}, nil
+	default:
+		return nil, fmt.Errorf("unknown DB ssl mode %q", dbConfig.SslMode)
 	}
+}
 
-	return c, nil
+var schemaModels = []interface{}{
+	(*User)(nil),
+	(*Reminder)(nil),
+	(*Webhook)(nil),
+	(*WebhookDelivery)(nil),
+	(*ReminderDelivery)(nil),
+	(*LoginFailure)(nil),
+	(*DeviceAuthorization)(nil),
+	(*DeviceToken)(nil),
+	(*Team)(nil),
+	(*TeamMember)(nil),
+	(*TeamReminderAck)(nil),
+	(*ReminderAssignment)(nil),
 }
 
 func (c *PostgresDBClient) createSchema(recreateDb bool) error {
 	if recreateDb {
-		for _, model := range []interface{}{(*User)(nil), (*Reminder)(nil)} {
+		for _, model := range schemaModels {
 			err := c.db.DropTable(model, &orm.DropTableOptions{
 				IfExists: true,
 				Cascade:  true,
@@ -49,7 +97,7 @@ func (c *PostgresDBClient) createSchema(recreateDb bool) error {
 		}
 	}
 
-	for _, model := range []interface{}{(*User)(nil), (*Reminder)(nil)} {
+	for _, model := range schemaModels {
 		err := c.db.CreateTable(model, &orm.CreateTableOptions{
 			IfNotExists: true,
 		})
@@ -58,35 +106,122 @@ func (c *PostgresDBClient) createSchema(recreateDb bool) error {
 		}
 	}
 
-	return nil
+	return c.migrate()
 }
 
-func (c *PostgresDBClient) insertAdminUser() bool {
-	admin := User{
-		Username:     "serj",
-		PasswordHash: fmt.Sprintf("%x", md5.Sum([]byte("serj"))),
-		Reminders:    nil,
+// schemaMigrations are applied in order on every start, so each one has to be idempotent
+var schemaMigrations = []string{
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS tags text[]`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+	`CREATE OR REPLACE FUNCTION reminders_search_vector_update() RETURNS trigger AS $$
+	BEGIN
+		NEW.search_vector :=
+			setweight(to_tsvector('simple', coalesce(NEW.message, '')), 'A') ||
+			setweight(to_tsvector('simple', coalesce(array_to_string(NEW.tags, ' '), '')), 'B');
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS reminders_search_vector_trigger ON reminders`,
+	`CREATE TRIGGER reminders_search_vector_trigger BEFORE INSERT OR UPDATE ON reminders
+	FOR EACH ROW EXECUTE PROCEDURE reminders_search_vector_update()`,
+	`UPDATE reminders SET search_vector = NULL WHERE search_vector IS NULL`, // fires the trigger for old rows
+	`CREATE INDEX IF NOT EXISTS reminders_search_vector_idx ON reminders USING GIN (search_vector)`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS uid text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS reminders_user_id_uid_idx ON reminders (user_id, uid)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS feed_token text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_feed_token_idx ON users (feed_token)`,
+	`CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email text`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS fallback_sent boolean DEFAULT false`,
+	`CREATE INDEX IF NOT EXISTS reminder_deliveries_reminder_id_idx ON reminder_deliveries (reminder_id, id)`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS priority text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS quiet_hours jsonb`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS dnd boolean DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS digest_time text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS last_digest_at bigint`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username))`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS recovery_codes text[]`,
+	`CREATE INDEX IF NOT EXISTS device_tokens_user_id_idx ON device_tokens (user_id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role text DEFAULT 'user'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled boolean DEFAULT false`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS team_id bigint`,
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS created_by bigint`,
+	`CREATE INDEX IF NOT EXISTS reminders_team_id_idx ON reminders (team_id) WHERE team_id IS NOT NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS teams_name_lower_idx ON teams (lower(name))`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS team_members_team_id_user_id_idx ON team_members (team_id, user_id)`,
+	`CREATE INDEX IF NOT EXISTS team_members_user_id_idx ON team_members (user_id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS team_reminder_acks_reminder_id_user_id_idx ON team_reminder_acks (reminder_id, user_id)`,
+	`CREATE INDEX IF NOT EXISTS reminder_assignments_assignee_id_idx ON reminder_assignments (assignee_id)`,
+	`ALTER TABLE team_members ADD COLUMN IF NOT EXISTS invited boolean DEFAULT false`,
+	// unix micros of the last change, for RemindersVersion
+	`ALTER TABLE reminders ADD COLUMN IF NOT EXISTS updated_at bigint`,
+	`CREATE OR REPLACE FUNCTION reminders_updated_at_update() RETURNS trigger AS $$
+	BEGIN
+		NEW.updated_at := (extract(epoch FROM clock_timestamp()) * 1000000)::bigint;
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS reminders_updated_at_trigger ON reminders`,
+	`CREATE TRIGGER reminders_updated_at_trigger BEFORE INSERT OR UPDATE ON reminders
+	FOR EACH ROW EXECUTE PROCEDURE reminders_updated_at_update()`,
+}
+
+func (c *PostgresDBClient) migrate() error {
+	if err := c.checkUsernameCaseDuplicates(); err != nil {
+		return err
 	}
+	for i, migration := range schemaMigrations {
+		if _, err := c.db.Exec(migration); err != nil {
+			return fmt.Errorf("migration #%d failed: %w", i, err)
+		}
+	}
+	return c.disableSeededUser()
+}
 
-	created, err := c.db.Model(&admin).
-		Column("id").
-		Where("username = ?username").
-		OnConflict("DO NOTHING"). // OnConflict is optional
-		Returning("id").
-		SelectOrInsert()
+// disableSeededUser disables the serj user older versions created with the password serj, if the password was never
+// changed. Anyone knowing the source could log in with it.
+func (c *PostgresDBClient) disableSeededUser() error {
+	res, err := c.db.Exec(`UPDATE users SET disabled = true
+		WHERE username = 'serj' AND password_hash = md5('serj') AND NOT coalesce(disabled, false)`)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("cannot disable the seeded user: %w", err)
 	}
-
-	return created
+	if res.RowsAffected() > 0 {
+		log.Warnf("user serj still had the seeded default password and was disabled, " +
+			"run user reset-password and user disable -enable if it is still used")
+	}
+	return nil
 }
 
-func (c *PostgresDBClient) DbOk() bool {
-	_, err := c.db.Exec("SELECT 1")
+// checkUsernameCaseDuplicates fails if usernames differ only in case, users_username_lower_idx cannot be created
+// until all but one of them are renamed or deleted
+func (c *PostgresDBClient) checkUsernameCaseDuplicates() error {
+	var duplicates []string
+	_, err := c.db.Query(&duplicates, `SELECT string_agg(username, ', ' ORDER BY id) FROM users
+		GROUP BY lower(username) HAVING count(*) > 1`)
 	if err != nil {
-		return false
+		return fmt.Errorf("cannot check usernames differing only in case: %w", err)
 	}
-	return true
+	if len(duplicates) > 0 {
+		return fmt.Errorf("usernames differ only in case, rename or delete all but one of each group before migrating: %s",
+			strings.Join(duplicates, "; "))
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) DbOk() bool {
+	return c.Ping(context.Background()) == nil
+}
+
+func (c *PostgresDBClient) Ping(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, "SELECT 1")
+	return err
 }
 
 func (c *PostgresDBClient) Close() error {
@@ -111,12 +246,77 @@ func (c *PostgresDBClient) AllUsers() []*User {
 	return allUsers
 }
 
+func (c *PostgresDBClient) SetUserDnd(userId int64, dnd bool) error {
+	return c.setUserColumn(userId, "dnd = ?", dnd)
+}
+
+func (c *PostgresDBClient) SetUserLastDigestAt(userId int64, at int64) error {
+	return c.setUserColumn(userId, "last_digest_at = ?", at)
+}
+
+// UseTotpStep only moves the step forward, of two concurrent logins with the same code one fails
+func (c *PostgresDBClient) UseTotpStep(userId int64, step int64) (bool, error) {
+	res, err := c.db.Model((*User)(nil)).
+		Set("totp_last_step = ?", step).
+		Where("id = ?", userId).
+		Where("coalesce(totp_last_step, 0) < ?", step).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+func (c *PostgresDBClient) UseRecoveryCode(userId int64, codeHash string) (bool, error) {
+	res, err := c.db.Model((*User)(nil)).
+		Set("recovery_codes = array_remove(recovery_codes, ?)", codeHash).
+		Where("id = ?", userId).
+		Where("? = ANY(recovery_codes)", codeHash).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// setUserColumn updates one column of the user, leaving the other columns as they are in the DB
+func (c *PostgresDBClient) setUserColumn(userId int64, set string, value interface{}) error {
+	res, err := c.db.Model((*User)(nil)).
+		Set(set, value).
+		Where("id = ?", userId).
+		Update()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorUserNotFound
+	}
+	return nil
+}
+
 func (c *PostgresDBClient) SaveUser(user *User) error {
 	res, err := c.db.Model(user).
 		Returning("id").
 		OnConflict("(id) DO UPDATE").
+		Set("username = EXCLUDED.username").
 		Set("password_hash = EXCLUDED.password_hash").
+		Set("feed_token = EXCLUDED.feed_token").
+		Set("email = EXCLUDED.email").
+		Set("timezone = EXCLUDED.timezone").
+		Set("quiet_hours = EXCLUDED.quiet_hours").
+		Set("dnd = EXCLUDED.dnd").
+		Set("digest_time = EXCLUDED.digest_time").
+		Set("last_digest_at = EXCLUDED.last_digest_at").
+		Set("totp_secret = EXCLUDED.totp_secret").
+		Set("totp_enabled = EXCLUDED.totp_enabled").
+		Set("totp_last_step = EXCLUDED.totp_last_step").
+		Set("recovery_codes = EXCLUDED.recovery_codes").
+		Set("role = EXCLUDED.role").
+		Set("disabled = EXCLUDED.disabled").
 		Insert()
+	if isUniqueViolation(err, usernameConstraints) {
+		return errorUsernameTaken
+	}
 	if err != nil {
 		return err
 	}
@@ -126,24 +326,123 @@ func (c *PostgresDBClient) SaveUser(user *User) error {
 	return nil
 }
 
+// DeleteUser removes the user rows and everything referencing the user in one transaction
+func (c *PostgresDBClient) DeleteUser(userId int64) error {
+	return c.db.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Model((*ReminderAssignment)(nil)).
+			Where("assignee_id = ?", userId).
+			WhereOr("reminder_id IN (?)", tx.Model((*Reminder)(nil)).Column("id").Where("user_id = ?", userId)).
+			Delete()
+		if err != nil {
+			return err
+		}
+
+		userModels := []interface{}{
+			(*TeamReminderAck)(nil),
+			(*TeamMember)(nil),
+			(*DeviceToken)(nil),
+			(*DeviceAuthorization)(nil),
+			(*ReminderDelivery)(nil),
+			(*WebhookDelivery)(nil),
+			(*Webhook)(nil),
+			(*Reminder)(nil),
+		}
+		for _, model := range userModels {
+			if _, err := tx.Model(model).Where("user_id = ?", userId).Delete(); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Model((*User)(nil)).Where("id = ?", userId).Delete()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() <= 0 {
+			return errorUserNotFound
+		}
+		return nil
+	})
+}
+
 func (c *PostgresDBClient) GetUser(username string) (*User, error) {
 	user := &User{
 		Username: username,
 	}
+	// usernames are unique regardless of case, see users_username_lower_idx
 	err := c.db.Model(user).
-		Where("username = ?username").
+		Where("lower(username) = lower(?username)").
 		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorUserNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	userReminders, err := c.getUserReminders(user.Id)
+	// reminders are not loaded here, use GetRemindersPage
+	return user, nil
+}
+
+func (c *PostgresDBClient) GetUserById(userId int64) (*User, error) {
+	user := &User{Id: userId}
+	err := c.db.Model(user).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, errorUserNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot get user %s reminders: %w", username, err)
+		return nil, err
 	}
+	return user, nil
+}
 
-	user.Reminders = userReminders
+func (c *PostgresDBClient) GetUsersPage(cursor int64, limit int) ([]*User, error) {
+	var users []*User
+	err := c.db.Model(&users).
+		Where("id > ?", cursor).
+		Order("id ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users page: %w", err)
+	}
+	return users, nil
+}
+
+func (c *PostgresDBClient) CountUsersWithRole(role string) (int, error) {
+	return c.db.Model((*User)(nil)).
+		Where("role = ?", role).
+		Count()
+}
+
+func (c *PostgresDBClient) GetStats() (*DbStats, error) {
+	stats := &DbStats{}
+	var err error
+	if stats.Users, err = c.db.Model((*User)(nil)).Count(); err != nil {
+		return nil, err
+	}
+	if stats.Reminders, err = c.db.Model((*Reminder)(nil)).Count(); err != nil {
+		return nil, err
+	}
+	if stats.UnackedReminders, err = c.db.Model((*Reminder)(nil)).Where("ack IS NOT TRUE").Where("team_id IS NULL").Count(); err != nil {
+		return nil, err
+	}
+	if stats.Webhooks, err = c.db.Model((*Webhook)(nil)).Count(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
+func (c *PostgresDBClient) GetUserByFeedToken(feedToken string) (*User, error) {
+	user := &User{}
+	err := c.db.Model(user).
+		Where("feed_token = ?", feedToken).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
@@ -164,6 +463,61 @@ func (c *PostgresDBClient) getUserReminders(userId int64) ([]*Reminder, error) {
 	return reminders, nil
 }
 
+func (c *PostgresDBClient) GetReminder(userId, reminderId int64) (*Reminder, error) {
+	reminder := &Reminder{}
+	err := c.db.Model(reminder).
+		Where("id = ?", reminderId).
+		Where("user_id = ?", userId).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorReminderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reminder, nil
+}
+
+func (c *PostgresDBClient) GetRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error) {
+	var remindersFromDb []Reminder
+	err := c.db.Model(&remindersFromDb).
+		Where("user_id = ?", userId).
+		Where("id > ?", cursor).
+		Order("id ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get reminders page for user %d: %w", userId, err)
+	}
+
+	var reminders []*Reminder
+	for i, _ := range remindersFromDb {
+		reminders = append(reminders, &remindersFromDb[i])
+	}
+
+	return reminders, nil
+}
+
+func (c *PostgresDBClient) RemindersCount(userId int64) (int, error) {
+	return c.db.Model((*Reminder)(nil)).
+		Where("user_id = ?", userId).
+		Count()
+}
+
+// RemindersVersion is made of the count, the highest id and the last update of the reminders of the user. Deleting
+// changes the count, adding the highest id, and updates the reminders_updated_at_trigger time.
+func (c *PostgresDBClient) RemindersVersion(userId int64) (string, error) {
+	var count, maxId, maxUpdatedAt int64
+	_, err := c.db.QueryOne(pg.Scan(&count, &maxId, &maxUpdatedAt), `
+		SELECT count(*), coalesce(max(id), 0), coalesce(max(updated_at), 0)
+		FROM reminders
+		WHERE user_id = ?`, userId)
+	if err != nil {
+		return "", fmt.Errorf("cannot get reminders version of user %d: %w", userId, err)
+	}
+	return fmt.Sprintf("%d-%d-%d", count, maxId, maxUpdatedAt), nil
+}
+
 func (c *PostgresDBClient) AckReminder(reminderId int64, ack bool) error {
 	var reminder Reminder
 	_, err := c.db.Model(&reminder).
@@ -185,6 +539,9 @@ func (c *PostgresDBClient) SaveReminder(reminder *Reminder) error {
 		Set("ack = EXCLUDED.ack").
 		Set("message = EXCLUDED.message").
 		Set("due_date = EXCLUDED.due_date").
+		Set("tags = EXCLUDED.tags").
+		Set("fallback_sent = EXCLUDED.fallback_sent").
+		Set("priority = EXCLUDED.priority").
 		Insert()
 	if err != nil {
 		return err
@@ -195,21 +552,36 @@ func (c *PostgresDBClient) SaveReminder(reminder *Reminder) error {
 	return nil
 }
 
-func (c *PostgresDBClient) NewReminder(username string, message string, dueDate int64) error {
+func (c *PostgresDBClient) SetReminderFallbackSent(reminderId int64) error {
+	res, err := c.db.Model((*Reminder)(nil)).
+		Set("fallback_sent = ?", true).
+		Where("id = ?", reminderId).
+		Update()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorReminderNotFound
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) NewReminder(username string, reminder *Reminder) error {
 	user, err := c.GetUser(username)
 	if err != nil {
 		return fmt.Errorf("cannot find user %s: %w", username, err)
 	}
 
-	reminder := &Reminder{
-		UserId:  user.Id,
-		Message: message,
-		DueDate: dueDate,
-		Ack:     false,
-	}
+	reminder.UserId = user.Id
 
+	// reminders without uid never conflict, as NULLs are distinct in the unique index
 	res, err := c.db.Model(reminder).
 		Returning("id").
+		OnConflict("(user_id, uid) DO UPDATE").
+		Set("ack = EXCLUDED.ack").
+		Set("message = EXCLUDED.message").
+		Set("due_date = EXCLUDED.due_date").
+		Set("tags = EXCLUDED.tags").
 		Insert()
 	if err != nil {
 		return err
@@ -221,3 +593,667 @@ func (c *PostgresDBClient) NewReminder(username string, message string, dueDate
 
 	return nil
 }
+
+func (c *PostgresDBClient) SearchReminders(userId int64, query ReminderSearchQuery) ([]*ReminderSearchResult, error) {
+	var rows []struct {
+		Reminder
+		Rank float64
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	tags := query.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	_, err := c.db.Query(&rows, `
+		SELECT r.id, r.user_id, r.message, r.due_date, r.tags, r.uid, r.ack, r.fallback_sent, r.priority,
+			ts_rank(r.search_vector, plainto_tsquery('simple', ?0)) AS rank
+		FROM reminders AS r
+		WHERE r.user_id = ?1
+			AND (?0 = '' OR r.search_vector @@ plainto_tsquery('simple', ?0))
+			AND (?2 = 0 OR r.due_date >= ?2)
+			AND (?3 = 0 OR r.due_date <= ?3)
+			AND coalesce(r.tags, '{}') @> ?4::text[]
+		ORDER BY rank DESC, r.due_date ASC
+		LIMIT NULLIF(?5, -1)`,
+		query.Text, userId, query.From, query.To, pg.Array(tags), limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot search reminders for user %d: %w", userId, err)
+	}
+
+	var results []*ReminderSearchResult
+	for i := range rows {
+		results = append(results, &ReminderSearchResult{
+			Reminder: &rows[i].Reminder,
+			Rank:     rows[i].Rank,
+		})
+	}
+
+	return results, nil
+}
+
+func (c *PostgresDBClient) SaveWebhook(webhook *Webhook) error {
+	if webhook.Id == 0 {
+		_, err := c.db.Model(webhook).
+			Returning("id").
+			Insert()
+		return err
+	}
+	_, err := c.db.Model(webhook).
+		WherePK().
+		Update()
+	return err
+}
+
+func (c *PostgresDBClient) GetWebhook(userId, webhookId int64) (*Webhook, error) {
+	webhook := &Webhook{}
+	err := c.db.Model(webhook).
+		Where("id = ?", webhookId).
+		Where("user_id = ?", userId).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (c *PostgresDBClient) GetWebhooks(userId int64) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := c.db.Model(&webhooks).
+		Where("user_id = ?", userId).
+		Order("id ASC").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get webhooks for user %d: %w", userId, err)
+	}
+	return webhooks, nil
+}
+
+func (c *PostgresDBClient) DeleteWebhook(userId, webhookId int64) error {
+	res, err := c.db.Model((*Webhook)(nil)).
+		Where("id = ?", webhookId).
+		Where("user_id = ?", userId).
+		Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorWebhookNotFound
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) SaveWebhookDelivery(delivery *WebhookDelivery) error {
+	if delivery.Id == 0 {
+		_, err := c.db.Model(delivery).
+			Returning("id").
+			Insert()
+		return err
+	}
+	_, err := c.db.Model(delivery).
+		WherePK().
+		Update()
+	return err
+}
+
+func (c *PostgresDBClient) GetPendingWebhookDeliveries(before int64, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := c.db.Model(&deliveries).
+		Where("status = ?", WebhookDeliveryPending).
+		Where("next_attempt_at <= ?", before).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get pending webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (c *PostgresDBClient) GetWebhookDeliveries(webhookId int64, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := c.db.Model(&deliveries).
+		Where("webhook_id = ?", webhookId).
+		Order("id DESC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get deliveries for webhook %d: %w", webhookId, err)
+	}
+	return deliveries, nil
+}
+
+func (c *PostgresDBClient) SaveReminderDelivery(delivery *ReminderDelivery) error {
+	if delivery.Id == 0 {
+		_, err := c.db.Model(delivery).
+			Returning("id").
+			Insert()
+		return err
+	}
+	_, err := c.db.Model(delivery).
+		WherePK().
+		Update()
+	return err
+}
+
+func (c *PostgresDBClient) GetReminderDeliveries(reminderId int64) ([]*ReminderDelivery, error) {
+	var deliveries []*ReminderDelivery
+	err := c.db.Model(&deliveries).
+		Where("reminder_id = ?", reminderId).
+		Order("id ASC").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get deliveries for reminder %d: %w", reminderId, err)
+	}
+	return deliveries, nil
+}
+
+// unique constraints meaning the name is taken, other unique violations (e.g. of the feed token) are errors
+var (
+	usernameConstraints = []string{"users_username_key", "users_username_lower_idx"}
+	teamNameConstraints = []string{"teams_name_key", "teams_name_lower_idx"}
+)
+
+// isUniqueViolation is true if err violates one of the unique constraints
+func isUniqueViolation(err error, constraints []string) bool {
+	pgErr, ok := err.(pg.Error)
+	if !ok || pgErr.Field('C') != "23505" {
+		return false
+	}
+	for _, constraint := range constraints {
+		if pgErr.Field('n') == constraint {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PostgresDBClient) SaveLoginFailure(failure *LoginFailure) error {
+	_, err := c.db.Model(failure).
+		OnConflict("(key) DO UPDATE").
+		Set("failures = EXCLUDED.failures").
+		Set("last_failure_at = EXCLUDED.last_failure_at").
+		Set("locked_until = EXCLUDED.locked_until").
+		Insert()
+	return err
+}
+
+func (c *PostgresDBClient) DeleteLoginFailure(key string) error {
+	_, err := c.db.Model((*LoginFailure)(nil)).
+		Where("key = ?", key).
+		Delete()
+	return err
+}
+
+func (c *PostgresDBClient) GetLoginFailures() ([]*LoginFailure, error) {
+	var failures []*LoginFailure
+	err := c.db.Model(&failures).Select()
+	return failures, err
+}
+
+func (c *PostgresDBClient) SaveDeviceAuthorization(authorization *DeviceAuthorization) error {
+	_, err := c.db.Model(authorization).
+		OnConflict("(device_code_hash) DO UPDATE").
+		Set("status = EXCLUDED.status").
+		Set("user_id = EXCLUDED.user_id").
+		Set("last_polled_at = EXCLUDED.last_polled_at").
+		Insert()
+	return err
+}
+
+func (c *PostgresDBClient) GetDeviceAuthorization(deviceCodeHash string) (*DeviceAuthorization, error) {
+	authorization := &DeviceAuthorization{}
+	err := c.db.Model(authorization).
+		Where("device_code_hash = ?", deviceCodeHash).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorDeviceAuthorizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return authorization, nil
+}
+
+func (c *PostgresDBClient) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	authorization := &DeviceAuthorization{}
+	err := c.db.Model(authorization).
+		Where("user_code = ?", userCode).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorDeviceAuthorizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return authorization, nil
+}
+
+func (c *PostgresDBClient) DeleteDeviceAuthorization(deviceCodeHash string) error {
+	res, err := c.db.Model((*DeviceAuthorization)(nil)).
+		Where("device_code_hash = ?", deviceCodeHash).
+		Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorDeviceAuthorizationNotFound
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) DeleteExpiredDeviceAuthorizations(before int64) error {
+	_, err := c.db.Model((*DeviceAuthorization)(nil)).
+		Where("expires_at < ?", before).
+		Delete()
+	return err
+}
+
+func (c *PostgresDBClient) SaveDeviceToken(token *DeviceToken) error {
+	if token.Id == 0 {
+		_, err := c.db.Model(token).
+			Returning("id").
+			Insert()
+		return err
+	}
+	_, err := c.db.Model(token).
+		WherePK().
+		Update()
+	return err
+}
+
+func (c *PostgresDBClient) GetDeviceToken(tokenHash string) (*DeviceToken, error) {
+	token := &DeviceToken{}
+	err := c.db.Model(token).
+		Where("token_hash = ?", tokenHash).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorDeviceTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (c *PostgresDBClient) GetDeviceTokens(userId int64) ([]*DeviceToken, error) {
+	var tokens []*DeviceToken
+	err := c.db.Model(&tokens).
+		Where("user_id = ?", userId).
+		Order("id ASC").
+		Select()
+	return tokens, err
+}
+
+func (c *PostgresDBClient) DeleteDeviceToken(userId, tokenId int64) error {
+	res, err := c.db.Model((*DeviceToken)(nil)).
+		Where("id = ?", tokenId).
+		Where("user_id = ?", userId).
+		Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorDeviceTokenNotFound
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) DeleteDeviceTokens(userId int64) error {
+	_, err := c.db.Model((*DeviceToken)(nil)).
+		Where("user_id = ?", userId).
+		Delete()
+	return err
+}
+
+func (c *PostgresDBClient) SaveTeam(team *Team) error {
+	var err error
+	if team.Id == 0 {
+		_, err = c.db.Model(team).
+			Returning("id").
+			Insert()
+	} else {
+		_, err = c.db.Model(team).
+			WherePK().
+			Update()
+	}
+	if isUniqueViolation(err, teamNameConstraints) {
+		return errorTeamNameTaken
+	}
+	return err
+}
+
+func (c *PostgresDBClient) GetTeam(name string) (*Team, error) {
+	team := &Team{}
+	// team names are unique regardless of case, see teams_name_lower_idx
+	err := c.db.Model(team).
+		Where("lower(name) = lower(?)", name).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorTeamNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (c *PostgresDBClient) DeleteTeam(teamId int64) error {
+	return c.db.RunInTransaction(func(tx *pg.Tx) error {
+		teamReminderIds := tx.Model((*Reminder)(nil)).Column("id").Where("team_id = ?", teamId)
+		for _, model := range []interface{}{(*TeamReminderAck)(nil), (*ReminderDelivery)(nil)} {
+			if _, err := tx.Model(model).Where("reminder_id IN (?)", teamReminderIds).Delete(); err != nil {
+				return err
+			}
+		}
+		for _, model := range []interface{}{(*Reminder)(nil), (*TeamMember)(nil)} {
+			if _, err := tx.Model(model).Where("team_id = ?", teamId).Delete(); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Model((*Team)(nil)).Where("id = ?", teamId).Delete()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() <= 0 {
+			return errorTeamNotFound
+		}
+		return nil
+	})
+}
+
+func (c *PostgresDBClient) GetUserTeams(userId int64) ([]*UserTeam, error) {
+	var rows []struct {
+		Team
+		MemberRole    string
+		MemberInvited bool
+	}
+	_, err := c.db.Query(&rows, `
+		SELECT t.id, t.name, t.members_can_remind, t.created_at, m.role AS member_role,
+			coalesce(m.invited, false) AS member_invited
+		FROM teams AS t
+		JOIN team_members AS m ON m.team_id = t.id
+		WHERE m.user_id = ?
+		ORDER BY t.name ASC`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get teams of user %d: %w", userId, err)
+	}
+
+	var teams []*UserTeam
+	for i := range rows {
+		teams = append(teams, &UserTeam{Team: &rows[i].Team, Role: rows[i].MemberRole, Invited: rows[i].MemberInvited})
+	}
+	return teams, nil
+}
+
+func (c *PostgresDBClient) SaveTeamMember(member *TeamMember) error {
+	_, err := c.db.Model(member).
+		Returning("id").
+		OnConflict("(team_id, user_id) DO UPDATE").
+		Set("role = EXCLUDED.role, invited = EXCLUDED.invited, joined_at = EXCLUDED.joined_at").
+		Insert()
+	return err
+}
+
+func (c *PostgresDBClient) GetTeamMember(teamId, userId int64) (*TeamMember, error) {
+	member := &TeamMember{}
+	err := c.db.Model(member).
+		Where("team_id = ?", teamId).
+		Where("user_id = ?", userId).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorNotTeamMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (c *PostgresDBClient) GetTeamMembers(teamId int64) ([]*TeamMember, error) {
+	var rows []struct {
+		TeamMember
+		MemberName string
+	}
+	_, err := c.db.Query(&rows, `
+		SELECT m.id, m.team_id, m.user_id, m.role, coalesce(m.invited, false) AS invited, m.joined_at,
+			u.username AS member_name
+		FROM team_members AS m
+		JOIN users AS u ON u.id = m.user_id
+		WHERE m.team_id = ?
+		ORDER BY u.username ASC`, teamId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get members of team %d: %w", teamId, err)
+	}
+
+	var members []*TeamMember
+	for i := range rows {
+		member := &rows[i].TeamMember
+		member.Username = rows[i].MemberName
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (c *PostgresDBClient) DeleteTeamMember(teamId, userId int64) error {
+	res, err := c.db.Model((*TeamMember)(nil)).
+		Where("team_id = ?", teamId).
+		Where("user_id = ?", userId).
+		Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() <= 0 {
+		return errorNotTeamMember
+	}
+	return nil
+}
+
+func (c *PostgresDBClient) NewTeamReminder(reminder *Reminder) error {
+	if reminder.TeamId == 0 {
+		return errorTeamNotFound
+	}
+	_, err := c.db.Model(reminder).
+		Returning("id").
+		Insert()
+	return err
+}
+
+func (c *PostgresDBClient) GetTeamReminder(teamId, reminderId int64) (*Reminder, error) {
+	reminder := &Reminder{}
+	err := c.db.Model(reminder).
+		Where("id = ?", reminderId).
+		Where("team_id = ?", teamId).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorReminderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reminder, nil
+}
+
+func (c *PostgresDBClient) GetTeamReminders(teamId int64) ([]*Reminder, error) {
+	var reminders []*Reminder
+	err := c.db.Model(&reminders).
+		Where("team_id = ?", teamId).
+		Order("id ASC").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get reminders of team %d: %w", teamId, err)
+	}
+	return reminders, nil
+}
+
+func (c *PostgresDBClient) DeleteTeamReminder(teamId, reminderId int64) error {
+	return c.db.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model((*Reminder)(nil)).
+			Where("id = ?", reminderId).
+			Where("team_id = ?", teamId).
+			Delete()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() <= 0 {
+			return errorReminderNotFound
+		}
+
+		for _, model := range []interface{}{(*TeamReminderAck)(nil), (*ReminderDelivery)(nil)} {
+			if _, err := tx.Model(model).Where("reminder_id = ?", reminderId).Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *PostgresDBClient) GetMemberTeamReminders(userId int64) ([]*Reminder, error) {
+	var rows []struct {
+		Reminder
+		TeamName  string
+		MemberAck bool
+	}
+	_, err := c.db.Query(&rows, `
+		SELECT r.id, r.message, r.due_date, r.tags, r.uid, r.priority, r.team_id, r.created_by,
+			t.name AS team_name, a.id IS NOT NULL AS member_ack
+		FROM reminders AS r
+		JOIN teams AS t ON t.id = r.team_id
+		JOIN team_members AS m ON m.team_id = r.team_id AND m.user_id = ?0 AND NOT coalesce(m.invited, false)
+		LEFT JOIN team_reminder_acks AS a ON a.reminder_id = r.id AND a.user_id = ?0
+		ORDER BY r.id ASC`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get team reminders of user %d: %w", userId, err)
+	}
+
+	var reminders []*Reminder
+	for i := range rows {
+		reminder := &rows[i].Reminder
+		reminder.Team = rows[i].TeamName
+		reminder.Ack = rows[i].MemberAck
+		reminders = append(reminders, reminder)
+	}
+	return reminders, nil
+}
+
+func (c *PostgresDBClient) AckTeamReminder(reminderId, userId int64) error {
+	_, err := c.db.Model(&TeamReminderAck{ReminderId: reminderId, UserId: userId, AckedAt: time.Now().Unix()}).
+		OnConflict("(reminder_id, user_id) DO NOTHING").
+		Insert()
+	return err
+}
+
+func (c *PostgresDBClient) GetTeamReminderAcks(reminderId int64) ([]*TeamReminderAck, error) {
+	var acks []*TeamReminderAck
+	err := c.db.Model(&acks).
+		Where("reminder_id = ?", reminderId).
+		Order("id ASC").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get acks of team reminder %d: %w", reminderId, err)
+	}
+	return acks, nil
+}
+
+func (c *PostgresDBClient) SaveReminderAssignment(assignment *ReminderAssignment) error {
+	if assignment.Id == 0 {
+		_, err := c.db.Model(assignment).
+			Returning("id").
+			Insert()
+		return err
+	}
+	_, err := c.db.Model(assignment).
+		WherePK().
+		Update()
+	return err
+}
+
+func (c *PostgresDBClient) GetReminderAssignment(reminderId int64) (*ReminderAssignment, error) {
+	assignment := &ReminderAssignment{}
+	err := c.db.Model(assignment).
+		Where("reminder_id = ?", reminderId).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, errorAssignmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
+
+func (c *PostgresDBClient) GetReminderAssignments(userId int64) ([]*ReminderAssignment, error) {
+	var assignments []*ReminderAssignment
+	_, err := c.db.Query(&assignments, `
+		SELECT a.* FROM reminder_assignments AS a
+		JOIN reminders AS r ON r.id = a.reminder_id
+		WHERE r.user_id = ?
+		ORDER BY a.reminder_id ASC`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get reminder assignments of user %d: %w", userId, err)
+	}
+	return assignments, nil
+}
+
+// assignedReminderRow is a reminder with the usernames of its creator and assignee, and the assignment status,
+// which are empty if the reminder is not assigned
+type assignedReminderRow struct {
+	Reminder
+	CreatorName      string
+	AssigneeName     string
+	AssignmentStatus string
+}
+
+const assignedRemindersQuery = `
+	SELECT r.id, r.user_id, r.message, r.due_date, r.tags, r.uid, r.ack, r.fallback_sent, r.priority,
+		creator.username AS creator_name, assignee.username AS assignee_name, a.status AS assignment_status
+	FROM reminders AS r
+	JOIN users AS creator ON creator.id = r.user_id
+	LEFT JOIN reminder_assignments AS a ON a.reminder_id = r.id
+	LEFT JOIN users AS assignee ON assignee.id = a.assignee_id`
+
+func assignedReminders(rows []assignedReminderRow) []*Reminder {
+	var reminders []*Reminder
+	for i := range rows {
+		reminder := &rows[i].Reminder
+		if len(rows[i].AssignmentStatus) > 0 {
+			reminder.AssignedBy = rows[i].CreatorName
+			reminder.AssignedTo = rows[i].AssigneeName
+			reminder.Assignment = rows[i].AssignmentStatus
+		}
+		reminders = append(reminders, reminder)
+	}
+	return reminders
+}
+
+func (c *PostgresDBClient) GetAssignedReminders(userId int64) ([]*Reminder, error) {
+	var rows []assignedReminderRow
+	_, err := c.db.Query(&rows, assignedRemindersQuery+`
+		WHERE a.assignee_id = ? AND a.status != ?
+		ORDER BY r.id ASC`, userId, AssignmentDeclined)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get reminders assigned to user %d: %w", userId, err)
+	}
+	return assignedReminders(rows), nil
+}
+
+func (c *PostgresDBClient) GetVisibleRemindersPage(userId int64, cursor int64, limit int) ([]*Reminder, error) {
+	var rows []assignedReminderRow
+	_, err := c.db.Query(&rows, assignedRemindersQuery+`
+		WHERE (r.user_id = ?0 OR (a.assignee_id = ?0 AND a.status != ?1)) AND r.id > ?2
+		ORDER BY r.id ASC
+		LIMIT ?3`, userId, AssignmentDeclined, cursor, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get visible reminders page for user %d: %w", userId, err)
+	}
+	return assignedReminders(rows), nil
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// queries taking longer are logged as warnings
+const slowQueryThreshold = 500 * time.Millisecond
+
+// queryLogHook logs failed and slow queries, and every query at trace level, with the request_id of the DB
+// context (see BuddyDb.WithContext). Queries are logged without params, they can hold password hashes and tokens.
+type queryLogHook struct{}
+
+func (queryLogHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (queryLogHook) AfterQuery(_ context.Context, evt *pg.QueryEvent) error {
+	duration := time.Since(evt.StartTime)
+	query, err := evt.UnformattedQuery()
+	if err != nil {
+		query = "?"
+	}
+
+	entry := contextLog(evt.DB.Context()).WithFields(log.Fields{
+		"query":       query,
+		"duration_ms": duration.Milliseconds(),
+	})
+	switch {
+	case evt.Err != nil && evt.Err != pg.ErrNoRows:
+		entry.Warnf("query failed: %s", evt.Err)
+	case duration > slowQueryThreshold:
+		entry.Warn("slow query")
+	default:
+		entry.Trace("query")
+	}
+	return nil
+}
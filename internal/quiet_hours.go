@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietHoursWindow is a daily window without notifications, in user timezone. Window with End before Start
+// ends on the next day, e.g. 22:00 - 07:00.
+type QuietHoursWindow struct {
+	Weekday time.Weekday `json:"weekday"` // 0 is Sunday
+	Start   string       `json:"start"`   // HH:MM
+	End     string       `json:"end"`     // HH:MM
+}
+
+func (w QuietHoursWindow) Validate() error {
+	if w.Weekday < time.Sunday || w.Weekday > time.Saturday {
+		return fmt.Errorf("invalid weekday %d", w.Weekday)
+	}
+	start, err := minuteOfDay(w.Start)
+	if err != nil {
+		return err
+	}
+	end, err := minuteOfDay(w.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("empty window %s - %s", w.Start, w.End)
+	}
+	return nil
+}
+
+// contains checks if the local time is inside the window
+func (w QuietHoursWindow) contains(local time.Time) bool {
+	start, err := minuteOfDay(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := minuteOfDay(w.End)
+	if err != nil {
+		return false
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	weekday := local.Weekday()
+	if start < end {
+		return weekday == w.Weekday && minute >= start && minute < end
+	}
+	// over midnight
+	nextDay := (w.Weekday + 1) % 7
+	return (weekday == w.Weekday && minute >= start) || (weekday == nextDay && minute < end)
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// InQuietTime is true if user has do not disturb on, or now is in one of user quiet hours windows
+func (u *User) InQuietTime(now time.Time) bool {
+	if u.Dnd {
+		return true
+	}
+	if len(u.QuietHours) == 0 {
+		return false
+	}
+
+	local := now.In(u.Location())
+	for _, w := range u.QuietHours {
+		if w.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// Location is the user timezone, UTC if not set
+func (u *User) Location() *time.Location {
+	if len(u.Timezone) > 0 {
+		if loc, err := time.LoadLocation(u.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
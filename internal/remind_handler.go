@@ -3,58 +3,67 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRemindersPageLimit = 50
+	maxRemindersPageLimit     = 200
+	maxImportSize             = 1 << 20 // 1MB
 )
 
 type RemindHandler struct {
-	db     BuddyDb
-	router *mux.Router
+	db      BuddyDb
+	limiter *LoginLimiter
+	nm      *NotificationManager
+	router  *mux.Router
 }
 
-func NewRemindHandler(db BuddyDb, remindRouter *mux.Router) {
+func NewRemindHandler(db BuddyDb, limiter *LoginLimiter, nm *NotificationManager, remindRouter *mux.Router) {
 	handler := &RemindHandler{
-		db:     db,
-		router: remindRouter,
+		db:      db,
+		limiter: limiter,
+		nm:      nm,
+		router:  remindRouter,
 	}
 
 	remindRouter.HandleFunc("/{username}", handler.handleGet).Methods("GET")
 	remindRouter.HandleFunc("/{username}", handler.handleNew).Methods("POST")
 	remindRouter.HandleFunc("/{username}/all", handler.handleAll).Methods("GET")
+	remindRouter.HandleFunc("/{username}/count", handler.handleCount).Methods("GET")
+	remindRouter.HandleFunc("/{username}/search", handler.handleSearch).Methods("GET")
+	remindRouter.HandleFunc("/{username}/export.ics", handler.handleExport).Methods("GET")
+	remindRouter.HandleFunc("/{username}/import", handler.handleImport).Methods("POST")
+	remindRouter.HandleFunc("/{username}/{id:[0-9]+}/deliveries", handler.handleDeliveries).Methods("GET")
+	remindRouter.HandleFunc("/{username}/digest", handler.handleDigest).Methods("GET")
 	remindRouter.HandleFunc("/{username}/today", handler.handleToday).Methods("GET")
 }
 
-func (handler *RemindHandler) handleGet(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	if username == "" {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing")
-		return
-	}
-
-	user, err := handler.db.GetUser(username)
-	if err != nil {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "cannot get user")
-		return
-	}
+func (handler *RemindHandler) authorizedUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	return headerAuthorizedUser(handler.db.WithContext(r.Context()), handler.limiter, w, r)
+}
 
+// formAuthorizedUser checks the password_hash form value against the user from the {username} path variable
+func (handler *RemindHandler) formAuthorizedUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
 	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
-		return
+		return nil, false
 	}
 
-	passwordHash := r.FormValue("password_hash")
-	if len(passwordHash) == 0 {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "password hash missing")
-		return
-	}
+	vars := mux.Vars(r)
+	return checkCredentials(handler.db.WithContext(r.Context()), handler.limiter, w, r, vars["username"], r.FormValue("password_hash"))
+}
 
-	if user.PasswordHash != passwordHash {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong credentials")
+func (handler *RemindHandler) handleGet(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.formAuthorizedUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -70,15 +79,15 @@ func (handler *RemindHandler) handleGet(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	reminder := user.GetReminder(id)
-	if reminder == nil {
+	reminder, err := handler.db.WithContext(r.Context()).GetReminder(user.Id, id)
+	if err != nil {
 		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
 		return
 	}
 
 	reminderJsonBytes, err := json.Marshal(reminder)
 	if err != nil {
-		log.Errorf("error marshaling reminder [%s]: %s", reminder.Id, err.Error())
+		requestLog(r).Errorf("error marshaling reminder [%d]: %s", reminder.Id, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
 		return
 	}
@@ -91,80 +100,401 @@ func (handler *RemindHandler) handleGet(w http.ResponseWriter, r *http.Request)
 }
 
 func (handler *RemindHandler) handleNew(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	user, err := handler.db.GetUser(username)
-	if len(username) == 0 || err != nil {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing / cannot get user")
+	user, ok := handler.formAuthorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
-		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+	message := r.FormValue("message")
+	dueDateStr := r.FormValue("due_date")
+	if len(message) == 0 || len(dueDateStr) == 0 {
+		sendSimpleBadRequestResponse(w, "wrong arguments")
 		return
 	}
 
-	passwordHash := r.FormValue("password_hash")
-	if len(passwordHash) == 0 {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "password hash missing")
+	requestLog(r).Debugf("new reminder added for: %s", user.Username)
+	requestLog(r).Debugln("message: \t" + message)
+	requestLog(r).Debugln("dueDateStr: \t" + dueDateStr)
+
+	dueDate, err := strconv.ParseInt(dueDateStr, 10, 64)
+	if err != nil {
+		sendSimpleErrResponse(w, http.StatusInternalServerError, fmt.Sprintf("due date (%v) error", dueDateStr))
 		return
 	}
 
-	if user.PasswordHash != passwordHash {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong credentials")
+	priority := r.FormValue("priority")
+	if priority != "" && priority != PriorityNormal && priority != PriorityHigh {
+		sendSimpleBadRequestResponse(w, "priority invalid")
 		return
 	}
 
-	message := r.FormValue("message")
-	dueDateStr := r.FormValue("due_date")
-	if len(message) == 0 || len(dueDateStr) == 0 {
-		sendSimpleBadRequestResponse(w, "wrong arguments")
+	var assignee *User
+	if assigneeName := r.FormValue("assignee"); len(assigneeName) > 0 && assigneeName != user.Username {
+		if assignee, ok = handler.assignee(w, r, user, assigneeName); !ok {
+			return
+		}
+	}
+
+	reminder := &Reminder{
+		Message:  message,
+		DueDate:  dueDate,
+		Tags:     ParseTags(r.FormValue("tags")),
+		Priority: priority,
+	}
+
+	if err = handler.db.WithContext(r.Context()).NewReminder(user.Username, reminder); err != nil {
+		requestLog(r).Errorf("failed to insert new reminder for user %s: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	log.Debugf("new reminder added for: %s", user.Username)
-	log.Debugln("message: \t" + message)
-	log.Debugln("dueDateStr: \t" + dueDateStr)
+	if assignee == nil {
+		sendSimpleResponse(w, "added")
+		return
+	}
 
-	dueDate, err := strconv.ParseInt(dueDateStr, 10, 64)
+	// the reminder stays with its creator if the assignment fails
+	if err := handler.nm.AssignReminder(user, assignee, reminder); err != nil {
+		requestLog(r).Errorf("failed to assign reminder %d of user %s to %s: %s", reminder.Id, user.Username, assignee.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "reminder added, but not assigned")
+		return
+	}
+
+	sendSimpleResponse(w, "assigned")
+}
+
+// assignee is the user the new reminder is assigned to, a teammate of the user
+func (handler *RemindHandler) assignee(w http.ResponseWriter, r *http.Request, user *User, assigneeName string) (*User, bool) {
+	db := handler.db.WithContext(r.Context())
+	assignee, err := db.GetUser(assigneeName)
+	if err != nil || assignee.Disabled {
+		sendSimpleErrResponse(w, http.StatusNotFound, "assignee not found")
+		return nil, false
+	}
+
+	teammates, err := shareTeam(db, user, assignee)
 	if err != nil {
-		sendSimpleErrResponse(w, http.StatusInternalServerError, fmt.Sprintf("due date (%v) error", dueDateStr))
+		requestLog(r).Errorf("error getting teams of user %s: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get teams")
+		return nil, false
+	}
+	if !teammates {
+		sendSimpleErrResponse(w, http.StatusForbidden, "reminders can be assigned to teammates only")
+		return nil, false
+	}
+	return assignee, true
+}
+
+func (handler *RemindHandler) handleAll(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	if err = handler.db.NewReminder(username, message, dueDate); err != nil {
-		log.Errorf("failed to insert new reminder for user %s: %s", user.Username, err.Error())
-		sendSimpleErrResponse(w, http.StatusInternalServerError, err.Error())
+	var err error
+	cursor := int64(0)
+	if cursorStr := r.URL.Query().Get("cursor"); len(cursorStr) > 0 {
+		if cursor, err = strconv.ParseInt(cursorStr, 10, 64); err != nil || cursor < 0 {
+			sendSimpleBadRequestResponse(w, "cursor value invalid")
+			return
+		}
+	}
+
+	limit := defaultRemindersPageLimit
+	if limitStr := r.URL.Query().Get("limit"); len(limitStr) > 0 {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			sendSimpleBadRequestResponse(w, "limit value invalid")
+			return
+		}
+		if limit > maxRemindersPageLimit {
+			limit = maxRemindersPageLimit
+		}
+	}
+
+	// reminders assigned to the user are listed too, assigned reminders have their origin set
+	reminders, err := handler.db.WithContext(r.Context()).GetVisibleRemindersPage(user.Id, cursor, limit)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] reminders: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
 		return
 	}
 
-	sendSimpleResponse(w, "added")
+	page := RemindersPage{
+		Reminders: reminders,
+	}
+	if page.Reminders == nil {
+		page.Reminders = []*Reminder{}
+	}
+	if len(reminders) == limit {
+		page.NextCursor = reminders[len(reminders)-1].Id
+	}
+
+	pageJsonBytes, err := json.Marshal(page)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] reminders: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: pageJsonBytes,
+	})
 }
 
-func (handler *RemindHandler) handleAll(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
-	user, err := handler.db.GetUser(username)
-	if len(username) == 0 || err != nil {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing / cannot get user")
+func (handler *RemindHandler) handleCount(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := handler.db.WithContext(r.Context()).RemindersCount(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error counting user [%s] reminders: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot count reminders")
 		return
 	}
 
-	passwordHash := r.Header.Get("Term-Buddy-Pass-Hash")
-	if len(passwordHash) == 0 {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "password hash missing")
+	countJsonBytes, err := json.Marshal(RemindersCount{Count: count})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] reminders count: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
 		return
 	}
 
-	if user.PasswordHash != passwordHash {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong credentials")
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: countJsonBytes,
+	})
+}
+
+func (handler *RemindHandler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	query := ReminderSearchQuery{
+		Text:  params.Get("q"),
+		Tags:  ParseTags(params.Get("tags")),
+		Limit: defaultRemindersPageLimit,
+	}
+
+	var err error
+	if fromStr := params.Get("from"); len(fromStr) > 0 {
+		if query.From, err = strconv.ParseInt(fromStr, 10, 64); err != nil {
+			sendSimpleBadRequestResponse(w, "from value invalid")
+			return
+		}
+	}
+	if toStr := params.Get("to"); len(toStr) > 0 {
+		if query.To, err = strconv.ParseInt(toStr, 10, 64); err != nil {
+			sendSimpleBadRequestResponse(w, "to value invalid")
+			return
+		}
+	}
+	if limitStr := params.Get("limit"); len(limitStr) > 0 {
+		if query.Limit, err = strconv.Atoi(limitStr); err != nil || query.Limit <= 0 {
+			sendSimpleBadRequestResponse(w, "limit value invalid")
+			return
+		}
+		if query.Limit > maxRemindersPageLimit {
+			query.Limit = maxRemindersPageLimit
+		}
+	}
+
+	if len(query.Text) == 0 && len(query.Tags) == 0 && query.From == 0 && query.To == 0 {
+		sendSimpleBadRequestResponse(w, "search query missing")
+		return
+	}
+
+	results, err := handler.db.WithContext(r.Context()).SearchReminders(user.Id, query)
+	if err != nil {
+		requestLog(r).Errorf("error searching user [%s] reminders: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "search error")
+		return
+	}
+	if results == nil {
+		results = []*ReminderSearchResult{}
+	}
+
+	resultsJsonBytes, err := json.Marshal(results)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] search results: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: resultsJsonBytes,
+	})
+}
+
+func (handler *RemindHandler) handleExport(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	reminders, err := allUserReminders(handler.db.WithContext(r.Context()), user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] reminders for export: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
+		return
+	}
+
+	asEvents := r.URL.Query().Get("type") == "event"
+	icsBytes := EncodeICalendar(reminders, asEvents, time.Now())
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user.Username+".ics"))
+	if _, err := w.Write(icsBytes); err != nil {
+		requestLog(r).Warnf("failed to send ics export to user [%s]: %s", user.Username, err)
+	}
+}
+
+func (handler *RemindHandler) handleImport(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	// accept both a multipart upload (file field) and a raw text/calendar body
+	var icsReader io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			sendSimpleBadRequestResponse(w, "ics file missing")
+			return
+		}
+		defer file.Close()
+		icsReader = file
+	}
+
+	reminders, err := ParseICalendar(icsReader)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, fmt.Sprintf("invalid ics data: %s", err))
+		return
+	}
+
+	result := ImportResult{}
+	for _, reminder := range reminders {
+		// reminders exported from here are updated in place instead of being duplicated
+		if id, ok := reminderIdFromUid(reminder.Uid); ok {
+			if existing, err := db.GetReminder(user.Id, id); err == nil {
+				reminder.Id = existing.Id
+				reminder.UserId = user.Id
+				reminder.Uid = existing.Uid
+				if err := db.SaveReminder(reminder); err != nil {
+					requestLog(r).Errorf("failed to update imported reminder %d for user %s: %s", id, user.Username, err.Error())
+					sendSimpleErrResponse(w, http.StatusInternalServerError, "import failed")
+					return
+				}
+				result.Imported++
+				continue
+			}
+		}
+
+		if err := db.NewReminder(user.Username, reminder); err != nil {
+			requestLog(r).Errorf("failed to import reminder %s for user %s: %s", reminder.Uid, user.Username, err.Error())
+			sendSimpleErrResponse(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		result.Imported++
+	}
+
+	resultJsonBytes, err := json.Marshal(result)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] import result: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "imported",
+		DataJsonBytes: resultJsonBytes,
+	})
+}
+
+// handleDeliveries returns the delivery history of the reminder
+func (handler *RemindHandler) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id value invalid")
+		return
+	}
+
+	if _, err := db.GetReminder(user.Id, id); err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	deliveries, err := db.GetReminderDeliveries(id)
+	if err != nil {
+		requestLog(r).Errorf("error getting reminder %d deliveries: %s", id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get deliveries")
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*ReminderDelivery{}
+	}
+
+	deliveriesJsonBytes, err := json.Marshal(deliveries)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling reminder %d deliveries: %s", id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: deliveriesJsonBytes,
+	})
+}
+
+// handleDigest returns the same summary the daily digest sends, as json or with ?format=text as plain text
+func (handler *RemindHandler) handleDigest(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	reminders, err := allUserReminders(handler.db.WithContext(r.Context()), user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] reminders for digest: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
+		return
+	}
+
+	digest := BuildDigest(user, reminders, time.Now())
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := w.Write([]byte(digest.Text(user.Location()))); err != nil {
+			requestLog(r).Warnf("failed to send digest to user [%s]: %s", user.Username, err)
+		}
 		return
 	}
 
-	userRemindersJsonBytes, err := json.Marshal(user.Reminders)
+	digestJsonBytes, err := json.Marshal(digest)
 	if err != nil {
-		log.Errorf("error marshaling user [%s] reminders: %s", user.Username, err.Error())
+		requestLog(r).Errorf("error marshaling user [%s] digest: %s", user.Username, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
 		return
 	}
@@ -172,7 +502,7 @@ func (handler *RemindHandler) handleAll(w http.ResponseWriter, r *http.Request)
 	sendResp(w, http.StatusOK, Response{
 		Ok:            true,
 		Message:       "ok",
-		DataJsonBytes: userRemindersJsonBytes,
+		DataJsonBytes: digestJsonBytes,
 	})
 }
 
@@ -1,16 +1,125 @@
 package internal
 
+import (
+	"strings"
+	"unicode"
+)
+
 type Reminder struct {
-	Id      int64  `json:"id"`
-	UserId  int64  `json:"-"`
-	Message string `json:"message" pg:",notnull"`
-	DueDate int64  `json:"due_date" pg:",notnull"`
-	Ack     bool   `json:"-" pg:"default:false"` //reminder acknowledged
+	Id      int64    `json:"id"`
+	UserId  int64    `json:"-"`
+	Message string   `json:"message" pg:",notnull"`
+	DueDate int64    `json:"due_date" pg:",notnull"`
+	Tags    []string `json:"tags" pg:",array"`
+	Uid     string   `json:"uid,omitempty"`        // set for reminders imported from iCalendar
+	Ack     bool     `json:"-" pg:"default:false"` //reminder acknowledged
+	// fallback notification (email) was sent, because reminder was not acked in time
+	FallbackSent bool `json:"-" pg:"default:false"`
+	// high priority reminders are sent in quiet hours too
+	Priority string `json:"priority,omitempty"`
+	// team reminders have no user, they go to all team members. Ack is the one of the member they are loaded for.
+	TeamId    int64  `json:"team_id,omitempty"`
+	Team      string `json:"team,omitempty" pg:"-"`
+	CreatedBy int64  `json:"-"` // user creating a team reminder
+	// origin of reminders assigned to another user, set where loaded with their assignment
+	AssignedBy string `json:"assigned_by,omitempty" pg:"-"`
+	AssignedTo string `json:"assigned_to,omitempty" pg:"-"`
+	Assignment string `json:"assignment,omitempty" pg:"-"` // assignment status
+}
+
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+func (r *Reminder) HighPriority() bool {
+	return r.Priority == PriorityHigh
+}
+
+// HasTags reports whether the reminder has all the given tags
+func (r *Reminder) HasTags(tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, rt := range r.Tags {
+			if rt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type ReminderSearchQuery struct {
+	Text  string
+	Tags  []string
+	From  int64 // due date lower bound, 0 means unbounded
+	To    int64 // due date upper bound, 0 means unbounded
+	Limit int
+}
+
+func (q ReminderSearchQuery) inDueDateRange(dueDate int64) bool {
+	if q.From > 0 && dueDate < q.From {
+		return false
+	}
+	if q.To > 0 && dueDate > q.To {
+		return false
+	}
+	return true
+}
+
+type ReminderSearchResult struct {
+	*Reminder
+	Rank float64 `json:"rank"`
+}
+
+// ParseTags splits comma separated tags, trimming and lower casing them
+func ParseTags(tagsStr string) []string {
+	var tags []string
+	for _, t := range strings.Split(tagsStr, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) > 0 {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// searchTokens splits text into lower cased words, used for in memory search
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type RemindersPage struct {
+	Reminders  []*Reminder `json:"reminders"`
+	NextCursor int64       `json:"next_cursor"` // 0 when there are no more reminders
+}
+
+type RemindersCount struct {
+	Count int `json:"count"`
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
 }
 
 type ReminderMessage struct {
-	Id      int64  `json:"id"`
-	Message string `json:"message"`
+	Id         int64  `json:"id"`
+	Message    string `json:"message"`
+	Priority   string `json:"priority,omitempty"`
+	Team       string `json:"team,omitempty"`        // name of the team, for team reminders
+	AssignedBy string `json:"assigned_by,omitempty"` // creator, for reminders assigned to the user
+	DeliveryId int64  `json:"deliveryId"`            // sent back in the "received" receipt
+}
+
+// ReminderBatchMessage carries reminders held during quiet time
+type ReminderBatchMessage struct {
+	Batch []ReminderMessage `json:"batch"`
 }
 
 type AgentMessage struct {
@@ -18,6 +127,25 @@ type AgentMessage struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"userCredentials"`
-	Message    string `json:"message"`
-	ReminderId int64  `json:"reminderId"`
+	Message       string `json:"message"`
+	ReminderId    int64  `json:"reminderId"`
+	DeliveryId    int64  `json:"deliveryId"`    // used with "received" message
+	SnoozeMinutes int    `json:"snoozeMinutes"` // used with "snooze" message
+	Dnd           bool   `json:"dnd"`           // used with "dnd" message
+	// used with "command_started" and "command_finished" messages
+	CommandId  string `json:"commandId"`
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exitCode"`
+	DurationMs int64  `json:"durationMs"`
+	Host       string `json:"host"`
+}
+
+func (m *AgentMessage) commandEvent() *CommandEvent {
+	return &CommandEvent{
+		Id:         m.CommandId,
+		Command:    m.Command,
+		ExitCode:   m.ExitCode,
+		DurationMs: m.DurationMs,
+		Host:       m.Host,
+	}
 }
@@ -0,0 +1,20 @@
+package internal
+
+const (
+	DeliveryResultSent     = "sent"     // handed to the client transport, not confirmed yet
+	DeliveryResultFailed   = "failed"   // transport refused it
+	DeliveryResultReceived = "received" // client sent a receipt
+)
+
+// ReminderDelivery is one attempt to deliver a reminder to a user device
+type ReminderDelivery struct {
+	Id         int64  `json:"id"`
+	ReminderId int64  `json:"reminder_id" pg:",notnull"`
+	UserId     int64  `json:"-" pg:",notnull"`
+	Device     string `json:"device" pg:",notnull"`
+	Transport  string `json:"transport" pg:",notnull"`
+	Result     string `json:"result" pg:",notnull"`
+	Error      string `json:"error,omitempty"`
+	SentAt     int64  `json:"sent_at" pg:",notnull"`
+	ReceivedAt int64  `json:"received_at,omitempty"`
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// request IDs from clients or proxies are kept if they are safe to log
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIdKey struct{}
+
+// newLogId is a random id for requests and connections, short enough to read in logs
+func newLogId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIdHandler gives every request an ID, the one sent in X-Request-Id if valid. It is in the X-Request-Id
+// response header and in the request context, for requestLog and DB query logs.
+func requestIdHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = newLogId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, requestId)))
+	})
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// contextLog is the log entry with the request_id of the context, if it has one
+func contextLog(ctx context.Context) *log.Entry {
+	if requestId := requestIdFromContext(ctx); len(requestId) > 0 {
+		return log.WithField("request_id", requestId)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestLog is the log entry of handlers, with the request_id of the request
+func requestLog(r *http.Request) *log.Entry {
+	return contextLog(r.Context())
+}
+
+// statusRecorder keeps the response status for the request log. It still lets SSE flush and websockets hijack the
+// connection.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot hijack the connection")
+	}
+	// websocket upgrade, the status is written to the hijacked connection
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (s *Server) getLoggingMiddleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			requestLog(r).WithFields(log.Fields{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      recorder.status,
+				"duration_ms": time.Since(start).Milliseconds(),
+				"user_agent":  r.Header.Get("User-Agent"),
+				"ip":          clientIp(r),
+			}).Trace("request")
+		})
+	}
+}
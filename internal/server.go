@@ -2,6 +2,7 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -15,60 +16,164 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	httpWriteTimeout = 15 * time.Second
+	httpReadTimeout  = 15 * time.Second
+	// SSE streams and long polls have to end before the write timeout kicks in
+	maxAgentWait = httpWriteTimeout - 3*time.Second
+)
+
 type Server struct {
-	port int
-	db   BuddyDb
+	port     int
+	db       BuddyDb
+	tbConfig *config.TBConfig // as of the last reload
 
 	wsUpgrader          websocket.Upgrader
+	origins             *originPolicy
+	proxies             *proxyPolicy
 	notificationManager *NotificationManager
+	webhookDispatcher   *WebhookDispatcher
+	passwordPolicy      config.PasswordPolicy
+	loginLimiter        *LoginLimiter
+	cluster             *Cluster
 }
 
-func NewServer(tbConfig *config.TBConfig, dbType BuddyDbType, dbPassword string, recreateDb bool) *Server {
+func NewServer(tbConfig *config.TBConfig, dbType BuddyDbType, recreateDb bool) *Server {
 	wsUpgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
 
-	wsUpgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
-	}
-
 	server := &Server{
-		wsUpgrader: wsUpgrader,
-		port:       tbConfig.Port(),
+		wsUpgrader:     wsUpgrader,
+		origins:        newOriginPolicy(tbConfig.AllowedOrigins()),
+		proxies:        newProxyPolicy(tbConfig.TrustedProxies()),
+		port:           tbConfig.Port(),
+		tbConfig:       tbConfig,
+		passwordPolicy: tbConfig.PasswordPolicy(),
 	}
+	server.wsUpgrader.CheckOrigin = server.origins.checkWsOrigin
 
+	var err error
+	if server.db, err = OpenDb(tbConfig, dbType, recreateDb); err != nil {
+		panic(err)
+	}
 	if dbType == InMemDB {
-		server.db = NewMemDb()
 		log.Println("using in memory DB")
-	} else if dbType == PsDB {
-		var err error
-		if server.db, err = NewPostgresDBClient(tbConfig, dbPassword, recreateDb); err != nil {
+	} else {
+		log.Println("using Postgres DB")
+	}
+
+	// email is a fallback for reminders not acked in time, and only if smtp is configured
+	var emailNotifier Notifier
+	if smtpConfig := tbConfig.Smtp(); len(smtpConfig.Host) > 0 {
+		if emailNotifier, err = NewEmailNotifier(smtpConfig); err != nil {
 			panic(err)
 		}
-		log.Println("using Postgres DB")
-	} else {
-		panic("unknown DB type")
+		log.Printf("email notifications via %s:%d", smtpConfig.Host, smtpConfig.Port)
 	}
 
-	if !server.db.DbOk() {
-		panic("DB connection not happy ...")
+	// instances sharing the DB route deliveries to each other, and only the leader scans
+	if server.cluster, err = NewCluster(server.db); err != nil {
+		panic(err)
 	}
+	log.Printf("server instance %s", server.cluster.InstanceId)
 
-	server.notificationManager = NewNotificationManager(server.db)
+	server.loginLimiter = NewLoginLimiter(tbConfig.LoginLimits(), server.db)
+	server.webhookDispatcher = NewWebhookDispatcher(server.db, nil, server.cluster.Leader)
+	server.notificationManager = NewNotificationManager(server.db, server.loginLimiter, server.webhookDispatcher, emailNotifier, notificationIntervals(tbConfig), server.cluster)
 
 	return server
 }
 
+func notificationIntervals(tbConfig *config.TBConfig) NotificationIntervals {
+	return NotificationIntervals{
+		FallbackAfter:      time.Duration(tbConfig.EmailFallbackMinutes()) * time.Minute,
+		RedeliveryAfter:    time.Duration(tbConfig.RedeliveryMinutes()) * time.Minute,
+		CommandNotifyAfter: time.Duration(tbConfig.CommandNotifySeconds()) * time.Second,
+	}
+}
+
+// Reload applies the settings which are safe to change while clients are connected: notification intervals,
+// login limits, allowed origins and trusted proxies. Changes to other settings are logged, they need a restart.
+func (s *Server) Reload(tbConfig *config.TBConfig) {
+	before, after := s.tbConfig.Config, tbConfig.Config
+
+	s.notificationManager.SetIntervals(notificationIntervals(tbConfig))
+	s.loginLimiter.SetLimits(tbConfig.LoginLimits())
+	s.origins.set(tbConfig.AllowedOrigins())
+	s.proxies.set(tbConfig.TrustedProxies())
+
+	restartNeeded := []struct {
+		setting string
+		changed bool
+	}{
+		{"env", s.tbConfig.Env != tbConfig.Env},
+		{"port", before.Port != after.Port},
+		{"db", before.DB != after.DB},
+		{"smtp", before.Smtp != after.Smtp},
+		{"password_policy", before.PasswordPolicy != after.PasswordPolicy},
+		{"login_limits.persist", before.LoginLimits.Persist != after.LoginLimits.Persist},
+	}
+	for _, r := range restartNeeded {
+		if r.changed {
+			log.Warnf("config reload: %s changed, it takes effect after a restart", r.setting)
+		}
+	}
+
+	s.tbConfig = tbConfig
+}
+
+// BootstrapAdmin creates the admin user, if there is no admin yet. An existing user with the same name and
+// password is made admin instead.
+func (s *Server) BootstrapAdmin(username string, password string) error {
+	admins, err := s.db.CountUsersWithRole(RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("cannot count admins: %w", err)
+	}
+	if admins > 0 {
+		log.Debugf("admin exists, not bootstrapping admin %s", username)
+		return nil
+	}
+
+	if len(password) == 0 {
+		return errors.New("admin password missing")
+	}
+	if err := ValidatePassword(s.passwordPolicy, password); err != nil {
+		return fmt.Errorf("admin password: %w", err)
+	}
+
+	user, err := s.db.GetUser(username)
+	if err == nil {
+		if user.PasswordHash != passwordHash(password) {
+			return fmt.Errorf("user %s exists with another password", username)
+		}
+	} else {
+		user = &User{
+			Username:     username,
+			PasswordHash: passwordHash(password),
+			Reminders:    []*Reminder{},
+		}
+	}
+
+	user.Role = RoleAdmin
+	if err := s.db.SaveUser(user); err != nil {
+		return fmt.Errorf("cannot save admin: %w", err)
+	}
+	log.Warnf("audit: bootstrapped admin user [%s]", username)
+
+	return nil
+}
+
 func (s *Server) Serve() {
 	router := s.routerSetup()
 
 	ipAndPort := fmt.Sprintf("%s:%d", "localhost", s.port)
 	httpServer := &http.Server{
-		Handler:      router,
+		Handler:      requestIdHandler(s.proxies.clientIpHandler(s.origins.corsHandler(router))),
 		Addr:         ipAndPort,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		WriteTimeout: httpWriteTimeout,
+		ReadTimeout:  httpReadTimeout,
 	}
 
 	chOsInterrupt := make(chan os.Signal, 1)
@@ -83,6 +188,10 @@ func (s *Server) Serve() {
 		s.notificationManager.Start()
 	}()
 
+	go func() {
+		s.webhookDispatcher.Start()
+	}()
+
 	select {
 	case <-chOsInterrupt:
 		log.Warn("os interrupt received!")
@@ -91,6 +200,9 @@ func (s *Server) Serve() {
 }
 
 func (s *Server) shutdown() {
+	if err := s.cluster.Close(); err != nil {
+		log.Errorf("failed to leave the cluster: %s", err.Error())
+	}
 	log.Debugf("shutting down DB ...")
 	if err := s.db.Close(); err != nil {
 		log.Errorf("failed to close DB connection: %s", err.Error())
@@ -108,27 +220,46 @@ func (s *Server) routerSetup() *mux.Router {
 	})
 
 	r.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
-		log.Debugf("new websocket client connecting: %s", r.RemoteAddr)
+		requestLog(r).Debugf("new websocket client connecting: %s", r.RemoteAddr)
 
 		c, err := s.wsUpgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Errorf("WS upgrade error: %s", err.Error())
+			requestLog(r).Errorf("WS upgrade error: %s", err.Error())
 			return
 		}
 
 		// pass client connection to notification manager
-		s.notificationManager.NewClient(c)
+		s.notificationManager.NewClient(r.Context(), c)
 	})
 
+	// kept for old checks, same as /health/live
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		sendSimpleResponse(w, "i'm fine <3")
 	})
 
+	// handle liveness and readiness checks
+	NewHealthHandler(s.db, s.notificationManager, r.PathPrefix("/health").Subrouter())
+
 	// handle register
-	NewUserHandler(s.db, r.PathPrefix("/user").Subrouter())
+	NewUserHandler(s.db, s.loginLimiter, s.notificationManager, s.passwordPolicy, r.PathPrefix("/user").Subrouter())
 
 	// handle remind
-	NewRemindHandler(s.db, r.PathPrefix("/remind").Subrouter())
+	NewRemindHandler(s.db, s.loginLimiter, s.notificationManager, r.PathPrefix("/remind").Subrouter())
+
+	// handle agents which cannot use websocket
+	NewAgentHandler(s.db, s.loginLimiter, s.notificationManager, r.PathPrefix("/agent").Subrouter())
+
+	// handle teams and team reminders
+	NewTeamHandler(s.db, s.loginLimiter, r.PathPrefix("/team").Subrouter())
+
+	// handle webhooks
+	NewWebhookHandler(s.db, s.loginLimiter, r.PathPrefix("/webhook").Subrouter())
+
+	// handle iCalendar feeds
+	NewFeedHandler(s.db, r.PathPrefix("/feed").Subrouter())
+
+	// handle admin endpoints
+	NewAdminHandler(s.db, s.loginLimiter, s.notificationManager, r.PathPrefix("/admin").Subrouter())
 
 	// middleware
 	r.Use(s.getLoggingMiddleware())
@@ -136,6 +267,58 @@ func (s *Server) routerSetup() *mux.Router {
 	return r
 }
 
+// headerAuthorizedUser checks the password hash sent in the Term-Buddy-Pass-Hash header against the user from
+// the {username} path variable, and writes an error response if it does not match
+func headerAuthorizedUser(db BuddyDb, limiter *LoginLimiter, w http.ResponseWriter, r *http.Request) (*User, bool) {
+	vars := mux.Vars(r)
+	return checkCredentials(db, limiter, w, r, vars["username"], r.Header.Get("Term-Buddy-Pass-Hash"))
+}
+
+// checkCredentials is the one place user credentials are checked for HTTP requests. Failures are counted by the
+// limiter, locked out usernames and IPs get 429 with Retry-After, and other failures get an error response.
+func checkCredentials(db BuddyDb, limiter *LoginLimiter, w http.ResponseWriter, r *http.Request, username string, passwordHash string) (*User, bool) {
+	if len(username) == 0 {
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing / cannot get user")
+		return nil, false
+	}
+
+	ip := limitedIp(r)
+	if retryAfter := limiter.Locked(username, ip); retryAfter > 0 {
+		requestLog(r).Warnf("audit: rejected locked out login of user [%s] from %s", username, clientIp(r))
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		sendSimpleErrResponse(w, http.StatusTooManyRequests, "too many failed logins, try again later")
+		return nil, false
+	}
+
+	user, err := db.GetUser(username)
+	if err != nil {
+		limiter.FailUnknownUser(ip)
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing / cannot get user")
+		return nil, false
+	}
+
+	if len(passwordHash) == 0 {
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "password hash missing")
+		return nil, false
+	}
+
+	if user.PasswordHash != passwordHash {
+		limiter.Fail(username, ip)
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong credentials")
+		return nil, false
+	}
+
+	limiter.Succeed(username)
+
+	if user.Disabled {
+		requestLog(r).Warnf("audit: rejected login of disabled user [%s] from %s", username, clientIp(r))
+		sendSimpleErrResponse(w, http.StatusForbidden, "account disabled")
+		return nil, false
+	}
+
+	return user, true
+}
+
 func sendResp(w http.ResponseWriter, statusCode int, response Response) {
 	w.WriteHeader(statusCode)
 	responseBytes, err := json.Marshal(response)
@@ -173,13 +356,3 @@ func sendSimpleBadRequestResponse(w http.ResponseWriter, message string) {
 		DataJsonBytes: nil,
 	})
 }
-
-func (s *Server) getLoggingMiddleware() func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userAgent := r.Header.Get("User-Agent")
-			log.Tracef(" ====> request [%s] path: [%s] [UA: %s]", r.Method, r.URL.Path, userAgent)
-			next.ServeHTTP(w, r)
-		})
-	}
-}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	TeamRoleOwner  = "owner"  // manages the team, its members and admins, and can delete the team
+	TeamRoleAdmin  = "admin"  // manages members and team reminders
+	TeamRoleMember = "member" // gets team reminders, creates them if the team allows it
+)
+
+// Team reminders go to the agents of all team members, each member acks them on their own
+type Team struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name" pg:",unique,notnull"`
+	// members can create team reminders, not only owners and admins
+	MembersCanRemind bool  `json:"members_can_remind" pg:"default:false"`
+	CreatedAt        int64 `json:"created_at" pg:",notnull"`
+}
+
+// TeamMember is a member of the team, or an invited user until the user accepts. Invited users get no team
+// reminders and cannot act as members.
+type TeamMember struct {
+	Id       int64  `json:"-"`
+	TeamId   int64  `json:"-" pg:",notnull"`
+	UserId   int64  `json:"-" pg:",notnull"`
+	Username string `json:"username" pg:"-"`
+	Role     string `json:"role" pg:",notnull"`
+	Invited  bool   `json:"invited,omitempty" pg:"default:false"`
+	JoinedAt int64  `json:"joined_at" pg:",notnull"` // when invited, until the invite is accepted
+}
+
+// TeamReminderAck is the ack of a team reminder by one member
+type TeamReminderAck struct {
+	Id         int64 `json:"-"`
+	ReminderId int64 `json:"-" pg:",notnull"`
+	UserId     int64 `json:"-" pg:",notnull"`
+	AckedAt    int64 `json:"acked_at" pg:",notnull"`
+}
+
+// UserTeam is a team as one of its members sees it
+type UserTeam struct {
+	*Team
+	Role    string `json:"role"`
+	Invited bool   `json:"invited,omitempty"` // the user has not accepted the invite yet
+}
+
+// TeamReminder is a team reminder as one of the members sees it
+type TeamReminder struct {
+	*Reminder
+	Ack bool `json:"ack"` // acked by the member
+}
+
+// TeamReminderMemberAck is the ack state of a team reminder for one member
+type TeamReminderMemberAck struct {
+	Username string `json:"username"`
+	Ack      bool   `json:"ack"`
+	AckedAt  int64  `json:"acked_at,omitempty"`
+}
+
+func validTeamRole(role string) bool {
+	return role == TeamRoleOwner || role == TeamRoleAdmin || role == TeamRoleMember
+}
+
+// CanManage reports whether the member can add and remove members and team reminders
+func (m *TeamMember) CanManage() bool {
+	return m.Role == TeamRoleOwner || m.Role == TeamRoleAdmin
+}
+
+// CanRemind reports whether the member can create team reminders
+func (t *Team) CanRemind(m *TeamMember) bool {
+	return m.CanManage() || t.MembersCanRemind
+}
+
+// ValidateTeamName checks team name length and characters, the same as for usernames
+func ValidateTeamName(name string) error {
+	if len(name) < minUsernameLength || len(name) > maxUsernameLength {
+		return fmt.Errorf("team name must have %d to %d characters", minUsernameLength, maxUsernameLength)
+	}
+	if !usernameRegexp.MatchString(name) {
+		return errors.New("team name can have only letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	}
+	return nil
+}
+
+// shareTeam reports whether the users are members of a common team, pending invites do not count
+func shareTeam(db BuddyDb, user *User, other *User) (bool, error) {
+	teams, err := db.GetUserTeams(user.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, team := range teams {
+		if team.Invited {
+			continue
+		}
+		member, err := db.GetTeamMember(team.Id, other.Id)
+		if err == nil && !member.Invited {
+			return true, nil
+		}
+		if err == nil {
+			continue
+		}
+		if err != errorNotTeamMember {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,671 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TeamHandler manages teams, their members and team reminders. The {username} of the path is the authorized user,
+// acting as a member of {team}.
+type TeamHandler struct {
+	db      BuddyDb
+	limiter *LoginLimiter
+	router  *mux.Router
+}
+
+func NewTeamHandler(db BuddyDb, limiter *LoginLimiter, teamRouter *mux.Router) {
+	handler := &TeamHandler{
+		db:      db,
+		limiter: limiter,
+		router:  teamRouter,
+	}
+
+	teamRouter.HandleFunc("/{username}", handler.handleList).Methods("GET")
+	teamRouter.HandleFunc("/{username}", handler.handleNew).Methods("POST")
+	teamRouter.HandleFunc("/{username}/{team}", handler.handleUpdate).Methods("PUT")
+	teamRouter.HandleFunc("/{username}/{team}", handler.handleDelete).Methods("DELETE")
+	teamRouter.HandleFunc("/{username}/{team}/accept", handler.handleAcceptInvite).Methods("POST")
+	teamRouter.HandleFunc("/{username}/{team}/decline", handler.handleDeclineInvite).Methods("POST")
+	teamRouter.HandleFunc("/{username}/{team}/members", handler.handleMembers).Methods("GET")
+	teamRouter.HandleFunc("/{username}/{team}/members", handler.handleSaveMember).Methods("POST")
+	teamRouter.HandleFunc("/{username}/{team}/members/{member}", handler.handleRemoveMember).Methods("DELETE")
+	teamRouter.HandleFunc("/{username}/{team}/reminders", handler.handleReminders).Methods("GET")
+	teamRouter.HandleFunc("/{username}/{team}/reminders", handler.handleNewReminder).Methods("POST")
+	teamRouter.HandleFunc("/{username}/{team}/reminders/{id:[0-9]+}", handler.handleDeleteReminder).Methods("DELETE")
+	teamRouter.HandleFunc("/{username}/{team}/reminders/{id:[0-9]+}/acks", handler.handleAcks).Methods("GET")
+}
+
+// teamMember is the {team} of the path with the membership of the user. Teams of others are not found, so their
+// names do not leak, the same for teams the user is only invited to.
+func (handler *TeamHandler) teamMember(db BuddyDb, w http.ResponseWriter, r *http.Request, user *User) (*Team, *TeamMember, bool) {
+	return handler.teamMembership(db, w, r, user, false)
+}
+
+// teamInvite is the {team} of the path with the pending invite of the user
+func (handler *TeamHandler) teamInvite(db BuddyDb, w http.ResponseWriter, r *http.Request, user *User) (*Team, *TeamMember, bool) {
+	return handler.teamMembership(db, w, r, user, true)
+}
+
+func (handler *TeamHandler) teamMembership(db BuddyDb, w http.ResponseWriter, r *http.Request, user *User, invited bool) (*Team, *TeamMember, bool) {
+	team, err := db.GetTeam(mux.Vars(r)["team"])
+	var member *TeamMember
+	if err == nil {
+		member, err = db.GetTeamMember(team.Id, user.Id)
+	}
+	if err == nil && member.Invited != invited {
+		err = errorNotTeamMember
+	}
+	if err == errorTeamNotFound || err == errorNotTeamMember {
+		if invited {
+			sendSimpleErrResponse(w, http.StatusNotFound, "invite not found")
+			return nil, nil, false
+		}
+		sendSimpleErrResponse(w, http.StatusNotFound, "team not found")
+		return nil, nil, false
+	}
+	if err != nil {
+		requestLog(r).Errorf("error getting team [%s] of user [%s]: %s", mux.Vars(r)["team"], user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get team")
+		return nil, nil, false
+	}
+	return team, member, true
+}
+
+// lastOwner reports whether the member is the only owner of the team, a team always keeps one. Invited owners do not
+// count until they accept.
+func lastOwner(db BuddyDb, member *TeamMember) (bool, error) {
+	if member.Role != TeamRoleOwner || member.Invited {
+		return false, nil
+	}
+	members, err := db.GetTeamMembers(member.TeamId)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		if m.Role == TeamRoleOwner && !m.Invited && m.UserId != member.UserId {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (handler *TeamHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	teams, err := db.GetUserTeams(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] teams: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get teams")
+		return
+	}
+	if teams == nil {
+		teams = []*UserTeam{}
+	}
+
+	teamsJsonBytes, err := json.Marshal(teams)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] teams: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: teamsJsonBytes,
+	})
+}
+
+// handleNew creates the team, the user becomes its owner
+func (handler *TeamHandler) handleNew(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	name := r.FormValue("name")
+	if err := ValidateTeamName(name); err != nil {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
+
+	team := &Team{
+		Name:             name,
+		MembersCanRemind: r.FormValue("members_can_remind") == "true",
+		CreatedAt:        time.Now().Unix(),
+	}
+	if err := db.SaveTeam(team); err != nil {
+		if err == errorTeamNameTaken {
+			sendSimpleErrResponse(w, http.StatusConflict, "team name taken")
+			return
+		}
+		requestLog(r).Errorf("error saving team [%s] of user [%s]: %s", name, user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save team")
+		return
+	}
+
+	owner := &TeamMember{TeamId: team.Id, UserId: user.Id, Role: TeamRoleOwner, JoinedAt: team.CreatedAt}
+	if err := db.SaveTeamMember(owner); err != nil {
+		requestLog(r).Errorf("error saving owner [%s] of team [%s]: %s", user.Username, name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save team")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] created team [%s]", user.Username, name)
+
+	teamJsonBytes, err := json.Marshal(UserTeam{Team: team, Role: owner.Role})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling team [%s]: %s", name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "added",
+		DataJsonBytes: teamJsonBytes,
+	})
+}
+
+// handleUpdate changes who can create team reminders, owners and admins only
+func (handler *TeamHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+	if !member.CanManage() {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners and admins can change the team")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	membersCanRemind, err := strconv.ParseBool(r.FormValue("members_can_remind"))
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "members_can_remind value invalid")
+		return
+	}
+
+	team.MembersCanRemind = membersCanRemind
+	if err := db.SaveTeam(team); err != nil {
+		requestLog(r).Errorf("error saving team [%s]: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save team")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] set team [%s] members_can_remind: %t", user.Username, team.Name, membersCanRemind)
+
+	sendSimpleResponse(w, "updated")
+}
+
+// handleDelete removes the team with its reminders, owners only
+func (handler *TeamHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+	if member.Role != TeamRoleOwner {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners can delete the team")
+		return
+	}
+
+	if err := db.DeleteTeam(team.Id); err != nil {
+		requestLog(r).Errorf("error deleting team [%s]: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot delete team")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] deleted team [%s]", user.Username, team.Name)
+
+	sendSimpleResponse(w, "deleted")
+}
+
+func (handler *TeamHandler) handleMembers(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, _, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	members, err := db.GetTeamMembers(team.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting team [%s] members: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get members")
+		return
+	}
+
+	membersJsonBytes, err := json.Marshal(members)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling team [%s] members: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: membersJsonBytes,
+	})
+}
+
+// handleSaveMember invites the user or changes the role of a member or invited user. Invited users become members
+// when they accept. Owners and admins manage members and admins, only owners manage owners.
+func (handler *TeamHandler) handleSaveMember(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+	if !member.CanManage() {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners and admins can manage members")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	role := r.FormValue("role")
+	if len(role) == 0 {
+		role = TeamRoleMember
+	}
+	if !validTeamRole(role) {
+		sendSimpleBadRequestResponse(w, "role invalid")
+		return
+	}
+
+	memberUser, err := db.GetUser(r.FormValue("member"))
+	if err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	existing, err := db.GetTeamMember(team.Id, memberUser.Id)
+	if err != nil && err != errorNotTeamMember {
+		requestLog(r).Errorf("error getting team [%s] member [%s]: %s", team.Name, memberUser.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get member")
+		return
+	}
+	ownerChange := role == TeamRoleOwner || (existing != nil && existing.Role == TeamRoleOwner)
+	if ownerChange && member.Role != TeamRoleOwner {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners can manage owners")
+		return
+	}
+	if existing != nil && role != TeamRoleOwner {
+		last, err := lastOwner(db, existing)
+		if err != nil {
+			requestLog(r).Errorf("error getting team [%s] owners: %s", team.Name, err.Error())
+			sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get members")
+			return
+		}
+		if last {
+			sendSimpleBadRequestResponse(w, "the team needs another owner first")
+			return
+		}
+	}
+
+	saved := &TeamMember{
+		TeamId:   team.Id,
+		UserId:   memberUser.Id,
+		Role:     role,
+		Invited:  existing == nil || existing.Invited,
+		JoinedAt: time.Now().Unix(),
+	}
+	if existing != nil {
+		saved.JoinedAt = existing.JoinedAt
+	}
+	if err := db.SaveTeamMember(saved); err != nil {
+		requestLog(r).Errorf("error saving team [%s] member [%s]: %s", team.Name, memberUser.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save member")
+		return
+	}
+	if existing == nil {
+		requestLog(r).Warnf("audit: user [%s] invited user [%s] as %s of team [%s]", user.Username, memberUser.Username, role, team.Name)
+		sendSimpleResponse(w, "invited")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] made user [%s] %s of team [%s]", user.Username, memberUser.Username, role, team.Name)
+
+	sendSimpleResponse(w, "saved")
+}
+
+// handleAcceptInvite makes the user a member of the team it was invited to, with the role of the invite
+func (handler *TeamHandler) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, invite, ok := handler.teamInvite(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	invite.Invited = false
+	invite.JoinedAt = time.Now().Unix()
+	if err := db.SaveTeamMember(invite); err != nil {
+		requestLog(r).Errorf("error saving team [%s] member [%s]: %s", team.Name, user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save member")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] joined team [%s] as %s", user.Username, team.Name, invite.Role)
+
+	sendSimpleResponse(w, "accepted")
+}
+
+// handleDeclineInvite removes the invite of the user to the team
+func (handler *TeamHandler) handleDeclineInvite(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, _, ok := handler.teamInvite(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteTeamMember(team.Id, user.Id); err != nil {
+		requestLog(r).Errorf("error removing team [%s] invite of [%s]: %s", team.Name, user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot decline invite")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] declined the invite to team [%s]", user.Username, team.Name)
+
+	sendSimpleResponse(w, "declined")
+}
+
+// handleRemoveMember removes the member from the team, members can leave on their own
+func (handler *TeamHandler) handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	memberUser, err := db.GetUser(mux.Vars(r)["member"])
+	var removed *TeamMember
+	if err == nil {
+		removed, err = db.GetTeamMember(team.Id, memberUser.Id)
+	}
+	if err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "member not found")
+		return
+	}
+
+	if removed.UserId != user.Id {
+		if !member.CanManage() {
+			sendSimpleErrResponse(w, http.StatusForbidden, "only team owners and admins can remove members")
+			return
+		}
+		if removed.Role == TeamRoleOwner && member.Role != TeamRoleOwner {
+			sendSimpleErrResponse(w, http.StatusForbidden, "only team owners can manage owners")
+			return
+		}
+	}
+	last, err := lastOwner(db, removed)
+	if err != nil {
+		requestLog(r).Errorf("error getting team [%s] owners: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get members")
+		return
+	}
+	if last {
+		sendSimpleBadRequestResponse(w, "the team needs another owner first")
+		return
+	}
+
+	if err := db.DeleteTeamMember(team.Id, removed.UserId); err != nil {
+		requestLog(r).Errorf("error removing team [%s] member [%s]: %s", team.Name, memberUser.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot remove member")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] removed user [%s] from team [%s]", user.Username, memberUser.Username, team.Name)
+
+	sendSimpleResponse(w, "removed")
+}
+
+// handleReminders lists the team reminders, acked if the user acked them
+func (handler *TeamHandler) handleReminders(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, _, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	memberReminders, err := db.GetMemberTeamReminders(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting team [%s] reminders: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get reminders")
+		return
+	}
+
+	reminders := []*TeamReminder{}
+	for _, reminder := range memberReminders {
+		if reminder.TeamId == team.Id {
+			reminders = append(reminders, &TeamReminder{Reminder: reminder, Ack: reminder.Ack})
+		}
+	}
+
+	remindersJsonBytes, err := json.Marshal(reminders)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling team [%s] reminders: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: remindersJsonBytes,
+	})
+}
+
+// handleNewReminder adds a reminder for all members, the scan sends it to each of them when due
+func (handler *TeamHandler) handleNewReminder(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+	if !team.CanRemind(member) {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners and admins can add team reminders")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	message := r.FormValue("message")
+	dueDate, err := strconv.ParseInt(r.FormValue("due_date"), 10, 64)
+	if len(message) == 0 || err != nil {
+		sendSimpleBadRequestResponse(w, "wrong arguments")
+		return
+	}
+
+	priority := r.FormValue("priority")
+	if priority != "" && priority != PriorityNormal && priority != PriorityHigh {
+		sendSimpleBadRequestResponse(w, "priority invalid")
+		return
+	}
+
+	reminder := &Reminder{
+		Message:   message,
+		DueDate:   dueDate,
+		Tags:      ParseTags(r.FormValue("tags")),
+		Priority:  priority,
+		TeamId:    team.Id,
+		CreatedBy: user.Id,
+	}
+	if err := db.NewTeamReminder(reminder); err != nil {
+		requestLog(r).Errorf("failed to insert new reminder for team %s: %s", team.Name, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save reminder")
+		return
+	}
+	requestLog(r).Debugf("new reminder %d added for team %s by %s", reminder.Id, team.Name, user.Username)
+
+	reminder.Team = team.Name
+	reminderJsonBytes, err := json.Marshal(reminder)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling reminder [%d]: %s", reminder.Id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "added",
+		DataJsonBytes: reminderJsonBytes,
+	})
+}
+
+// handleDeleteReminder removes the team reminder for all members, owners and admins or its creator only
+func (handler *TeamHandler) handleDeleteReminder(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, member, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id value invalid")
+		return
+	}
+
+	reminder, err := db.GetTeamReminder(team.Id, id)
+	if err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !member.CanManage() && reminder.CreatedBy != user.Id {
+		sendSimpleErrResponse(w, http.StatusForbidden, "only team owners and admins can delete reminders of others")
+		return
+	}
+
+	if err := db.DeleteTeamReminder(team.Id, id); err != nil {
+		requestLog(r).Errorf("error deleting team [%s] reminder %d: %s", team.Name, id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot delete reminder")
+		return
+	}
+
+	sendSimpleResponse(w, "deleted")
+}
+
+// handleAcks shows which members acked the team reminder
+func (handler *TeamHandler) handleAcks(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+	team, _, ok := handler.teamMember(db, w, r, user)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id value invalid")
+		return
+	}
+
+	if _, err := db.GetTeamReminder(team.Id, id); err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	members, err := db.GetTeamMembers(team.Id)
+	var acks []*TeamReminderAck
+	if err == nil {
+		acks, err = db.GetTeamReminderAcks(id)
+	}
+	if err != nil {
+		requestLog(r).Errorf("error getting team [%s] reminder %d acks: %s", team.Name, id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get acks")
+		return
+	}
+
+	// members who left do not count anymore, invited users not yet
+	memberAcks := []*TeamReminderMemberAck{}
+	for _, m := range members {
+		if m.Invited {
+			continue
+		}
+		memberAck := &TeamReminderMemberAck{Username: m.Username}
+		for _, ack := range acks {
+			if ack.UserId == m.UserId {
+				memberAck.Ack = true
+				memberAck.AckedAt = ack.AckedAt
+			}
+		}
+		memberAcks = append(memberAcks, memberAck)
+	}
+
+	acksJsonBytes, err := json.Marshal(memberAcks)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling team [%s] reminder %d acks: %s", team.Name, id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: acksJsonBytes,
+	})
+}
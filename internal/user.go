@@ -1,11 +1,63 @@
 package internal
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	Id           int64       `json:"-"`
-	Username     string      `json:"username" pg:",unique,notnull"`
-	PasswordHash string      `json:"-"`
-	Reminders    []*Reminder `json:"reminders" pg:"-"`
-	// TODO: maybe add email address and a requirement to verify
+	Id           int64              `json:"-"`
+	Username     string             `json:"username" pg:",unique,notnull"`
+	PasswordHash string             `json:"-"`
+	Reminders    []*Reminder        `json:"reminders" pg:"-"`
+	FeedToken    string             `json:"-"` // secret token of the user iCalendar feed, empty if the feed is disabled
+	Email        string             `json:"email,omitempty"`
+	Timezone     string             `json:"timezone,omitempty"` // IANA name, quiet hours are in this timezone
+	QuietHours   []QuietHoursWindow `json:"quiet_hours"`
+	Dnd          bool               `json:"dnd" pg:"default:false"` // do not disturb, set by agent
+	DigestTime   string             `json:"digest_time,omitempty"`  // HH:MM in user timezone, empty if the daily digest is off
+	LastDigestAt int64              `json:"-"`
+	// TOTP second factor, asked for at login once enabled. The secret is set when enrollment starts.
+	TotpSecret    string   `json:"-"`
+	TotpEnabled   bool     `json:"totp_enabled" pg:"default:false"`
+	TotpLastStep  int64    `json:"-"`             // step of the last accepted code, codes work only once
+	RecoveryCodes []string `json:"-" pg:",array"` // sha256 hashes of unused recovery codes
+	Role          string   `json:"role" pg:"default:'user'"`
+	Disabled      bool     `json:"disabled" pg:"default:false"` // disabled users cannot log in or get notifications
+}
+
+// UserSummary is how admins see users
+type UserSummary struct {
+	Id          int64  `json:"id"`
+	Username    string `json:"username"`
+	Email       string `json:"email,omitempty"`
+	Role        string `json:"role"`
+	Disabled    bool   `json:"disabled"`
+	TotpEnabled bool   `json:"totp_enabled"`
+}
+
+type UsersPage struct {
+	Users      []*UserSummary `json:"users"`
+	NextCursor int64          `json:"next_cursor"` // 0 when there are no more users
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+func (u *User) Summary() *UserSummary {
+	return &UserSummary{
+		Id:          u.Id,
+		Username:    u.Username,
+		Email:       u.Email,
+		Role:        u.Role,
+		Disabled:    u.Disabled,
+		TotpEnabled: u.TotpEnabled,
+	}
+}
+
+type FeedInfo struct {
+	Path string `json:"path"`
 }
 
 func (u *User) GetReminder(id int64) *Reminder {
@@ -2,55 +2,106 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/mail"
+	"time"
+
+	"TerminalBuddyServer/config"
 
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
 )
 
 type UserHandler struct {
-	db     BuddyDb
-	router *mux.Router
+	db             BuddyDb
+	limiter        *LoginLimiter
+	nm             *NotificationManager
+	passwordPolicy config.PasswordPolicy
+	router         *mux.Router
 }
 
-func NewUserHandler(db BuddyDb, userRouter *mux.Router) {
+func NewUserHandler(db BuddyDb, limiter *LoginLimiter, nm *NotificationManager, passwordPolicy config.PasswordPolicy, userRouter *mux.Router) {
 	handler := &UserHandler{
-		db:     db,
-		router: userRouter,
+		db:             db,
+		limiter:        limiter,
+		nm:             nm,
+		passwordPolicy: passwordPolicy,
+		router:         userRouter,
 	}
 
 	userRouter.HandleFunc("/login", handler.handleLogin).Methods("POST")
 	userRouter.HandleFunc("/register", handler.handleRegister).Methods("POST")
+	userRouter.HandleFunc("/password", handler.handleChangePassword).Methods("POST")
+	userRouter.HandleFunc("/rename", handler.handleRename).Methods("POST")
+	userRouter.HandleFunc("/delete", handler.handleDelete).Methods("POST")
+	userRouter.HandleFunc("/totp/enroll", handler.handleTotpEnroll).Methods("POST")
+	userRouter.HandleFunc("/totp/confirm", handler.handleTotpConfirm).Methods("POST")
+	userRouter.HandleFunc("/totp/disable", handler.handleTotpDisable).Methods("POST")
+	userRouter.HandleFunc("/totp/recovery-codes", handler.handleTotpRecoveryCodes).Methods("POST")
+	userRouter.HandleFunc("/device/code", handler.handleDeviceCode).Methods("POST")
+	userRouter.HandleFunc("/device/approve", handler.handleDeviceApprovePage).Methods("GET")
+	userRouter.HandleFunc("/device/approve", handler.handleDeviceApprove).Methods("POST")
+	userRouter.HandleFunc("/device/token", handler.handleDeviceToken).Methods("POST")
+	userRouter.HandleFunc("/device/tokens", handler.handleDeviceTokens).Methods("POST")
+	userRouter.HandleFunc("/device/revoke", handler.handleDeviceRevoke).Methods("POST")
+	userRouter.HandleFunc("/feed/rotate", handler.handleFeedRotate).Methods("POST")
+	userRouter.HandleFunc("/feed/revoke", handler.handleFeedRevoke).Methods("POST")
+	userRouter.HandleFunc("/email", handler.handleEmail).Methods("POST")
+	userRouter.HandleFunc("/quiet-hours", handler.handleQuietHours).Methods("POST")
+	userRouter.HandleFunc("/digest", handler.handleDigest).Methods("POST")
 }
 
-func (handler *UserHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+// authorizedUser checks the username and password_hash form values, and writes an error response if they do not match
+func (handler *UserHandler) authorizedUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
 	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
-		return
+		return nil, false
 	}
 
-	username := r.FormValue("username")
-	user, err := handler.db.GetUser(username)
-	if len(username) == 0 || err != nil {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "username missing / cannot get user")
-		return
+	return checkCredentials(handler.db.WithContext(r.Context()), handler.limiter, w, r, r.FormValue("username"), formPasswordHash(r))
+}
+
+// formPasswordHash is the password_hash form value, or the hash of the password value sent by browser forms, like
+// the device approval page
+func formPasswordHash(r *http.Request) string {
+	if hash := r.FormValue("password_hash"); len(hash) > 0 {
+		return hash
 	}
+	if password := r.FormValue("password"); len(password) > 0 {
+		return passwordHash(password)
+	}
+	return ""
+}
 
-	passwordHash := r.FormValue("password_hash")
-	if len(passwordHash) == 0 {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "password hash missing")
+// secondFactorUser is authorizedUser, also checking the second factor if the user enabled TOTP. Account changes
+// need it, the password alone must not be enough for them.
+func (handler *UserHandler) secondFactorUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user.TotpEnabled && !verifySecondFactor(handler.db.WithContext(r.Context()), handler.limiter, w, r, user) {
+		return nil, false
+	}
+	return user, true
+}
+
+// handleLogin checks the credentials, and the totp_code or recovery_code form value if the user enabled TOTP.
+// Agents authenticating on their own (websocket, headers) are not asked for the second factor.
+func (handler *UserHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	if user.PasswordHash != passwordHash {
-		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong credentials")
+	if user.TotpEnabled && !verifySecondFactor(handler.db.WithContext(r.Context()), handler.limiter, w, r, user) {
 		return
 	}
 
 	userJsonBytes, err := json.Marshal(user)
 	if err != nil {
-		log.Errorf("error marshaling user [%s]: %s", user.Username, err.Error())
+		requestLog(r).Errorf("error marshaling user [%s]: %s", user.Username, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
 		return
 	}
@@ -62,9 +113,52 @@ func (handler *UserHandler) handleLogin(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// verifySecondFactor checks the totp_code, or else the recovery_code form value, and writes an error response if
+// neither matches. The code is marked used in the DB, only its columns are written, so it works once even for
+// concurrent requests. A used recovery code is removed.
+func verifySecondFactor(db BuddyDb, limiter *LoginLimiter, w http.ResponseWriter, r *http.Request, user *User) bool {
+	totpCode := r.FormValue("totp_code")
+	recoveryCode := r.FormValue("recovery_code")
+	if len(totpCode) == 0 && len(recoveryCode) == 0 {
+		sendSimpleErrResponse(w, http.StatusUnauthorized, "totp code required")
+		return false
+	}
+
+	verified := false
+	var err error
+	if len(totpCode) > 0 {
+		var step int64
+		if step, verified = verifyTotp(user.TotpSecret, totpCode, time.Now(), user.TotpLastStep); verified {
+			if verified, err = db.UseTotpStep(user.Id, step); verified {
+				user.TotpLastStep = step
+			}
+		}
+	} else if verified = user.useRecoveryCode(recoveryCode); verified {
+		if verified, err = db.UseRecoveryCode(user.Id, recoveryCodeHash(recoveryCode)); verified {
+			requestLog(r).Warnf("audit: user [%s] used a recovery code, %d left", user.Username, len(user.RecoveryCodes))
+		}
+	}
+
+	if err != nil {
+		requestLog(r).Errorf("error saving second factor use of user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot verify totp code")
+		return false
+	}
+	if !verified {
+		limiter.FailSecondFactor(user.Username, limitedIp(r))
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong totp code")
+		return false
+	}
+	limiter.SucceedSecondFactor(user.Username)
+
+	return true
+}
+
+// handleRegister creates the user. The password is sent either as password (checked against the password policy,
+// and hashed here) or, if there is no policy, already hashed as password_hash.
 func (handler *UserHandler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		log.Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
 		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
 		return
 	}
@@ -74,10 +168,14 @@ func (handler *UserHandler) handleRegister(w http.ResponseWriter, r *http.Reques
 		sendSimpleBadRequestResponse(w, "username missing")
 		return
 	}
+	if err := ValidateUsername(username); err != nil {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
 
-	passwordHash := r.FormValue("password_hash")
-	if len(passwordHash) == 0 {
-		sendSimpleBadRequestResponse(w, "password hash missing")
+	passwordHash, err := checkedPasswordHash(handler.passwordPolicy, r.FormValue("password"), r.FormValue("password_hash"))
+	if err != nil {
+		sendSimpleBadRequestResponse(w, err.Error())
 		return
 	}
 
@@ -85,12 +183,403 @@ func (handler *UserHandler) handleRegister(w http.ResponseWriter, r *http.Reques
 		Username:     username,
 		PasswordHash: passwordHash,
 		Reminders:    []*Reminder{},
+		Role:         RoleUser,
 	}
 
-	if err := handler.db.SaveUser(user); err == nil {
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		if err == errorUsernameTaken {
+			sendSimpleErrResponse(w, http.StatusConflict, "username taken")
+			return
+		}
+		requestLog(r).Errorf("error saving new user [%s]: %s", username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot register user")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleChangePassword sets the new password, given as new_password or new_password_hash like on registration.
+// Connected agents are disconnected and have to log in again.
+func (handler *UserHandler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	newPasswordHash, err := checkedPasswordHash(handler.passwordPolicy, r.FormValue("new_password"), r.FormValue("new_password_hash"))
+	if err != nil {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
+
+	oldPasswordHash := user.PasswordHash
+	user.PasswordHash = newPasswordHash
+	if err := db.SaveUser(user); err != nil {
+		user.PasswordHash = oldPasswordHash
+		requestLog(r).Errorf("error saving password for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot change password")
+		return
+	}
+
+	// the password is the root of all sessions, device tokens issued with the old one go too
+	if err := db.DeleteDeviceTokens(user.Id); err != nil {
+		requestLog(r).Errorf("error revoking device tokens of user [%s]: %s", user.Username, err.Error())
+	}
+	handler.nm.DisconnectUser(user.Username)
+	requestLog(r).Infof("user [%s] changed password", user.Username)
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleRename changes the username, connected agents are disconnected and have to log in with the new one
+func (handler *UserHandler) handleRename(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	newUsername := r.FormValue("new_username")
+	if len(newUsername) == 0 {
+		sendSimpleBadRequestResponse(w, "new username missing")
+		return
+	}
+	if newUsername == user.Username {
 		sendSimpleResponse(w, "ok")
-	} else {
-		log.Errorf("error saving new user: %s", err.Error())
-		sendSimpleErrResponse(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	if err := ValidateUsername(newUsername); err != nil {
+		sendSimpleBadRequestResponse(w, err.Error())
+		return
+	}
+
+	oldUsername := user.Username
+	user.Username = newUsername
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		user.Username = oldUsername
+		if err == errorUsernameTaken {
+			sendSimpleErrResponse(w, http.StatusConflict, "username taken")
+			return
+		}
+		requestLog(r).Errorf("error renaming user [%s]: %s", oldUsername, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot rename user")
+		return
+	}
+
+	handler.nm.DisconnectUser(oldUsername)
+	requestLog(r).Infof("user [%s] renamed to [%s]", oldUsername, newUsername)
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleDelete removes the account with all its reminders, webhooks and history, and disconnects its agents
+func (handler *UserHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := handler.db.WithContext(r.Context()).DeleteUser(user.Id); err != nil {
+		requestLog(r).Errorf("error deleting user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot delete user")
+		return
+	}
+
+	handler.nm.DisconnectUser(user.Username)
+	requestLog(r).Infof("user [%s] deleted", user.Username)
+
+	sendSimpleResponse(w, "deleted")
+}
+
+// handleFeedRotate creates a new feed token for the user, the old feed URL stops working. The token reads all
+// reminders, so the second factor is required if the user enabled TOTP.
+func (handler *UserHandler) handleFeedRotate(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	feedToken, err := newRandomToken()
+	if err != nil {
+		requestLog(r).Errorf("error generating feed token for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "token error")
+		return
+	}
+
+	user.FeedToken = feedToken
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving feed token for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save feed token")
+		return
+	}
+
+	feedJsonBytes, err := json.Marshal(FeedInfo{Path: feedPath(feedToken)})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling feed info for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: feedJsonBytes,
+	})
+}
+
+func (handler *UserHandler) handleFeedRevoke(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	user.FeedToken = ""
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error revoking feed token for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot revoke feed token")
+		return
+	}
+
+	sendSimpleResponse(w, "revoked")
+}
+
+// handleEmail sets the address used for email notifications, empty email removes it
+func (handler *UserHandler) handleEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.secondFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	email := r.FormValue("email")
+	if len(email) > 0 {
+		// only plain addresses, it ends up in mail headers
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			sendSimpleBadRequestResponse(w, "email invalid")
+			return
+		}
+	}
+
+	user.Email = email
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving email for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save email")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleQuietHours sets user timezone and quiet hours windows, given as json array, empty array removes them
+func (handler *UserHandler) handleQuietHours(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	timezone := r.FormValue("timezone")
+	if len(timezone) > 0 {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			sendSimpleBadRequestResponse(w, "timezone invalid")
+			return
+		}
+	}
+
+	var windows []QuietHoursWindow
+	if windowsJson := r.FormValue("windows"); len(windowsJson) > 0 {
+		if err := json.Unmarshal([]byte(windowsJson), &windows); err != nil {
+			sendSimpleBadRequestResponse(w, "windows invalid")
+			return
+		}
+	}
+	for i, window := range windows {
+		if err := window.Validate(); err != nil {
+			sendSimpleBadRequestResponse(w, fmt.Sprintf("window %d invalid: %s", i, err))
+			return
+		}
+	}
+
+	user.Timezone = timezone
+	user.QuietHours = windows
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving quiet hours for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save quiet hours")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleDigest sets the time of the daily digest, HH:MM in user timezone, empty time turns the digest off
+func (handler *UserHandler) handleDigest(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	digestTime := r.FormValue("time")
+	if len(digestTime) > 0 {
+		if _, err := minuteOfDay(digestTime); err != nil {
+			sendSimpleBadRequestResponse(w, "time invalid, use HH:MM")
+			return
+		}
+	}
+
+	user.DigestTime = digestTime
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving digest time for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save digest time")
+		return
+	}
+
+	sendSimpleResponse(w, "ok")
+}
+
+// handleTotpEnroll starts TOTP enrollment with a new secret, TOTP is enabled only after handleTotpConfirm
+func (handler *UserHandler) handleTotpEnroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TotpEnabled {
+		sendSimpleErrResponse(w, http.StatusConflict, "totp already enabled")
+		return
+	}
+
+	secret, err := newTotpSecret()
+	if err != nil {
+		requestLog(r).Errorf("error creating totp secret for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create totp secret")
+		return
+	}
+
+	user.TotpSecret = secret
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving totp secret for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save totp secret")
+		return
+	}
+
+	enrollmentJsonBytes, err := json.Marshal(TotpEnrollment{
+		Secret: secret,
+		Uri:    totpUri(user.Username, secret),
+	})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling totp enrollment for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: enrollmentJsonBytes,
+	})
+}
+
+// handleTotpConfirm enables TOTP when the code from the authenticator matches, and returns the recovery codes
+func (handler *UserHandler) handleTotpConfirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TotpEnabled {
+		sendSimpleErrResponse(w, http.StatusConflict, "totp already enabled")
+		return
+	}
+	if len(user.TotpSecret) == 0 {
+		sendSimpleBadRequestResponse(w, "totp enrollment not started")
+		return
+	}
+
+	step, verified := verifyTotp(user.TotpSecret, r.FormValue("totp_code"), time.Now(), 0)
+	if !verified {
+		handler.limiter.FailSecondFactor(user.Username, limitedIp(r))
+		sendSimpleErrResponse(w, http.StatusNotAcceptable, "wrong totp code")
+		return
+	}
+
+	user.TotpEnabled = true
+	user.TotpLastStep = step
+	handler.sendNewRecoveryCodes(w, r, user)
+	requestLog(r).Warnf("audit: user [%s] enabled totp", user.Username)
+}
+
+// handleTotpRecoveryCodes replaces the recovery codes, the second factor is required
+func (handler *UserHandler) handleTotpRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.TotpEnabled {
+		sendSimpleBadRequestResponse(w, "totp not enabled")
+		return
+	}
+	if !verifySecondFactor(handler.db.WithContext(r.Context()), handler.limiter, w, r, user) {
+		return
+	}
+
+	handler.sendNewRecoveryCodes(w, r, user)
+}
+
+// sendNewRecoveryCodes saves the user with new recovery codes, and sends them. They are not shown again.
+func (handler *UserHandler) sendNewRecoveryCodes(w http.ResponseWriter, r *http.Request, user *User) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		requestLog(r).Errorf("error creating recovery codes for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot create recovery codes")
+		return
+	}
+
+	user.RecoveryCodes = hashes
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error saving totp for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save totp")
+		return
+	}
+
+	codesJsonBytes, err := json.Marshal(RecoveryCodes{Codes: codes})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling recovery codes for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: codesJsonBytes,
+	})
+}
+
+// handleTotpDisable turns TOTP off, the second factor is required
+func (handler *UserHandler) handleTotpDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := handler.authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.TotpEnabled {
+		sendSimpleBadRequestResponse(w, "totp not enabled")
+		return
+	}
+	if !verifySecondFactor(handler.db.WithContext(r.Context()), handler.limiter, w, r, user) {
+		return
+	}
+
+	user.TotpEnabled = false
+	user.TotpSecret = ""
+	user.TotpLastStep = 0
+	user.RecoveryCodes = nil
+	if err := handler.db.WithContext(r.Context()).SaveUser(user); err != nil {
+		requestLog(r).Errorf("error disabling totp for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot disable totp")
+		return
+	}
+	requestLog(r).Warnf("audit: user [%s] disabled totp", user.Username)
+
+	sendSimpleResponse(w, "ok")
 }
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	WebhookEventReminderDue     = "reminder.due"
+	WebhookEventReminderAcked   = "reminder.acked"
+	WebhookEventReminderSnoozed = "reminder.snoozed"
+	WebhookEventCommandFinished = "command.finished"
+)
+
+var webhookEvents = []string{
+	WebhookEventReminderDue,
+	WebhookEventReminderAcked,
+	WebhookEventReminderSnoozed,
+	WebhookEventCommandFinished,
+}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+const (
+	webhookMaxAttempts     = 8
+	webhookRetryBaseDelay  = 30 * time.Second
+	webhookRetryMaxDelay   = time.Hour
+	webhookScanPeriod      = 5 * time.Second
+	webhookDeliveryTimeout = 10 * time.Second
+	webhookScanBatchSize   = 100
+)
+
+type Webhook struct {
+	Id     int64    `json:"id"`
+	UserId int64    `json:"-" pg:",notnull"`
+	Url    string   `json:"url" pg:",notnull"`
+	Secret string   `json:"-" pg:",notnull"`
+	Events []string `json:"events" pg:",array"`
+}
+
+func (wh *Webhook) Subscribed(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event to be sent to a webhook, it is kept after delivery as the delivery log
+type WebhookDelivery struct {
+	Id            int64  `json:"id"`
+	WebhookId     int64  `json:"webhook_id" pg:",notnull"`
+	UserId        int64  `json:"-" pg:",notnull"`
+	Event         string `json:"event" pg:",notnull"`
+	Payload       string `json:"payload" pg:",notnull"`
+	Status        string `json:"status" pg:",notnull"`
+	Attempts      int    `json:"attempts" pg:",use_zero"`
+	NextAttemptAt int64  `json:"next_attempt_at" pg:",use_zero"`
+	ResponseCode  int    `json:"response_code"`
+	LastError     string `json:"last_error"`
+	CreatedAt     int64  `json:"created_at" pg:",notnull"`
+	UpdatedAt     int64  `json:"updated_at" pg:",notnull"`
+}
+
+type WebhookPayload struct {
+	Event     string        `json:"event"`
+	Timestamp int64         `json:"timestamp"`
+	Username  string        `json:"username"`
+	Reminder  *Reminder     `json:"reminder,omitempty"`
+	Command   *CommandEvent `json:"command,omitempty"` // for command events
+}
+
+type WebhookCreated struct {
+	*Webhook
+	Secret string `json:"secret"` // only shown once, when the webhook is created
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validWebhookUrl rejects hosts which are loopback, private or link local addresses. Host names are checked again
+// after DNS resolution when the webhook is sent, see webhookDialControl.
+func validWebhookUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicWebhookIp(ip) {
+		return false
+	}
+	return true
+}
+
+// blocked webhook networks, besides loopback, link local and unspecified addresses
+var privateWebhookNets = mustParseCidrs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10", // carrier grade NAT
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15", // benchmarking
+	"fc00::/7",      // unique local
+)
+
+func mustParseCidrs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// publicWebhookIp is false for addresses of the server host and internal networks, webhooks must not reach them
+func publicWebhookIp(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, ipNet := range privateWebhookNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses connections to non public addresses, after DNS resolution, so host names resolving to
+// internal addresses cannot be used to reach them
+func webhookDialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicWebhookIp(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// newWebhookHttpClient connects to public addresses only and does not follow redirects
+func newWebhookHttpClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookDeliveryTimeout,
+		Control: webhookDialControl,
+	}
+	return &http.Client{
+		Timeout: webhookDeliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookDeliveryTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebhookSignature is the hex HMAC-SHA256 of the payload, sent in the X-TB-Signature header as "sha256=<signature>"
+func WebhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher sends reminder events to user webhooks. Deliveries are stored in the DB before they are sent,
+// so pending retries survive server restarts.
+type WebhookDispatcher struct {
+	db         BuddyDb
+	leader     LeaderElector
+	httpClient *http.Client
+	stopChan   chan Signal
+	now        func() time.Time
+}
+
+func NewWebhookDispatcher(db BuddyDb, httpClient *http.Client, leader LeaderElector) *WebhookDispatcher {
+	if httpClient == nil {
+		httpClient = newWebhookHttpClient()
+	}
+	return &WebhookDispatcher{
+		db:         db,
+		leader:     leader,
+		httpClient: httpClient,
+		stopChan:   make(chan Signal, 1),
+		now:        time.Now,
+	}
+}
+
+// Enqueue stores a delivery for every user webhook subscribed to the reminder event
+func (wd *WebhookDispatcher) Enqueue(user *User, event string, reminder *Reminder) {
+	wd.enqueue(user, WebhookPayload{Event: event, Username: user.Username, Reminder: reminder})
+}
+
+// EnqueueCommand stores a delivery for every user webhook subscribed to the command event
+func (wd *WebhookDispatcher) EnqueueCommand(user *User, event string, command *CommandEvent) {
+	wd.enqueue(user, WebhookPayload{Event: event, Username: user.Username, Command: command})
+}
+
+func (wd *WebhookDispatcher) enqueue(user *User, payload WebhookPayload) {
+	event := payload.Event
+	webhooks, err := wd.db.GetWebhooks(user.Id)
+	if err != nil {
+		log.Errorf("failed to get webhooks for user %s: %s", user.Username, err)
+		return
+	}
+
+	now := wd.now().Unix()
+	payload.Timestamp = now
+	for _, wh := range webhooks {
+		if !wh.Subscribed(event) {
+			continue
+		}
+
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			log.Errorf("failed to marshal webhook %d payload for event %s: %s", wh.Id, event, err)
+			continue
+		}
+
+		delivery := &WebhookDelivery{
+			WebhookId:     wh.Id,
+			UserId:        user.Id,
+			Event:         event,
+			Payload:       string(payloadBytes),
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if err := wd.db.SaveWebhookDelivery(delivery); err != nil {
+			log.Errorf("failed to store webhook %d delivery for event %s: %s", wh.Id, event, err)
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) Start() {
+	for {
+		select {
+		case <-wd.stopChan:
+			log.Println("stopping webhook deliveries")
+			return
+		case <-time.After(webhookScanPeriod):
+			// deliveries are stored by all instances, and sent by the leader only
+			if wd.leader.Leader() {
+				wd.DeliverPending()
+			}
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) Stop() {
+	wd.stopChan <- EmptySignal
+}
+
+// DeliverPending sends all deliveries whose next attempt is due
+func (wd *WebhookDispatcher) DeliverPending() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("DeliverPending recovered from panic: %s", r)
+		}
+	}()
+
+	deliveries, err := wd.db.GetPendingWebhookDeliveries(wd.now().Unix(), webhookScanBatchSize)
+	if err != nil {
+		log.Errorf("failed to get pending webhook deliveries: %s", err)
+		return
+	}
+
+	for _, d := range deliveries {
+		wd.deliver(d)
+	}
+}
+
+func (wd *WebhookDispatcher) deliver(delivery *WebhookDelivery) {
+	delivery.Attempts++
+
+	wh, err := wd.db.GetWebhook(delivery.UserId, delivery.WebhookId)
+	if err != nil {
+		// webhook was removed meanwhile
+		wd.finishDelivery(delivery, WebhookDeliveryFailed, 0, fmt.Sprintf("webhook not found: %s", err))
+		return
+	}
+
+	responseCode, err := wd.post(wh, delivery)
+	if err == nil {
+		wd.finishDelivery(delivery, WebhookDeliveryDelivered, responseCode, "")
+		return
+	}
+
+	log.Warnf("webhook %d delivery %d attempt %d failed: %s", wh.Id, delivery.Id, delivery.Attempts, err)
+	if delivery.Attempts >= webhookMaxAttempts {
+		wd.finishDelivery(delivery, WebhookDeliveryFailed, responseCode, err.Error())
+		return
+	}
+
+	delivery.ResponseCode = responseCode
+	delivery.LastError = err.Error()
+	delivery.NextAttemptAt = wd.now().Add(webhookRetryDelay(delivery.Attempts)).Unix()
+	delivery.UpdatedAt = wd.now().Unix()
+	if err := wd.db.SaveWebhookDelivery(delivery); err != nil {
+		log.Errorf("failed to save webhook delivery %d: %s", delivery.Id, err)
+	}
+}
+
+func (wd *WebhookDispatcher) finishDelivery(delivery *WebhookDelivery, status string, responseCode int, lastError string) {
+	delivery.Status = status
+	delivery.ResponseCode = responseCode
+	delivery.LastError = lastError
+	delivery.UpdatedAt = wd.now().Unix()
+	if err := wd.db.SaveWebhookDelivery(delivery); err != nil {
+		log.Errorf("failed to save webhook delivery %d: %s", delivery.Id, err)
+	}
+}
+
+// post sends the delivery payload, a non 2xx response is an error
+func (wd *WebhookDispatcher) post(wh *Webhook, delivery *WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, wh.Url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "terminal-buddy-webhooks")
+	req.Header.Set("X-TB-Event", delivery.Event)
+	req.Header.Set("X-TB-Delivery", fmt.Sprintf("%d", delivery.Id))
+	req.Header.Set("X-TB-Signature", "sha256="+WebhookSignature(wh.Secret, payload))
+
+	resp, err := wd.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the response body is not kept, the delivery log must not show the users what internal hosts answer
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay doubles the delay with every failed attempt
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookRetryMaxDelay {
+			return webhookRetryMaxDelay
+		}
+	}
+	return delay
+}
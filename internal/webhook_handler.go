@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const maxWebhookDeliveriesLimit = 100
+
+type WebhookHandler struct {
+	db      BuddyDb
+	limiter *LoginLimiter
+	router  *mux.Router
+}
+
+func NewWebhookHandler(db BuddyDb, limiter *LoginLimiter, webhookRouter *mux.Router) {
+	handler := &WebhookHandler{
+		db:      db,
+		limiter: limiter,
+		router:  webhookRouter,
+	}
+
+	webhookRouter.HandleFunc("/{username}", handler.handleList).Methods("GET")
+	webhookRouter.HandleFunc("/{username}", handler.handleNew).Methods("POST")
+	webhookRouter.HandleFunc("/{username}/{id:[0-9]+}", handler.handleDelete).Methods("DELETE")
+	webhookRouter.HandleFunc("/{username}/{id:[0-9]+}/deliveries", handler.handleDeliveries).Methods("GET")
+}
+
+func (handler *WebhookHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	webhooks, err := db.GetWebhooks(user.Id)
+	if err != nil {
+		requestLog(r).Errorf("error getting user [%s] webhooks: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get webhooks")
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*Webhook{}
+	}
+
+	webhooksJsonBytes, err := json.Marshal(webhooks)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] webhooks: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: webhooksJsonBytes,
+	})
+}
+
+func (handler *WebhookHandler) handleNew(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		requestLog(r).Errorf("error parsing form values [%s]: %s", r.URL.Path, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "parsing error")
+		return
+	}
+
+	// webhooks send reminders out, the password alone must not be enough to add one
+	if user.TotpEnabled && !verifySecondFactor(db, handler.limiter, w, r, user) {
+		return
+	}
+
+	webhookUrl := r.FormValue("url")
+	if !validWebhookUrl(webhookUrl) {
+		sendSimpleBadRequestResponse(w, "url missing / invalid")
+		return
+	}
+
+	var events []string
+	for _, e := range strings.Split(r.FormValue("events"), ",") {
+		e = strings.TrimSpace(e)
+		if len(e) == 0 {
+			continue
+		}
+		if !validWebhookEvent(e) {
+			sendSimpleBadRequestResponse(w, "unknown event: "+e)
+			return
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+
+	// a random secret is generated if the user does not provide one
+	secret := r.FormValue("secret")
+	if len(secret) == 0 {
+		var err error
+		if secret, err = newRandomToken(); err != nil {
+			requestLog(r).Errorf("error generating webhook secret for user [%s]: %s", user.Username, err.Error())
+			sendSimpleErrResponse(w, http.StatusInternalServerError, "secret error")
+			return
+		}
+	}
+
+	webhook := &Webhook{
+		UserId: user.Id,
+		Url:    webhookUrl,
+		Secret: secret,
+		Events: events,
+	}
+	if err := db.SaveWebhook(webhook); err != nil {
+		requestLog(r).Errorf("error saving webhook for user [%s]: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot save webhook")
+		return
+	}
+
+	webhookJsonBytes, err := json.Marshal(WebhookCreated{Webhook: webhook, Secret: secret})
+	if err != nil {
+		requestLog(r).Errorf("error marshaling user [%s] webhook: %s", user.Username, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "added",
+		DataJsonBytes: webhookJsonBytes,
+	})
+}
+
+func (handler *WebhookHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id value invalid")
+		return
+	}
+
+	if err := db.DeleteWebhook(user.Id, id); err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	sendSimpleResponse(w, "deleted")
+}
+
+func (handler *WebhookHandler) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	db := handler.db.WithContext(r.Context())
+	user, ok := headerAuthorizedUser(db, handler.limiter, w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendSimpleBadRequestResponse(w, "id value invalid")
+		return
+	}
+
+	if _, err := db.GetWebhook(user.Id, id); err != nil {
+		sendSimpleErrResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	limit := maxWebhookDeliveriesLimit
+	if limitStr := r.URL.Query().Get("limit"); len(limitStr) > 0 {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			sendSimpleBadRequestResponse(w, "limit value invalid")
+			return
+		}
+		if limit > maxWebhookDeliveriesLimit {
+			limit = maxWebhookDeliveriesLimit
+		}
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(id, limit)
+	if err != nil {
+		requestLog(r).Errorf("error getting webhook %d deliveries: %s", id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "cannot get deliveries")
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*WebhookDelivery{}
+	}
+
+	deliveriesJsonBytes, err := json.Marshal(deliveries)
+	if err != nil {
+		requestLog(r).Errorf("error marshaling webhook %d deliveries: %s", id, err.Error())
+		sendSimpleErrResponse(w, http.StatusInternalServerError, "marshaling error")
+		return
+	}
+
+	sendResp(w, http.StatusOK, Response{
+		Ok:            true,
+		Message:       "ok",
+		DataJsonBytes: deliveriesJsonBytes,
+	})
+}
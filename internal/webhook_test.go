@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests, and answers with the queued status codes, then with 200
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+
+	status := http.StatusOK
+	if len(wr.statuses) > 0 {
+		status, wr.statuses = wr.statuses[0], wr.statuses[1:]
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte("internal details"))
+}
+
+func (wr *webhookReceiver) count() int {
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return len(wr.requests)
+}
+
+type testLeader struct{}
+
+func (testLeader) Leader() bool { return true }
+func (testLeader) Close() error { return nil }
+
+func newTestWebhook(t *testing.T, db BuddyDb, receiverUrl string) (*User, *Webhook) {
+	user := &User{Username: "alice"}
+	if err := db.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	webhook := &Webhook{UserId: user.Id, Url: receiverUrl, Secret: "secret", Events: webhookEvents}
+	if err := db.SaveWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	return user, webhook
+}
+
+func newTestDispatcher(db BuddyDb, server *httptest.Server, now time.Time) *WebhookDispatcher {
+	// the receiver is on the loopback address, which the default client refuses
+	wd := NewWebhookDispatcher(db, server.Client(), testLeader{})
+	wd.now = func() time.Time { return now }
+	return wd
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	db := NewMemDb()
+	user, webhook := newTestWebhook(t, db, server.URL)
+	wd := newTestDispatcher(db, server, time.Unix(1600000000, 0))
+
+	reminder := &Reminder{Id: 7, Message: "deploy", DueDate: 1600000000}
+	wd.Enqueue(user, WebhookEventReminderDue, reminder)
+	wd.DeliverPending()
+
+	if receiver.count() != 1 {
+		t.Fatalf("expected 1 request, got %d", receiver.count())
+	}
+	req, body := receiver.requests[0], receiver.bodies[0]
+	if got, want := req.Header.Get("X-TB-Signature"), "sha256="+WebhookSignature(webhook.Secret, body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-TB-Event"); got != WebhookEventReminderDue {
+		t.Errorf("event header %q", got)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != WebhookEventReminderDue || payload.Username != "alice" || payload.Reminder.Id != 7 {
+		t.Errorf("unexpected payload %s", body)
+	}
+
+	deliveries, _ := db.GetWebhookDeliveries(webhook.Id, 10)
+	if len(deliveries) != 1 || deliveries[0].Status != WebhookDeliveryDelivered || deliveries[0].ResponseCode != 200 {
+		t.Errorf("unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	db := NewMemDb()
+	user, webhook := newTestWebhook(t, db, server.URL)
+	now := time.Unix(1600000000, 0)
+	wd := newTestDispatcher(db, server, now)
+
+	wd.Enqueue(user, WebhookEventReminderAcked, &Reminder{Id: 1, Message: "m"})
+	wd.DeliverPending()
+
+	deliveries, _ := db.GetWebhookDeliveries(webhook.Id, 10)
+	delivery := deliveries[0]
+	if delivery.Status != WebhookDeliveryPending || delivery.Attempts != 1 || delivery.ResponseCode != 500 {
+		t.Fatalf("unexpected delivery after failure %+v", delivery)
+	}
+	if delivery.NextAttemptAt != now.Add(webhookRetryBaseDelay).Unix() {
+		t.Errorf("next attempt at %d, want base delay", delivery.NextAttemptAt)
+	}
+	if delivery.LastError != "receiver responded with 500" {
+		t.Errorf("last error %q must not carry the response body", delivery.LastError)
+	}
+
+	// not due yet
+	wd.DeliverPending()
+	if receiver.count() != 1 {
+		t.Fatalf("retried before the delay, %d requests", receiver.count())
+	}
+
+	// second failure doubles the delay
+	now = now.Add(webhookRetryBaseDelay)
+	wd.now = func() time.Time { return now }
+	wd.DeliverPending()
+	if delivery.Attempts != 2 || delivery.NextAttemptAt != now.Add(2*webhookRetryBaseDelay).Unix() {
+		t.Fatalf("unexpected delivery after second failure %+v", delivery)
+	}
+
+	// a restarted server sends the stored delivery
+	now = now.Add(2 * webhookRetryBaseDelay)
+	restarted := newTestDispatcher(db, server, now)
+	restarted.DeliverPending()
+	deliveries, _ = db.GetWebhookDeliveries(webhook.Id, 10)
+	if receiver.count() != 3 || deliveries[0].Status != WebhookDeliveryDelivered || deliveries[0].Attempts != 3 {
+		t.Errorf("unexpected delivery after restart %+v, %d requests", deliveries[0], receiver.count())
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	if d := webhookRetryDelay(1); d != webhookRetryBaseDelay {
+		t.Errorf("first delay %s", d)
+	}
+	if d := webhookRetryDelay(3); d != 4*webhookRetryBaseDelay {
+		t.Errorf("third delay %s", d)
+	}
+	if d := webhookRetryDelay(webhookMaxAttempts * 2); d != webhookRetryMaxDelay {
+		t.Errorf("delay not capped: %s", d)
+	}
+}
+
+func TestWebhookInternalTargets(t *testing.T) {
+	for _, u := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.1/hook",
+		"http://[::1]/hook",
+		"ftp://example.com/hook",
+	} {
+		if validWebhookUrl(u) {
+			t.Errorf("%s accepted", u)
+		}
+	}
+	if !validWebhookUrl("https://example.com/hook") {
+		t.Error("public url rejected")
+	}
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// stored before the check, or a host name resolving to loopback: refused when dialing
+	db := NewMemDb()
+	user, webhook := newTestWebhook(t, db, server.URL)
+	wd := NewWebhookDispatcher(db, nil, testLeader{})
+	wd.Enqueue(user, WebhookEventReminderDue, &Reminder{Id: 1, Message: "m"})
+	wd.DeliverPending()
+
+	if receiver.count() != 0 {
+		t.Fatal("loopback receiver reached")
+	}
+	deliveries, _ := db.GetWebhookDeliveries(webhook.Id, 10)
+	if deliveries[0].Status != WebhookDeliveryPending || deliveries[0].ResponseCode != 0 {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+}
+
+func TestWebhookRedirectNotFollowed(t *testing.T) {
+	target := &webhookReceiver{}
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(targetServer.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	db := NewMemDb()
+	user, webhook := newTestWebhook(t, db, redirect.URL)
+	// the redirect policy of the default client, with a client allowed to reach the test servers
+	client := redirect.Client()
+	client.CheckRedirect = newWebhookHttpClient().CheckRedirect
+	wd := NewWebhookDispatcher(db, client, testLeader{})
+	wd.Enqueue(user, WebhookEventReminderDue, &Reminder{Id: 1, Message: "m"})
+	wd.DeliverPending()
+
+	if target.count() != 0 {
+		t.Fatal("redirect followed")
+	}
+	deliveries, _ := db.GetWebhookDeliveries(webhook.Id, 10)
+	if deliveries[0].ResponseCode != http.StatusTemporaryRedirect || deliveries[0].Status != WebhookDeliveryPending {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+}
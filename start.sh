@@ -1,2 +1,2 @@
 #!/usr/bin/env bash
-go run cmd/main.go -port=8088
+go run ./cmd -port=8088